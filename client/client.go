@@ -0,0 +1,234 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+
+	"go_db/server"
+)
+
+// 通过网络访问server.DB，方法和*server.DB一致
+// Client上的操作各自是一个事务，Begin会建立一个新的连接给事务使用
+type Client struct {
+	conn
+	network string
+	addr    string
+}
+
+// a remote transaction, 使用自己的连接
+type Tx struct {
+	conn
+}
+
+// a connection, 请求和响应一一对应
+type conn struct {
+	mu sync.Mutex
+	c  net.Conn
+	r  *bufio.Reader
+}
+
+func Dial(network, addr string) (*Client, error) {
+	c := &Client{network: network, addr: addr}
+	if err := c.conn.dial(network, addr); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Client) Close() error {
+	return c.c.Close()
+}
+
+func (c *Client) Begin(tx *Tx) error {
+	if err := tx.dial(c.network, c.addr); err != nil {
+		return err
+	}
+	if _, err := tx.call(&server.Request{Op: server.OP_BEGIN}); err != nil {
+		tx.c.Close()
+		return err
+	}
+	return nil
+}
+
+// 提交后关闭事务的连接，冲突时返回server.ErrConflict
+func (c *Client) Commit(tx *Tx) error {
+	defer tx.c.Close()
+	_, err := tx.call(&server.Request{Op: server.OP_COMMIT})
+	return err
+}
+
+// 连接关闭时服务端也会回滚，不需要等待响应的错误
+func (c *Client) Abort(tx *Tx) {
+	defer tx.c.Close()
+	tx.call(&server.Request{Op: server.OP_ABORT})
+}
+
+func (c *conn) dial(network, addr string) error {
+	nc, err := net.Dial(network, addr)
+	if err != nil {
+		return fmt.Errorf("dial %s %s: %w", network, addr, err)
+	}
+	c.c = nc
+	c.r = bufio.NewReader(nc)
+	return nil
+}
+
+func (c *conn) call(req *server.Request) (server.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.roundTrip(req)
+}
+
+// 调用者持有c.mu
+func (c *conn) roundTrip(req *server.Request) (server.Response, error) {
+	if err := server.WriteFrame(c.c, req.Encode()); err != nil {
+		return server.Response{}, err
+	}
+	data, err := server.ReadFrame(c.r)
+	if err != nil {
+		return server.Response{}, err
+	}
+	res, err := server.DecodeResponse(data)
+	if err != nil {
+		return server.Response{}, err
+	}
+	return res, res.Err()
+}
+
+func (c *conn) Get(table string, rec *server.Record) (bool, error) {
+	res, err := c.call(&server.Request{Op: server.OP_GET, Table: table, Rec: *rec})
+	if err != nil || !res.Ok {
+		return false, err
+	}
+	*rec = res.Recs[0]
+	return true, nil
+}
+
+func (c *conn) Insert(table string, rec server.Record) (bool, error) {
+	return c.Set(table, rec, server.MODE_INSERT_ONLY)
+}
+
+func (c *conn) Update(table string, rec server.Record) (bool, error) {
+	return c.Set(table, rec, server.MODE_UPDATE_ONLY)
+}
+
+func (c *conn) Upsert(table string, rec server.Record) (bool, error) {
+	return c.Set(table, rec, server.MODE_UPSERT)
+}
+
+func (c *conn) Set(table string, rec server.Record, mode int) (bool, error) {
+	res, err := c.call(&server.Request{Op: server.OP_SET, Table: table, Rec: rec, Mode: mode})
+	return res.Ok, err
+}
+
+func (c *conn) Delete(table string, rec server.Record) (bool, error) {
+	res, err := c.call(&server.Request{Op: server.OP_DELETE, Table: table, Rec: rec})
+	return res.Ok, err
+}
+
+func (c *conn) TableNew(tdef *server.TableDef) error {
+	data, err := json.Marshal(tdef)
+	if err != nil {
+		return err
+	}
+	_, err = c.call(&server.Request{Op: server.OP_TABLE_NEW, Data: data})
+	return err
+}
+
+// 结果分页返回，取完所有的页之前不能在这个连接上发送其他请求
+func (c *conn) Exec(query string) (server.QLResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	res, err := c.roundTrip(&server.Request{Op: server.OP_EXEC, Data: []byte(query)})
+	if err != nil {
+		return server.QLResult{}, err
+	}
+	result := server.QLResult{Names: res.Names, Rows: res.Recs, Affected: res.Affected}
+	for res.Ok {
+		res, err = c.roundTrip(&server.Request{Op: server.OP_EXEC_NEXT})
+		if err != nil {
+			return server.QLResult{}, err
+		}
+		result.Rows = append(result.Rows, res.Recs...)
+	}
+	return result, nil
+}
+
+// 服务端分页返回结果，这里取回第一页，Scanner.Next在当前页用完之后再取下一页
+// 不在事务中时每一页是一个单独的读事务，需要一致的结果时在Tx上Scan
+func (c *conn) Scan(table string, req *Scanner) error {
+	req.c, req.table = c, table
+	req.rows, req.pos, req.err = nil, 0, nil
+	return scanFetch(req, req.Key1, req.Cmp1)
+}
+
+// fetch the page starting from key1
+func scanFetch(sc *Scanner, key1 server.Record, cmp1 int) error {
+	res, err := sc.c.call(&server.Request{
+		Op: server.OP_SCAN, Table: sc.table,
+		Key1: key1, Key2: sc.Key2, Cmp1: cmp1, Cmp2: sc.Cmp2,
+	})
+	if err != nil {
+		return err
+	}
+	sc.rows, sc.pos = res.Recs, 0
+	sc.more, sc.next = res.Ok, res.Next
+	return nil
+}
+
+// the same as server.Scanner
+type Scanner struct {
+	// the range, from Key1 to Key2
+	Cmp1 int // CMP_??
+	Cmp2 int
+	Key1 server.Record
+	Key2 server.Record
+
+	c     *conn
+	table string
+	rows  []server.Record // the current page
+	pos   int
+	more  bool          // there are more pages
+	next  server.Record // the key of the last row
+	err   error         // failed to fetch the next page
+}
+
+func (sc *Scanner) Valid() bool {
+	return sc.err != nil || sc.pos < len(sc.rows)
+}
+
+// 当前页用完之后取下一页，失败时Valid仍然为true，错误由Deref返回
+func (sc *Scanner) Next() {
+	if sc.err != nil {
+		sc.Close()
+		return
+	}
+	sc.pos++
+	if sc.pos < len(sc.rows) || !sc.more {
+		return
+	}
+	// 从上一页的最后一行之后继续
+	cmp1 := server.CMP_GT
+	if sc.Cmp1 < 0 {
+		cmp1 = server.CMP_LT
+	}
+	if err := scanFetch(sc, sc.next, cmp1); err != nil {
+		sc.err = err
+	}
+}
+
+func (sc *Scanner) Deref(rec *server.Record) error {
+	if sc.err != nil {
+		return sc.err
+	}
+	*rec = sc.rows[sc.pos]
+	return nil
+}
+
+func (sc *Scanner) Close() {
+	sc.rows, sc.more, sc.err = nil, false, nil
+}
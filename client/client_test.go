@@ -0,0 +1,303 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"go_db/server"
+)
+
+func newTestClient(t *testing.T) *Client {
+	dir := t.TempDir()
+	db, err := server.Open(dir+"/test.db", server.Options{SyncMode: server.SyncNever})
+	if err != nil {
+		t.Fatalf("fail to open db, err: %s", err)
+	}
+	l, err := net.Listen("unix", dir+"/godb.sock")
+	if err != nil {
+		t.Fatalf("fail to listen, err: %s", err)
+	}
+	served := make(chan struct{})
+	go func() {
+		db.Serve(l)
+		close(served)
+	}()
+
+	c, err := Dial("unix", dir+"/godb.sock")
+	if err != nil {
+		t.Fatalf("fail to dial, err: %s", err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+		l.Close()
+		<-served
+		db.Close()
+	})
+	return c
+}
+
+func account(id string, balance int) server.Record {
+	return *(&server.Record{}).AddStr("id", []byte(id)).AddStr("balance", []byte(fmt.Sprint(balance)))
+}
+
+func TestClient(t *testing.T) {
+	c := newTestClient(t)
+	tdef := &server.TableDef{Name: "accounts", Types: []uint32{server.TYPE_BYTES, server.TYPE_BYTES}, Cols: []string{"id", "balance"}, PKeys: 1}
+	if err := c.TableNew(tdef); err != nil {
+		t.Fatalf("fail to create table, err: %s", err)
+	}
+	for i, id := range []string{"a", "b", "c"} {
+		if ok, err := c.Insert("accounts", account(id, i)); !ok || err != nil {
+			t.Fatalf("fail to insert, ok: %v, err: %v", ok, err)
+		}
+	}
+	if ok, err := c.Update("accounts", account("b", 10)); !ok || err != nil {
+		t.Fatalf("fail to update, ok: %v, err: %v", ok, err)
+	}
+	if ok, err := c.Delete("accounts", *(&server.Record{}).AddStr("id", []byte("c"))); !ok || err != nil {
+		t.Fatalf("fail to delete, ok: %v, err: %v", ok, err)
+	}
+
+	rec := (&server.Record{}).AddStr("id", []byte("b"))
+	if ok, err := c.Get("accounts", rec); !ok || err != nil || string(rec.Get("balance").Str) != "10" {
+		t.Fatalf("fail to get, ok: %v, err: %v, rec: %v", ok, err, rec)
+	}
+	if _, err := c.Get("nope", rec); err == nil {
+		t.Fatalf("expect an error on a missing table")
+	}
+
+	sc := &Scanner{Cmp1: server.CMP_GE, Cmp2: server.CMP_LE}
+	if err := c.Scan("accounts", sc); err != nil {
+		t.Fatalf("fail to scan, err: %s", err)
+	}
+	ids := ""
+	for ; sc.Valid(); sc.Next() {
+		rec := server.Record{}
+		if err := sc.Deref(&rec); err != nil {
+			t.Fatalf("fail to deref, err: %s", err)
+		}
+		ids += string(rec.Get("id").Str)
+	}
+	if ids != "ab" {
+		t.Fatalf("wrong scan result: %s", ids)
+	}
+
+	res, err := c.Exec("select id from accounts where id = 'a'")
+	if err != nil || len(res.Rows) != 1 {
+		t.Fatalf("fail to exec, res: %v, err: %v", res, err)
+	}
+}
+
+func TestClientTX(t *testing.T) {
+	c := newTestClient(t)
+	tdef := &server.TableDef{Name: "accounts", Types: []uint32{server.TYPE_BYTES, server.TYPE_BYTES}, Cols: []string{"id", "balance"}, PKeys: 1}
+	if err := c.TableNew(tdef); err != nil {
+		t.Fatalf("fail to create table, err: %s", err)
+	}
+	c.Insert("accounts", account("a", 100))
+
+	// uncommitted writes are invisible to other connections
+	tx := Tx{}
+	if err := c.Begin(&tx); err != nil {
+		t.Fatalf("fail to begin, err: %s", err)
+	}
+	tx.Update("accounts", account("a", 50))
+	rec := (&server.Record{}).AddStr("id", []byte("a"))
+	c.Get("accounts", rec)
+	if string(rec.Get("balance").Str) != "100" {
+		t.Fatalf("uncommitted write is visible: %v", rec)
+	}
+	c.Abort(&tx)
+
+	// two transactions read and write the same row
+	tx1, tx2 := Tx{}, Tx{}
+	c.Begin(&tx1)
+	c.Begin(&tx2)
+	tx1.Get("accounts", (&server.Record{}).AddStr("id", []byte("a")))
+	tx2.Get("accounts", (&server.Record{}).AddStr("id", []byte("a")))
+	tx1.Update("accounts", account("a", 1))
+	tx2.Update("accounts", account("a", 2))
+	if err := c.Commit(&tx1); err != nil {
+		t.Fatalf("fail to commit, err: %s", err)
+	}
+	if err := c.Commit(&tx2); !errors.Is(err, server.ErrConflict) {
+		t.Fatalf("expect a conflict, err: %v", err)
+	}
+}
+
+// 关闭listener之后Serve等待所有的连接结束，未提交的事务回滚
+func TestServeShutdown(t *testing.T) {
+	dir := t.TempDir()
+	db, err := server.Open(dir+"/test.db", server.Options{SyncMode: server.SyncNever})
+	if err != nil {
+		t.Fatalf("fail to open db, err: %s", err)
+	}
+	defer db.Close()
+	l, err := net.Listen("unix", dir+"/godb.sock")
+	if err != nil {
+		t.Fatalf("fail to listen, err: %s", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- db.Serve(l) }()
+
+	c, err := Dial("unix", dir+"/godb.sock")
+	if err != nil {
+		t.Fatalf("fail to dial, err: %s", err)
+	}
+	defer c.Close()
+	tdef := &server.TableDef{Name: "accounts", Types: []uint32{server.TYPE_BYTES, server.TYPE_BYTES}, Cols: []string{"id", "balance"}, PKeys: 1}
+	if err := c.TableNew(tdef); err != nil {
+		t.Fatalf("fail to create table, err: %s", err)
+	}
+	tx := Tx{}
+	if err := c.Begin(&tx); err != nil {
+		t.Fatalf("fail to begin, err: %s", err)
+	}
+	if _, err := tx.Insert("accounts", account("a", 100)); err != nil {
+		t.Fatalf("fail to insert, err: %s", err)
+	}
+
+	l.Close()
+	select {
+	case err := <-served:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("unexpected serve error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Serve does not return")
+	}
+	// the connections are closed and the transaction is aborted
+	if _, err := tx.Get("accounts", (&server.Record{}).AddStr("id", []byte("a"))); err == nil {
+		t.Fatalf("the connection should be closed")
+	}
+	if ok, err := db.Get("accounts", (&server.Record{}).AddStr("id", []byte("a"))); ok || err != nil {
+		t.Fatalf("the open transaction should be aborted, ok: %v, err: %v", ok, err)
+	}
+}
+
+// 超过一页的结果分多次取回
+func TestClientScanPages(t *testing.T) {
+	c := newTestClient(t)
+	tdef := &server.TableDef{
+		Name: "accounts", Types: []uint32{server.TYPE_BYTES, server.TYPE_BYTES}, Cols: []string{"id", "balance"}, PKeys: 1,
+		Indexes: [][]string{{"balance"}},
+	}
+	if err := c.TableNew(tdef); err != nil {
+		t.Fatalf("fail to create table, err: %s", err)
+	}
+	n := 2*server.PROTO_SCAN_ROWS + 10
+	tx := Tx{}
+	if err := c.Begin(&tx); err != nil {
+		t.Fatalf("fail to begin, err: %s", err)
+	}
+	for i := 0; i < n; i++ {
+		// the balances repeat, the index pages continue after the last primary key
+		if _, err := tx.Insert("accounts", account(fmt.Sprintf("%05d", i), i%7)); err != nil {
+			t.Fatalf("fail to insert, err: %s", err)
+		}
+	}
+	if err := c.Commit(&tx); err != nil {
+		t.Fatalf("fail to commit, err: %s", err)
+	}
+
+	count := func(sc *Scanner) int {
+		if err := c.Scan("accounts", sc); err != nil {
+			t.Fatalf("fail to scan, err: %s", err)
+		}
+		defer sc.Close()
+		if len(sc.rows) > server.PROTO_SCAN_ROWS {
+			t.Fatalf("fetched more than one page, rows: %d", len(sc.rows))
+		}
+		seen, rows := map[string]bool{}, 0
+		for ; sc.Valid(); sc.Next() {
+			rec := server.Record{}
+			if err := sc.Deref(&rec); err != nil {
+				t.Fatalf("fail to deref, err: %s", err)
+			}
+			seen[string(rec.Get("id").Str)] = true
+			rows++
+		}
+		if len(seen) != rows {
+			t.Fatalf("duplicated rows across pages, rows: %d, unique: %d", rows, len(seen))
+		}
+		return rows
+	}
+	if got := count(&Scanner{Cmp1: server.CMP_GE, Cmp2: server.CMP_LE}); got != n {
+		t.Fatalf("wrong number of rows, got: %d, expected: %d", got, n)
+	}
+	if got := count(&Scanner{Cmp1: server.CMP_LE, Cmp2: server.CMP_GE}); got != n {
+		t.Fatalf("wrong number of rows in descending order, got: %d, expected: %d", got, n)
+	}
+	lo, hi := *(&server.Record{}).AddStr("balance", []byte("0")), *(&server.Record{}).AddStr("balance", []byte("9"))
+	if got := count(&Scanner{Cmp1: server.CMP_GE, Cmp2: server.CMP_LE, Key1: lo, Key2: hi}); got != n {
+		t.Fatalf("wrong number of rows by the index, got: %d, expected: %d", got, n)
+	}
+
+	// 取下一页失败时Deref返回错误
+	sc := &Scanner{Cmp1: server.CMP_GE, Cmp2: server.CMP_LE}
+	if err := c.Scan("accounts", sc); err != nil {
+		t.Fatalf("fail to scan, err: %s", err)
+	}
+	c.c.Close()
+	rows := 0
+	for ; sc.Valid(); sc.Next() {
+		rec := server.Record{}
+		if err := sc.Deref(&rec); err != nil {
+			break
+		}
+		rows++
+	}
+	if rows != server.PROTO_SCAN_ROWS || !sc.Valid() {
+		t.Fatalf("expect an error after the first page, rows: %d", rows)
+	}
+	sc.Next()
+	if sc.Valid() {
+		t.Fatal("the scanner should end after the error")
+	}
+}
+
+func TestClientExecPages(t *testing.T) {
+	c := newTestClient(t)
+	tdef := &server.TableDef{Name: "accounts", Types: []uint32{server.TYPE_BYTES, server.TYPE_BYTES}, Cols: []string{"id", "balance"}, PKeys: 1}
+	if err := c.TableNew(tdef); err != nil {
+		t.Fatalf("fail to create table, err: %s", err)
+	}
+	n := 2*server.PROTO_SCAN_ROWS + 10
+	tx := Tx{}
+	if err := c.Begin(&tx); err != nil {
+		t.Fatalf("fail to begin, err: %s", err)
+	}
+	for i := 0; i < n; i++ {
+		if _, err := tx.Insert("accounts", account(fmt.Sprintf("%05d", i), i)); err != nil {
+			t.Fatalf("fail to insert, err: %s", err)
+		}
+	}
+	if err := c.Commit(&tx); err != nil {
+		t.Fatalf("fail to commit, err: %s", err)
+	}
+
+	res, err := c.Exec("select id from accounts")
+	if err != nil {
+		t.Fatalf("fail to exec, err: %s", err)
+	}
+	if len(res.Rows) != n {
+		t.Fatalf("wrong number of rows, got: %d, expected: %d", len(res.Rows), n)
+	}
+	for i, rec := range res.Rows {
+		if id := string(rec.Get("id").Str); id != fmt.Sprintf("%05d", i) {
+			t.Fatalf("wrong row %d, got: %s", i, id)
+		}
+	}
+
+	// 没有剩余的结果时返回错误，连接仍然可以使用
+	if _, err := c.call(&server.Request{Op: server.OP_EXEC_NEXT}); err == nil {
+		t.Fatal("expect an error without a pending result")
+	}
+	rec := *(&server.Record{}).AddStr("id", []byte("00001"))
+	if ok, err := c.Get("accounts", &rec); !ok || err != nil {
+		t.Fatalf("fail to get after the error, ok: %v, err: %v", ok, err)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"go_db/server"
+)
+
+// 同一台机器上的多个服务通过这个进程共享一个数据库文件
+func main() {
+	path := flag.String("db", "godb.db", "the database file")
+	network := flag.String("network", "tcp", "tcp or unix")
+	addr := flag.String("addr", "127.0.0.1:7070", "the address or the socket path to listen on")
+	pageSize := flag.Int("page-size", 0, "the page size of a new database file, 4096, 8192 or 16384")
+	verify := flag.Bool("verify", false, "check the checksums of all pages before serving")
+	wal := flag.Bool("wal", false, "write-ahead log mode, fsync the log once per commit")
+	commitDelay := flag.Duration("commit-delay", 0, "the max delay to batch concurrent commits into one flush")
+	syncMode := flag.String("sync", "always", "fsync on commits: always, never, or an interval like 100ms")
+	flag.Parse()
+
+	opts := server.Options{PageSize: *pageSize, Verify: *verify, WAL: *wal, CommitDelay: *commitDelay}
+	switch *syncMode {
+	case "always":
+		opts.SyncMode = server.SyncAlways
+	case "never":
+		opts.SyncMode = server.SyncNever
+	default:
+		interval, err := time.ParseDuration(*syncMode)
+		if err != nil || interval <= 0 {
+			log.Fatalf("bad -sync: %s", *syncMode)
+		}
+		opts.SyncMode = server.SyncEvery(interval)
+	}
+	db, err := server.Open(*path, opts)
+	if err != nil {
+		log.Fatalf("open %s: %s", *path, err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			log.Printf("close %s: %s", *path, err)
+		}
+	}()
+
+	if *network == "unix" {
+		os.Remove(*addr) // the stale socket
+	}
+	l, err := net.Listen(*network, *addr)
+	if err != nil {
+		log.Fatalf("listen %s %s: %s", *network, *addr, err)
+	}
+
+	// stop accepting connections on signals, Serve关闭所有的连接并等待它们结束，之后才Close DB
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		l.Close()
+	}()
+
+	log.Printf("serving %s on %s %s", *path, *network, *addr)
+	if err := db.Serve(l); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("serve: %s", err)
+	}
+}
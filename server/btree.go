@@ -1,73 +1,112 @@
 package server
 
 import (
+	"bytes"
 	"fmt"
 )
 
 type BTree struct {
-	root uint64 // pointer
+	root   uint64     // pointer
+	layout pageLayout // the sizes derived from the page size
+	flag   int        // 每个value前面的flag的长度，不计入BTREE_VAL_LIMIT，只有pending tree使用
 
 	get func(uint64) BNode // dereference a pointer
 	new func(BNode) uint64 // allocate a new page
 	del func(uint64)       // deallocate a page
 }
 
-func (tree *BTree) Get(key []byte) ([]byte, bool) {
-	assert(len(key) != 0, "function:Get, key is empty")
-	assert(len(key) <= BTREE_MAX_KEY_SIZE, fmt.Sprintf("function:Get, key is exceed size, key: %v", key))
+func checkKey(key []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey // 空key是哨兵
+	}
+	if len(key) > BTREE_KEY_LIMIT {
+		return fmt.Errorf("%w: %d > %d", ErrKeyTooLarge, len(key), BTREE_KEY_LIMIT)
+	}
+	return nil
+}
+
+func checkVal(tree *BTree, val []byte) error {
+	if size := len(val) - tree.flag; size > BTREE_VAL_LIMIT {
+		return fmt.Errorf("%w: %d > %d", ErrValueTooLarge, size, BTREE_VAL_LIMIT)
+	}
+	return nil
+}
+
+func (tree *BTree) Get(key []byte) (val []byte, ok bool, err error) {
+	if err := checkKey(key); err != nil {
+		return nil, false, err
+	}
+	if tree.root == 0 {
+		return nil, false, nil
+	}
+	defer recoverCorrupt(&err)
 
 	node := treeGet(tree, tree.get(tree.root), key)
 	if node.data == nil {
-		return nil, false
+		return nil, false, nil
 	}
 
-	return node.getVal(nodeLookupLE(node, key)), true
+	return leafGetVal(tree, node, nodeLookupLE(tree, node, key)), true, nil
 }
 
-func (tree *BTree) Insert(key, val []byte) {
-	assert(len(key) != 0, "function:Insert, key is empty")
-	assert(len(key) <= BTREE_MAX_KEY_SIZE, fmt.Sprintf("function:Insert, key is exceed size, key: %v", key))
-	assert(len(val) <= BTREE_MAX_VAL_SIZE, fmt.Sprintf("function:Insert, val is exceed size, val: %v", val))
+func (tree *BTree) Insert(key, val []byte) (err error) {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	if err := checkVal(tree, val); err != nil {
+		return err
+	}
+	defer recoverCorrupt(&err)
+
+	// 大的值写入overflow page，叶子节点中只保存第一个page和长度，长key在写入叶子节点时处理
+	ptr := uint64(0)
+	if len(val) > tree.layout.maxVal {
+		ptr = ovWrite(tree, val)
+		val = ovRef(len(val))
+	}
 
 	if tree.root == 0 {
-		root := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+		root := BNode{data: make([]byte, tree.layout.size)}
 		root.setHeader(BNODE_LEAF, 2)
 
 		nodeAppendKV(root, 0, 0, nil, nil)
-		nodeAppendKV(root, 1, 0, key, val)
+		raw, long := leafStoreKey(tree, key)
+		leafAppendKV(root, 1, ptr, raw, long, val)
 		tree.root = tree.new(root)
-		return
+		return nil
 	}
 
 	node := tree.get(tree.root)
 	tree.del(tree.root)
 
-	node = treeInsert(tree, node, key, val)
-	nsplit, splitted := nodeSplit3(node)
-	if nsplit > 1 {
-		root := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
-		root.setHeader(BNODE_NODE, nsplit)
+	node = treeInsert(tree, node, key, val, ptr)
+	splitted := nodeSplit(tree, node)
+	if len(splitted) > 1 {
+		root := BNode{data: make([]byte, tree.layout.size)}
+		root.setHeader(BNODE_NODE, uint16(len(splitted)))
 
-		for i, knode := range splitted[:nsplit] {
-			ptr, key := tree.new(knode), knode.getKey(0)
-			nodeAppendKV(root, uint16(i), ptr, key, nil)
+		for i, knode := range splitted {
+			nodeAppendSep(tree, root, uint16(i), tree.new(knode), knode)
 		}
 		tree.root = tree.new(root)
 	} else {
 		tree.root = tree.new(splitted[0])
 	}
+	return nil
 }
 
-func (tree *BTree) Delete(key []byte) bool {
-	assert(len(key) != 0, "function:Delete, key len is zero")
-	assert(len(key) <= BTREE_MAX_KEY_SIZE, fmt.Sprintf("function:Delete, key is exceed max key size, key: %v, len: %v", key, len(key)))
+func (tree *BTree) Delete(key []byte) (deleted bool, err error) {
+	if err := checkKey(key); err != nil {
+		return false, err
+	}
 	if tree.root == 0 {
-		return false
+		return false, nil
 	}
+	defer recoverCorrupt(&err)
 
 	updated := treeDelete(tree, tree.get(tree.root), key)
 	if len(updated.data) == 0 {
-		return false
+		return false, nil
 	}
 
 	tree.del(tree.root)
@@ -76,19 +115,64 @@ func (tree *BTree) Delete(key []byte) bool {
 	} else {
 		tree.root = tree.new(updated)
 	}
-	return true
+	return true, nil
 }
 
 type InsertReq struct {
 	tree *BTree
 
-	Added bool
-	Key   []byte
-	Val   []byte
-	Mode  int
+	// out
+	Added   bool   // added a new key
+	Updated bool   // added a new key or an old key was changed
+	Old     []byte // the value before the update, nil if the key is new
+	// in
+	Key  []byte
+	Val  []byte
+	Mode int
+}
+
+// insert or update a key according to req.Mode
+func (tree *BTree) InsertEx(req *InsertReq) error {
+	req.tree = tree
+
+	old, exists, err := tree.Get(req.Key)
+	if err != nil {
+		return err
+	}
+	write, err := req.apply(old, exists)
+	if err != nil || !write {
+		return err
+	}
+	return tree.Insert(req.Key, req.Val)
 }
-// todo
-func (tree *BTree) InsertEx(req *InsertReq) {
 
+// 根据key当前的值决定是否需要写入，并设置Old、Added和Updated
+func (req *InsertReq) apply(old []byte, exists bool) (bool, error) {
+	// req可能被重用(比如冲突后重试)，清除上一次的结果
+	req.Old, req.Added, req.Updated = nil, false, false
+	switch req.Mode {
+	case MODE_UPSERT:
+	case MODE_UPDATE_ONLY:
+		if !exists {
+			return false, nil
+		}
+	case MODE_INSERT_ONLY:
+		if exists {
+			return false, nil
+		}
+	default:
+		return false, fmt.Errorf("%w: %v", ErrBadMode, req.Mode)
+	}
+
+	if exists {
+		// old指向的page在本次写入后会被释放，需要拷贝一份
+		req.Old = append([]byte{}, old...)
+		if bytes.Equal(old, req.Val) {
+			return false, nil
+		}
+	}
 
+	req.Added = !exists
+	req.Updated = true
+	return true, nil
 }
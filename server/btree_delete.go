@@ -1,33 +1,44 @@
 package server
 
-import (
-	"bytes"
-	"fmt"
-)
+import "fmt"
 
 func treeDelete(tree *BTree, node BNode, key []byte) BNode {
-	idx := nodeLookupLE(node, key)
+	idx := nodeLookupLE(tree, node, key)
 
 	switch node.btype() {
 	case BNODE_LEAF:
-		if !bytes.Equal(key, node.getKey(idx)) {
+		if nodeCmpKey(tree, node, idx, key) != 0 {
 			return BNode{}
 		}
 
-		new := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
-		leafDelete(new, node, idx)
+		leafFreeKV(tree, node, idx)
+		new := BNode{data: make([]byte, tree.layout.size)}
+		leafDelete(tree, new, node, idx)
 		return new
 
 	case BNODE_NODE:
 		return nodeDelete(tree, node, idx, key)
 
 	default:
-		panic("bad node!")
+		panic(errCorrupt("bad node type: %d", node.btype()))
 	}
 }
 
-func leafDelete(new BNode, old BNode, idx uint16) {
-	new.setHeader(BNODE_LEAF, old.nkeys()-1)
+func leafDelete(tree *BTree, new BNode, old BNode, idx uint16) {
+	// 删除第一个或最后一个key后，公共前缀可能变长
+	nkeys := old.nkeys() - 1
+	first, last := uint16(0), nkeys
+	if idx == 0 {
+		first = 1
+	}
+	if idx == nkeys {
+		last = nkeys - 1
+	}
+	if nkeys == 0 {
+		new.setHeader(BNODE_LEAF, 0)
+	} else {
+		nodeSetHeaderKeys(tree, new, BNODE_LEAF, nkeys, old.getKey(first), old.getKey(last))
+	}
 	nodeAppendRange(new, old, 0, 0, idx)
 	nodeAppendRange(new, old, idx, idx+1, old.nkeys()-(idx+1))
 }
@@ -40,21 +51,27 @@ func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
 	}
 	tree.del(kptr)
 
-	new := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+	new := BNode{data: make([]byte, tree.layout.size)}
 	mergeDir, sibling := shouldMerge(tree, node, idx, updated)
 
 	switch {
 	case mergeDir < 0:
-		merged := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
-		nodeMerge(merged, sibling, updated)
+		merged := BNode{data: make([]byte, tree.layout.size)}
+		nodeMerge(tree, merged, sibling, updated)
 		tree.del(node.getPtr(idx - 1))
-		nodeReplace2Kid(new, node, idx-1, tree.new(merged), merged.getKey(0))
+		nodeReplace2Kid(tree, new, node, idx-1, tree.new(merged), merged)
 
 	case mergeDir > 0:
-		merged := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
-		nodeMerge(merged, updated, sibling)
+		merged := BNode{data: make([]byte, tree.layout.size)}
+		nodeMerge(tree, merged, updated, sibling)
 		tree.del(node.getPtr(idx + 1))
-		nodeReplace2Kid(new, node, idx, tree.new(merged), merged.getKey(0))
+		nodeReplace2Kid(tree, new, node, idx, tree.new(merged), merged)
+
+	case updated.nkeys() == 0:
+		// 只有一个子节点时没有兄弟节点可以合并，变成空节点，由上一层合并
+		// 第一个叶子节点中有哨兵，所以root不会变空
+		assert(node.nkeys() == 1, fmt.Sprintf("function:nodeDelete, empty kid with siblings, nkeys: %v", node.nkeys()))
+		new.setHeader(BNODE_NODE, 0)
 
 	case mergeDir == 0:
 		assert(updated.nkeys() > 0, fmt.Sprintf("function:nodeDelete, update.nkeys not bigger than 0, nkeys: %v", updated.nkeys()))
@@ -63,38 +80,43 @@ func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
 	return new
 }
 
-func nodeMerge(new BNode, left BNode, right BNode) {
-	new.setHeader(left.btype(), left.nkeys()+right.nkeys())
+func nodeMerge(tree *BTree, new BNode, left BNode, right BNode) {
+	first, last := nodeMergedEnds(left, right)
+	nodeSetHeaderKeys(tree, new, left.btype(), left.nkeys()+right.nkeys(), first, last)
 	nodeAppendRange(new, left, 0, 0, left.nkeys())
 	nodeAppendRange(new, right, left.nkeys(), 0, right.nkeys())
 }
 
 func shouldMerge(tree *BTree, node BNode, idx uint16, updated BNode) (int, BNode) {
-	if updated.nbytes() > BTREE_PAGE_SIZE/4 {
+	if int(updated.nbytes()) > tree.layout.space/4 {
 		return 0, BNode{}
 	}
 
+	// 合并后的公共前缀可能变短
+	fits := func(left, right BNode) bool {
+		return tree.layout.fits(nodeMergedBytes(tree, left, right))
+	}
+
 	if idx > 0 {
 		sibling := tree.get(node.getPtr(idx - 1))
-		merged := sibling.nbytes() + updated.nbytes() - HEADLEN
-		if merged <= BTREE_PAGE_SIZE {
+		if fits(sibling, updated) {
 			return -1, sibling
 		}
 	}
 
 	if idx+1 < node.nkeys() {
 		sibling := tree.get(node.getPtr(idx + 1))
-		merged := sibling.nbytes() + updated.nbytes() - HEADLEN
-		if merged <= BTREE_PAGE_SIZE {
+		if fits(updated, sibling) {
 			return 1, sibling
 		}
 	}
 	return 0, BNode{}
 }
 
-func nodeReplace2Kid(new, node BNode, idx uint16, merged uint64, key []byte) {
-	new.setHeader(BNODE_NODE, node.nkeys())
-	nodeAppendRange(new, node, 0, 0, idx-1)
-	nodeAppendKV(new, idx, merged, key, nil)
-	nodeAppendRange(new, node, idx+1, idx+1, node.nkeys()-(idx+1))
+// idx和idx+1两个子节点合并成一个
+func nodeReplace2Kid(tree *BTree, new, node BNode, idx uint16, ptr uint64, merged BNode) {
+	new.setHeader(BNODE_NODE, node.nkeys()-1)
+	nodeAppendRange(new, node, 0, 0, idx)
+	nodeAppendSep(tree, new, idx, ptr, merged)
+	nodeAppendRange(new, node, idx+1, idx+2, node.nkeys()-(idx+2))
 }
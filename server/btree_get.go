@@ -1,13 +1,11 @@
 package server
 
-import "bytes"
-
 func treeGet(tree *BTree, node BNode, key []byte) BNode {
-	idx := nodeLookupLE(node, key)
+	idx := nodeLookupLE(tree, node, key)
 
 	switch node.btype() {
 	case BNODE_LEAF:
-		if !bytes.Equal(key, node.getKey(idx)) {
+		if nodeCmpKey(tree, node, idx, key) != 0 {
 			return BNode{}
 		}
 		return node
@@ -18,6 +16,6 @@ func treeGet(tree *BTree, node BNode, key []byte) BNode {
 		return treeGet(tree, childPage, key)
 
 	default:
-		panic("bad node!")
+		panic(errCorrupt("bad node type: %d", node.btype()))
 	}
 }
@@ -1,29 +1,29 @@
 package server
 
-import (
-	"bytes"
-	"fmt"
-)
+import "fmt"
 
 // main function for insert a key
 // first call use root node
-func treeInsert(tree *BTree, node BNode, key, val []byte) BNode {
-	// the result
-	new := BNode{data: make([]byte, 2*BTREE_PAGE_SIZE)}
+// ptr是大的值的第一个overflow page，普通的值为0
+func treeInsert(tree *BTree, node BNode, key, val []byte, ptr uint64) BNode {
+	// the result, 叶子节点解压后最多leafRawMax，再加上新的KV
+	new := BNode{data: make([]byte, 3*tree.layout.size)}
 
-	idx := nodeLookupLE(node, key)
+	idx := nodeLookupLE(tree, node, key)
 
 	switch node.btype() {
 	case BNODE_LEAF:
-		if bytes.Equal(key, node.getKey(idx)) {
-			leafUpdate(new, node, idx, key, val)
+		if nodeCmpKey(tree, node, idx, key) == 0 {
+			// the old value is replaced, the stored key is kept
+			ovFree(tree, node.getPtr(idx))
+			leafUpdate(new, node, idx, ptr, val)
 		} else {
-			leafInsert(new, node, idx, key, val)
+			leafInsert(tree, new, node, idx, ptr, key, val)
 		}
 	case BNODE_NODE:
-		nodeInsert(tree, new, node, idx, key, val)
+		nodeInsert(tree, new, node, idx, key, val, ptr)
 	default:
-		panic("bad node!")
+		panic(errCorrupt("bad node type: %d", node.btype()))
 	}
 
 	return new
@@ -38,110 +38,108 @@ func treeInsert(tree *BTree, node BNode, key, val []byte) BNode {
 	所以在叶子节点情况下，4存的idx位置是2
 	非叶子节点情况下，返回的就是下一层page，目标值要存进这个page或者这个page下面
 */
-func nodeLookupLE(node BNode, key []byte) uint16 {
-	nkeys := node.nkeys()
-	found := uint16(0)
-
-	for i := uint16(1); i < nkeys; i++ {
-		cmp := bytes.Compare(node.getKey(i), key)
-		// 找到第一个不大于key的idx
-		if cmp <= 0 {
-			found = i
-		}
-
-		if cmp >= 0 {
-			break
+func nodeLookupLE(tree *BTree, node BNode, key []byte) uint16 {
+	// 二分查找最后一个不大于key的idx，第一个key总是不大于key，所以从1开始比较
+	// key(lo) <= key < key(hi)
+	lo, hi := uint16(0), node.nkeys()
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		if nodeCmpKey(tree, node, mid, key) <= 0 {
+			lo = mid
+		} else {
+			hi = mid
 		}
 	}
-	return found
+	return lo
 }
 
 // 新增一个key 需要拷贝一份新的page, new是将要包含新key的page, old是原来的page
 // idx是
-func leafInsert(new, old BNode, idx uint16, key, val []byte) {
-	new.setHeader(BNODE_LEAF, old.nkeys()+1)
+func leafInsert(tree *BTree, new, old BNode, idx uint16, ptr uint64, key, val []byte) {
+	raw, long := leafStoreKey(tree, key)
+	// 新的key可能是最后一个，公共前缀可能变短
+	last := raw
+	if idx+1 < old.nkeys() {
+		last = old.getKey(old.nkeys() - 1)
+	}
+	nodeSetHeaderKeys(tree, new, BNODE_LEAF, old.nkeys()+1, old.getKey(0), last)
 
 	// 最后一个参数是要拷贝几个数据, 若idx=1，则前面有idx=0,1的数据需要拷贝
 	nodeAppendRange(new, old, 0, 0, idx+1)
 	// idx+1 是目标存入的索引位置
-	nodeAppendKV(new, idx+1, 0, key, val)
+	leafAppendKV(new, idx+1, ptr, raw, long, val)
 
 	nodeAppendRange(new, old, idx+2, idx+1, old.nkeys()-(idx+1))
 }
 
-func leafUpdate(new, old BNode, idx uint16, key, val []byte) {
+func leafUpdate(new, old BNode, idx uint16, ptr uint64, val []byte) {
+	// the same keys and the same prefix
 	new.setHeader(BNODE_LEAF, old.nkeys())
+	new.setPrefix(old.prefix())
 	nodeAppendRange(new, old, 0, 0, idx+1)
-	nodeUpdateKV(new, idx, 0, key, val)
+	nodeUpdateKV(new, idx, ptr, val)
 	nodeAppendRange(new, old, idx+1, idx+1, old.nkeys()-(idx+1))
 }
 
 // new需要将node的数据拷贝过来
-func nodeInsert(tree *BTree, new BNode, node BNode, idx uint16, key, val []byte) {
+func nodeInsert(tree *BTree, new BNode, node BNode, idx uint16, key, val []byte, ptr uint64) {
 	// get and deallocate the kid node
 	kptr := node.getPtr(idx)
 	knode := tree.get(kptr)
 	tree.del(kptr)
 
 	// recrusive
-	knode = treeInsert(tree, knode, key, val)
+	knode = treeInsert(tree, knode, key, val, ptr)
 
 	// split the result
-	nsplit, splited := nodeSplit3(knode)
+	splited := nodeSplit(tree, knode)
 
 	// update the kid links
-	nodeReplaceKidN(tree, new, node, idx, splited[:nsplit]...)
+	nodeReplaceKidN(tree, new, node, idx, splited...)
 }
 
-func nodeSplit3(node BNode) (uint16, [3]BNode) {
-	if node.nbytes() <= BTREE_PAGE_SIZE {
-		// 之前初始化时，时2*BTREE_PAGE_SIZE
-		node.data = node.data[:BTREE_PAGE_SIZE]
-		return 1, [3]BNode{node}
+// 拆成能放进page的几个节点，通常不超过3个
+func nodeSplit(tree *BTree, node BNode) []BNode {
+	if nodeFits(tree, node) {
+		// 之前初始化时，是更大的临时空间
+		node.data = node.data[:tree.layout.size]
+		return []BNode{node}
 	}
 
-	left := BNode{make([]byte, 2*BTREE_PAGE_SIZE)}
-	right := BNode{make([]byte, BTREE_PAGE_SIZE)}
-	nodeSplit2(left, right, node)
-	if left.nbytes() <= BTREE_PAGE_SIZE {
-		left.data = left.data[:BTREE_PAGE_SIZE]
-		return 2, [3]BNode{left, right}
-	}
-
-	// the left node is still too large
-	leftleft := BNode{make([]byte, BTREE_PAGE_SIZE)}
-	middle := BNode{make([]byte, BTREE_PAGE_SIZE)}
-	nodeSplit2(leftleft, middle, left)
-	assert(leftleft.nbytes() <= BTREE_PAGE_SIZE, fmt.Sprintf("function:nodeSplit3, page size is exceed max, size: %v", leftleft.nbytes()))
-	return 3, [3]BNode{leftleft, middle, right}
+	left := BNode{make([]byte, 3*tree.layout.size)}
+	right := BNode{make([]byte, tree.layout.size)}
+	nodeSplit2(tree, left, right, node)
+	// the left node may be still too large
+	return append(nodeSplit(tree, left), right)
 }
 
-func nodeSplit2(left, right, old BNode) {
-	halfSize := old.nbytes() / 2
-
-	left.setHeader(old.btype(), 1)
-	nodeAppendRange(left, old, 0, 0, 1)
+// old拆成left和right两部分，right一定能放进一个page，left可能仍然超出一个page，由nodeSplit再拆
+// 叶子节点拆分后重新计算公共前缀，两部分的大小由nodeRangeBytes计算
+func nodeSplit2(tree *BTree, left, right, old BNode) {
+	assert(old.nkeys() >= 2, fmt.Sprintf("function:nodeSplit2, too few keys to split, nkeys: %v", old.nkeys()))
 
-	i := uint16(1)
-	for {
-		// 8 ptr; 2 offset; 4 keylen vallen
-		nextleftSize := left.nbytes() + 8 + 2 + 4 + uint16(len(old.getKey(i))+len(old.getVal(i)))
-
-		if len(left.data) == 2*BTREE_PAGE_SIZE {
-			if left.nbytes() > halfSize {
-				break
-			}
-		} else {
-			if nextleftSize > halfSize {
-				break
-			}
-		}
-
-		nodeAppendRange(left, old, i, i, 1)
-		i = i + 1
+	fits := func(start, end uint16) bool {
+		return tree.layout.fits(nodeRangeBytes(tree, old, start, end))
 	}
 
-	nodeAppendRange(right, old, 0, i, old.nkeys()-i)
+	// 先从一半开始尝试，让left尽量放进一个page
+	nkeys := old.nkeys()
+	nleft := nkeys / 2
+	for nleft > 1 && !fits(0, nleft) {
+		nleft--
+	}
+	// right必须放进一个page
+	for !fits(nleft, nkeys) {
+		nleft++
+	}
+	assert(nleft < nkeys, fmt.Sprintf("function:nodeSplit2, bad split point, nleft: %v, nkeys: %v", nleft, nkeys))
+	nright := nkeys - nleft
+
+	nodeSetHeaderKeys(tree, left, old.btype(), nleft, old.getKey(0), old.getKey(nleft-1))
+	nodeSetHeaderKeys(tree, right, old.btype(), nright, old.getKey(nleft), old.getKey(nkeys-1))
+	nodeAppendRange(left, old, 0, 0, nleft)
+	nodeAppendRange(right, old, 0, nleft, nright)
+	assert(int(right.nbytes()) <= tree.layout.space, fmt.Sprintf("function:nodeSplit2, right node exceed page size, size: %v", right.nbytes()))
 }
 
 func nodeReplaceKidN(tree *BTree, new, old BNode, idx uint16, kids ...BNode) {
@@ -149,7 +147,7 @@ func nodeReplaceKidN(tree *BTree, new, old BNode, idx uint16, kids ...BNode) {
 	new.setHeader(BNODE_NODE, old.nkeys()+inc-1)
 	nodeAppendRange(new, old, 0, 0, idx)
 	for i, node := range kids {
-		nodeAppendKV(new, idx+uint16(i), tree.new(node), node.getKey(0), nil)
+		nodeAppendSep(tree, new, idx+uint16(i), tree.new(node), node)
 	}
 	nodeAppendRange(new, old, idx+inc, idx+1, old.nkeys()-(idx+1))
 }
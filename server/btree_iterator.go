@@ -18,9 +18,9 @@ type BIter struct {
 // find the closest position to a key with respect to the `cmp` relation
 func (tree *BTree) Seek(key []byte, cmp int) *BIter {
 	iter := tree.SeekLE(key)
-	if cmp != CMP_LE && iter.Valid() {
-		cur, _ := iter.Deref()
-		if !cmpOK(cur, cmp, key) {
+	if cmp != CMP_LE && len(iter.path) > 0 {
+		// SeekLE可能停在哨兵(空key)上，这时Valid为false，也需要移动
+		if !iter.Valid() || !cmpOK(iter.Key(), cmp, key) {
 			// off by one
 			if cmp > 0 {
 				iter.Next()
@@ -34,29 +34,64 @@ func (tree *BTree) Seek(key []byte, cmp int) *BIter {
 
 // get the current KV pair
 func (iter *BIter) Deref() ([]byte, []byte) {
-	return nil, nil
+	last := len(iter.path) - 1
+	node := iter.path[last]
+	pos := iter.pos[last]
+	return nodeGetKey(iter.tree, node, pos), leafGetVal(iter.tree, node, pos)
 }
 
-// precondition of the Deref()
+// get the current key, 不读取value，大的value在overflow page中
+func (iter *BIter) Key() []byte {
+	last := len(iter.path) - 1
+	return nodeGetKey(iter.tree, iter.path[last], iter.pos[last])
+}
+
+// precondition of the Deref() and Key()
 func (iter *BIter) Valid() bool {
-	return false
+	if len(iter.path) == 0 {
+		return false
+	}
+	last := len(iter.path) - 1
+	node := iter.path[last]
+	pos := iter.pos[last]
+	if pos >= node.nkeys() {
+		return false // past the last key
+	}
+	// 第一个叶子节点的第一个key是哨兵，空key不允许写入，所以只有哨兵的key为空
+	return len(node.prefix()) != 0 || len(node.getSuffix(pos)) != 0
 }
 
 // moving backward and forward
 func (iter *BIter) Prev() {
-	iterPrev(iter, len(iter.path)-1)
+	if len(iter.path) == 0 {
+		return
+	}
+	last := len(iter.path) - 1
+	if iter.pos[last] >= iter.path[last].nkeys() {
+		// 已经越过最后一个key，退回到最后一个key
+		iter.pos[last] = iter.path[last].nkeys() - 1
+		return
+	}
+	iterPrev(iter, last)
 }
-func (iter *BIter) Next() {
 
+func (iter *BIter) Next() {
+	if len(iter.path) == 0 {
+		return
+	}
+	last := len(iter.path) - 1
+	if !iterNext(iter, last) {
+		// 没有下一个key了，停在最后一个key之后
+		iter.pos[last] = iter.path[last].nkeys()
+	}
 }
 
-func iterPrev(iter *BIter, level int) {
+// 返回值表示是否移动成功，停在哨兵上时无法再向前移动
+func iterPrev(iter *BIter, level int) bool {
 	if iter.pos[level] > 0 {
 		iter.pos[level]-- // move within this node
-	} else if level > 0 {
-		iterPrev(iter, level-1) // move to a slibing node
-	} else {
-		return // dummy key
+	} else if level == 0 || !iterPrev(iter, level-1) {
+		return false // dummy key
 	}
 	if level+1 < len(iter.pos) {
 		// update the kid node
@@ -65,6 +100,24 @@ func iterPrev(iter *BIter, level int) {
 		iter.path[level+1] = kid
 		iter.pos[level+1] = kid.nkeys() - 1
 	}
+	return true
+}
+
+// 返回值表示是否移动成功，已经是最后一个key时无法再向后移动
+func iterNext(iter *BIter, level int) bool {
+	if iter.pos[level]+1 < iter.path[level].nkeys() {
+		iter.pos[level]++ // move within this node
+	} else if level == 0 || !iterNext(iter, level-1) {
+		return false // the last key
+	}
+	if level+1 < len(iter.pos) {
+		// update the kid node
+		node := iter.path[level]
+		kid := iter.tree.get(node.getPtr(iter.pos[level]))
+		iter.path[level+1] = kid
+		iter.pos[level+1] = 0
+	}
+	return true
 }
 
 // find the closest position that is less or equal to the input key
@@ -72,7 +125,7 @@ func (tree *BTree) SeekLE(key []byte) *BIter {
 	iter := &BIter{tree: tree}
 	for ptr := tree.root; ptr != 0; {
 		node := tree.get(ptr)
-		idx := nodeLookupLE(node, key)
+		idx := nodeLookupLE(tree, node, key)
 		iter.path = append(iter.path, node)
 		iter.pos = append(iter.pos, idx)
 		if node.btype() == BNODE_NODE {
@@ -84,6 +137,10 @@ func (tree *BTree) SeekLE(key []byte) *BIter {
 	return iter
 }
 
+func validCmp(cmp int) bool {
+	return cmp == CMP_GE || cmp == CMP_GT || cmp == CMP_LT || cmp == CMP_LE
+}
+
 // key cmp ref
 func cmpOK(key []byte, cmp int, ref []byte) bool {
 	r := bytes.Compare(key, ref)
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+/*
+*
+超过maxVal的值保存在一串overflow page中，叶子节点中:
+
+	pointer: 第一个overflow page, 普通的值为0
+	val:     值的总长度, 8B
+
+overflow page通过tree.new和tree.del分配和释放，和B+tree的节点一样走free list
+
+The overflow page format:
+| type | unused | next | data |
+|  2B  |   2B   |  8B  | ...  |
+*/
+
+const (
+	BNODE_OVERFLOW  = 4
+	OVERFLOW_HEADER = 4 + 8 // 每个page的数据大小是pageLayout.ovCap
+)
+
+// write a large value, returns the first page
+// 从最后一段开始写，每个page写入时已经知道next
+func ovWrite(tree *BTree, val []byte) uint64 {
+	next, ovCap := uint64(0), tree.layout.ovCap
+	for end := len(val); end > 0; {
+		start := (end - 1) / ovCap * ovCap
+		node := BNode{make([]byte, tree.layout.size)}
+		binary.LittleEndian.PutUint16(node.data[0:], BNODE_OVERFLOW)
+		binary.LittleEndian.PutUint64(node.data[4:], next)
+		copy(node.data[OVERFLOW_HEADER:], val[start:end])
+		next = tree.new(node)
+		end = start
+	}
+	return next
+}
+
+func ovRead(tree *BTree, ptr uint64, size uint64) []byte {
+	if size > uint64(BTREE_VAL_LIMIT+tree.flag) {
+		panic(errCorrupt("overflow size: %d", size))
+	}
+	out := make([]byte, 0, size)
+	for uint64(len(out)) < size {
+		if ptr == 0 {
+			panic(errCorrupt("the overflow chain is too short, size: %d, read: %d", size, len(out)))
+		}
+		node := tree.get(ptr)
+		if node.btype() != BNODE_OVERFLOW {
+			panic(errCorrupt("bad overflow page type: %d", node.btype()))
+		}
+		n := min(size-uint64(len(out)), uint64(tree.layout.ovCap))
+		out = append(out, node.data[OVERFLOW_HEADER:][:n]...)
+		ptr = binary.LittleEndian.Uint64(node.data[4:])
+	}
+	return out
+}
+
+func ovFree(tree *BTree, ptr uint64) {
+	for ptr != 0 {
+		next := binary.LittleEndian.Uint64(tree.get(ptr).data[4:])
+		tree.del(ptr)
+		ptr = next
+	}
+}
+
+// the value stored in the leaf for a large value
+func ovRef(size int) []byte {
+	return binary.LittleEndian.AppendUint64(nil, uint64(size))
+}
+
+// the value of a leaf KV pair, 大的值从overflow page中读出
+func leafGetVal(tree *BTree, node BNode, idx uint16) []byte {
+	ptr := node.getPtr(idx)
+	if ptr == 0 {
+		return node.getVal(idx)
+	}
+	return ovRead(tree, ptr, binary.LittleEndian.Uint64(node.getVal(idx)))
+}
+
+/*
+*
+超过maxKey的长key，klen带有BNODE_KEY_LONG标记:
+
+	叶子节点: | key的前keyPrefix字节 | 第一个overflow page 8B | key的总长度 8B |
+	内部节点: | key的前keyPrefix字节 |
+
+内部节点的key只用于查找子节点，它总是等于子节点的第一个key，所以只保存前缀，
+前缀相同时沿着子节点的第一个key找到叶子节点中完整的key。
+完整的key只属于叶子节点，在删除时释放
+*/
+
+// the key stored in a leaf
+func leafStoreKey(tree *BTree, key []byte) ([]byte, bool) {
+	if len(key) <= tree.layout.maxKey {
+		return key, false
+	}
+	raw := append([]byte{}, key[:tree.layout.keyPrefix]...)
+	raw = binary.LittleEndian.AppendUint64(raw, ovWrite(tree, key))
+	raw = binary.LittleEndian.AppendUint64(raw, uint64(len(key)))
+	return raw, true
+}
+
+// free the overflow pages of a leaf KV pair
+func leafFreeKV(tree *BTree, node BNode, idx uint16) {
+	if node.keyLong(idx) {
+		raw := node.getKey(idx)
+		ovFree(tree, binary.LittleEndian.Uint64(raw[tree.layout.keyPrefix:]))
+	}
+	ovFree(tree, node.getPtr(idx))
+}
+
+// the complete key
+func nodeGetKey(tree *BTree, node BNode, idx uint16) []byte {
+	raw := node.getKey(idx)
+	if !node.keyLong(idx) {
+		return raw
+	}
+	if node.btype() == BNODE_LEAF {
+		n := tree.layout.keyPrefix
+		if len(raw) != n+16 {
+			panic(errCorrupt("bad long key size: %d", len(raw)))
+		}
+		ptr := binary.LittleEndian.Uint64(raw[n:])
+		size := binary.LittleEndian.Uint64(raw[n+8:])
+		return ovRead(tree, ptr, size)
+	}
+	return nodeGetKey(tree, tree.get(node.getPtr(idx)), 0)
+}
+
+// compare the idx-th key of the node with the key
+// 先比较前缀，前缀相同时才需要读出完整的key
+func nodeCmpKey(tree *BTree, node BNode, idx uint16, key []byte) int {
+	if !node.keyLong(idx) {
+		return cmpPrefixed(node.prefix(), node.getSuffix(idx), key)
+	}
+	raw, n := node.getKey(idx), tree.layout.keyPrefix
+	if len(raw) < n {
+		panic(errCorrupt("bad long key size: %d", len(raw)))
+	}
+	if r := bytes.Compare(raw[:n], key[:min(len(key), n)]); r != 0 {
+		return r
+	}
+	return bytes.Compare(nodeGetKey(tree, node, idx), key)
+}
+
+// append the first key of the kid as the key of an internal node
+func nodeAppendSep(tree *BTree, dst BNode, idx uint16, ptr uint64, kid BNode) {
+	key := kid.getKey(0)
+	long := kid.keyLong(0)
+	if long {
+		key = key[:tree.layout.keyPrefix]
+	}
+	nodeAppendKV(dst, idx, ptr, key, nil)
+	if long {
+		dst.setKeyLong(idx)
+	}
+}
+
+// append a new KV pair to a leaf, raw和long来自leafStoreKey
+func leafAppendKV(dst BNode, idx uint16, ptr uint64, raw []byte, long bool, val []byte) {
+	nodeAppendKV(dst, idx, ptr, raw, val)
+	if long {
+		dst.setKeyLong(idx)
+	}
+}
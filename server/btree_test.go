@@ -2,6 +2,7 @@ package server
 
 import (
 	"fmt"
+	"math/rand"
 	"testing"
 	"unsafe"
 )
@@ -23,6 +24,7 @@ func newC() *C {
 
 	return &C{
 		tree: BTree{
+			layout: defaultLayout,
 			get: func(ptr uint64) BNode {
 				node, ok := pages[ptr]
 				assert(ok, "function:get, cant find node")
@@ -48,13 +50,16 @@ func newC() *C {
 }
 
 func (c *C) add(key string, val string) {
-	c.tree.Insert([]byte(key), []byte(val))
+	err := c.tree.Insert([]byte(key), []byte(val))
+	assert(err == nil, fmt.Sprintf("function:add, insert err: %v", err))
 	c.ref[key] = val
 }
 
 func (c *C) del(key string) bool {
 	delete(c.ref, key)
-	return c.tree.Delete([]byte(key))
+	deleted, err := c.tree.Delete([]byte(key))
+	assert(err == nil, fmt.Sprintf("function:del, delete err: %v", err))
+	return deleted
 }
 
 func TestInsert(t *testing.T) {
@@ -74,3 +79,330 @@ func TestInsert(t *testing.T) {
 	client.add("c_key", "c_value")
 	client.strings()
 }
+
+func TestInsertMany(t *testing.T) {
+	client := newC()
+
+	for i := 0; i < 2000; i++ {
+		client.add(fmt.Sprintf("key%05d", i), fmt.Sprintf("val%0100d", i))
+	}
+	for i := 0; i < 2000; i += 2 {
+		if !client.del(fmt.Sprintf("key%05d", i)) {
+			t.Fatalf("fail to delete key%05d", i)
+		}
+	}
+
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		val, ok, _ := client.tree.Get([]byte(key))
+		expected, exists := client.ref[key]
+		if ok != exists || string(val) != expected {
+			t.Fatalf("wrong value, key: %s, got: %s, expected: %s", key, val, expected)
+		}
+	}
+}
+
+func TestInsertEx(t *testing.T) {
+	client := newC()
+	client.add("a_key", "a_value")
+
+	req := &InsertReq{Key: []byte("a_key"), Val: []byte("a_new"), Mode: MODE_INSERT_ONLY}
+	client.tree.InsertEx(req)
+	if req.Updated || req.Added {
+		t.Fatalf("insert only should not overwrite an existing key")
+	}
+
+	req = &InsertReq{Key: []byte("b_key"), Val: []byte("b_value"), Mode: MODE_UPDATE_ONLY}
+	client.tree.InsertEx(req)
+	if req.Updated || req.Added {
+		t.Fatalf("update only should not add a missing key")
+	}
+
+	req = &InsertReq{Key: []byte("a_key"), Val: []byte("a_new"), Mode: MODE_UPDATE_ONLY}
+	client.tree.InsertEx(req)
+	if !req.Updated || req.Added || string(req.Old) != "a_value" {
+		t.Fatalf("wrong update result, updated: %v, added: %v, old: %s", req.Updated, req.Added, req.Old)
+	}
+
+	req = &InsertReq{Key: []byte("b_key"), Val: []byte("b_value"), Mode: MODE_UPSERT}
+	client.tree.InsertEx(req)
+	if !req.Updated || !req.Added || req.Old != nil {
+		t.Fatalf("wrong upsert result, updated: %v, added: %v, old: %s", req.Updated, req.Added, req.Old)
+	}
+
+	if v, _, _ := client.tree.Get([]byte("a_key")); string(v) != "a_new" {
+		t.Fatalf("wrong value, got: %s, expected: %s", v, "a_new")
+	}
+}
+
+func TestIterator(t *testing.T) {
+	client := newC()
+	if iter := client.tree.Seek([]byte("key"), CMP_GE); iter.Valid() {
+		t.Fatalf("empty tree should have no valid position")
+	}
+
+	// 偶数key，value较大保证树有三层
+	n := 3000
+	for i := 0; i < n; i += 2 {
+		client.add(fmt.Sprintf("key%05d", i), fmt.Sprintf("val%01000d", i))
+	}
+
+	// forward
+	count := 0
+	for iter := client.tree.Seek([]byte("key"), CMP_GE); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		if string(key) != fmt.Sprintf("key%05d", 2*count) || string(val) != client.ref[string(key)] {
+			t.Fatalf("wrong kv, idx: %d, key: %s", count, key)
+		}
+		count++
+	}
+	if count != n/2 {
+		t.Fatalf("wrong number of keys, got: %d, expected: %d", count, n/2)
+	}
+
+	// backward
+	for iter := client.tree.Seek([]byte("z"), CMP_LE); iter.Valid(); iter.Prev() {
+		count--
+		key, _ := iter.Deref()
+		if string(key) != fmt.Sprintf("key%05d", 2*count) {
+			t.Fatalf("wrong key, idx: %d, key: %s", count, key)
+		}
+	}
+	if count != 0 {
+		t.Fatalf("backward iteration stopped early, remain: %d", count)
+	}
+
+	cases := []struct {
+		key      string
+		cmp      int
+		expected string
+	}{
+		{"key00100", CMP_GE, "key00100"},
+		{"key00101", CMP_GE, "key00102"},
+		{"key00100", CMP_GT, "key00102"},
+		{"key00100", CMP_LE, "key00100"},
+		{"key00101", CMP_LE, "key00100"},
+		{"key00100", CMP_LT, "key00098"},
+		{"key00000", CMP_LT, ""},
+		{"key02998", CMP_GT, ""},
+	}
+	for _, c := range cases {
+		iter := client.tree.Seek([]byte(c.key), c.cmp)
+		got := ""
+		if iter.Valid() {
+			key, _ := iter.Deref()
+			got = string(key)
+		}
+		if got != c.expected {
+			t.Fatalf("wrong seek result, key: %s, cmp: %d, got: %s, expected: %s", c.key, c.cmp, got, c.expected)
+		}
+	}
+}
+
+func TestOverflow(t *testing.T) {
+	client := newC()
+	large := func(i, size int) string {
+		return fmt.Sprintf("%0*d", size, i)
+	}
+
+	for i := 0; i < 20; i++ {
+		client.add(fmt.Sprintf("key%03d", i), fmt.Sprintf("val%d", i))
+	}
+	npages := len(client.pages)
+
+	// the values span 0 to 3 overflow pages
+	sizes := []int{BTREE_MAX_VAL_SIZE, BTREE_MAX_VAL_SIZE + 1, defaultLayout.ovCap, 3*defaultLayout.ovCap - 1, 10000}
+	for i, size := range sizes {
+		client.add(fmt.Sprintf("key%03d", i), large(i, size))
+	}
+	for i, size := range sizes {
+		key := fmt.Sprintf("key%03d", i)
+		val, ok, _ := client.tree.Get([]byte(key))
+		if !ok || len(val) != size || string(val) != client.ref[key] {
+			t.Fatalf("wrong large value, key: %s, len: %d, expected: %d", key, len(val), size)
+		}
+	}
+	count := 0
+	for iter := client.tree.Seek([]byte("key"), CMP_GE); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		if string(val) != client.ref[string(key)] {
+			t.Fatalf("wrong value from the iterator, key: %s, len: %d", key, len(val))
+		}
+		count++
+	}
+	if count != 20 {
+		t.Fatalf("wrong number of keys, got: %d", count)
+	}
+
+	// Key只读取叶子节点，不读取overflow page
+	get, ovReads := client.tree.get, 0
+	client.tree.get = func(ptr uint64) BNode {
+		node := get(ptr)
+		if node.btype() == BNODE_OVERFLOW {
+			ovReads++
+		}
+		return node
+	}
+	for iter := client.tree.Seek([]byte("key"), CMP_GE); iter.Valid(); iter.Next() {
+		iter.Key()
+	}
+	client.tree.get = get
+	if ovReads != 0 {
+		t.Fatalf("overflow pages are read for the keys, reads: %d", ovReads)
+	}
+
+	// the overflow pages are freed on updates and deletes
+	for i := range sizes {
+		if i%2 == 0 {
+			client.add(fmt.Sprintf("key%03d", i), fmt.Sprintf("val%d", i))
+		}
+	}
+	for i := range sizes {
+		if i%2 == 1 {
+			client.del(fmt.Sprintf("key%03d", i))
+			client.add(fmt.Sprintf("key%03d", i), fmt.Sprintf("val%d", i))
+		}
+	}
+	if len(client.pages) != npages {
+		t.Fatalf("overflow pages are leaked, pages before: %d, after: %d", npages, len(client.pages))
+	}
+}
+
+func TestLongKey(t *testing.T) {
+	client := newC()
+	npages := len(client.pages)
+
+	// 长key有很长的公共前缀，内部节点中的前缀无法区分它们
+	prefix := fmt.Sprintf("%02000d", 0)
+	keys := []string{}
+	for i := 0; i < 300; i++ {
+		keys = append(keys, fmt.Sprintf("%s%05d", prefix[:defaultLayout.keyPrefix+i%3*500], i))
+		keys = append(keys, fmt.Sprintf("short%05d", i))
+	}
+	for i, key := range keys {
+		client.add(key, fmt.Sprintf("val%0100d", i))
+	}
+
+	for _, key := range keys {
+		val, ok, _ := client.tree.Get([]byte(key))
+		if !ok || string(val) != client.ref[key] {
+			t.Fatalf("wrong value of a long key, len: %d", len(key))
+		}
+	}
+	if _, ok, _ := client.tree.Get([]byte(prefix + "x")); ok {
+		t.Fatalf("found a missing key")
+	}
+
+	// the iterator returns the complete keys in order
+	last, count := "", 0
+	for iter := client.tree.Seek([]byte{0}, CMP_GE); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		if string(key) <= last || string(val) != client.ref[string(key)] {
+			t.Fatalf("wrong key from the iterator, idx: %d, len: %d", count, len(key))
+		}
+		last = string(key)
+		count++
+	}
+	if count != len(keys) {
+		t.Fatalf("wrong number of keys, got: %d, expected: %d", count, len(keys))
+	}
+	iter := client.tree.Seek([]byte(keys[100]), CMP_GT)
+	if key, _ := iter.Deref(); string(key) <= keys[100] {
+		t.Fatalf("wrong seek result for a long key")
+	}
+
+	// overwrite and delete, the overflow pages are freed
+	for _, key := range keys {
+		client.add(key, "new")
+	}
+	for _, key := range keys {
+		if !client.del(key) {
+			t.Fatalf("fail to delete a long key, len: %d", len(key))
+		}
+	}
+	if len(client.pages) != npages+1 {
+		t.Fatalf("overflow pages are leaked, pages: %d", len(client.pages))
+	}
+}
+
+func TestPrefixCompression(t *testing.T) {
+	client := newC()
+
+	// composite keys with a long common prefix
+	key := func(i int) string {
+		return fmt.Sprintf("\x00\x00\x00\x05customer-%040d\x00order-%08d", i/500, i)
+	}
+	perm := rand.New(rand.NewSource(1)).Perm(3000)
+	for _, i := range perm {
+		client.add(key(i), fmt.Sprintf("v%d", i))
+	}
+
+	// most leaves store the prefix once and hold more keys than the raw size allows
+	prefixed, nleaves, nkeys := 0, 0, 0
+	for _, node := range client.pages {
+		if node.btype() != BNODE_LEAF {
+			continue
+		}
+		nleaves++
+		nkeys += int(node.nkeys())
+		if len(node.prefix()) > 0 {
+			prefixed++
+		}
+	}
+	if prefixed*2 < nleaves {
+		t.Fatalf("too few prefix compressed leaves: %d/%d", prefixed, nleaves)
+	}
+	rawPerPage := (BTREE_PAGE_SIZE - HEADLEN) / (8 + 2 + 4 + len(key(0)) + 5)
+	if nkeys/nleaves <= rawPerPage {
+		t.Fatalf("no gain from prefix compression, keys per leaf: %d, without: %d", nkeys/nleaves, rawPerPage)
+	}
+
+	// delete in another order, the merged leaves recompute the prefix
+	for _, i := range perm[:2000] {
+		if !client.del(key(i)) {
+			t.Fatalf("fail to delete %s", key(i))
+		}
+	}
+	for i := 0; i < 3000; i++ {
+		val, ok, _ := client.tree.Get([]byte(key(i)))
+		expected, exists := client.ref[key(i)]
+		if ok != exists || string(val) != expected {
+			t.Fatalf("wrong value, key: %s, got: %s, expected: %s", key(i), val, expected)
+		}
+	}
+	count := 0
+	last := ""
+	for iter := client.tree.Seek([]byte{0}, CMP_GE); iter.Valid(); iter.Next() {
+		k, _ := iter.Deref()
+		if string(k) <= last {
+			t.Fatalf("keys out of order: %q, %q", last, k)
+		}
+		last = string(k)
+		count++
+	}
+	if count != len(client.ref) {
+		t.Fatalf("wrong number of keys, got: %d, expected: %d", count, len(client.ref))
+	}
+}
+
+// 没有前缀标志的节点是原来的格式
+func TestPrefixOldFormat(t *testing.T) {
+	node := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+	node.setHeader(BNODE_LEAF, 3)
+	nodeAppendKV(node, 0, 0, nil, nil)
+	nodeAppendKV(node, 1, 0, []byte("key-0001"), []byte("v1"))
+	nodeAppendKV(node, 2, 0, []byte("key-0002"), []byte("v2"))
+	if node.headLen() != HEADLEN || node.prefix() != nil || node.kvPos(0) != HEADLEN+10*3 {
+		t.Fatalf("wrong layout of the old format")
+	}
+
+	compressed := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+	nodeSetHeaderKeys(&BTree{layout: defaultLayout}, compressed, BNODE_LEAF, 2, node.getKey(1), node.getKey(2))
+	nodeAppendRange(compressed, node, 0, 1, 2)
+	if string(compressed.prefix()) != "key-000" || string(compressed.getSuffix(1)) != "2" {
+		t.Fatalf("wrong prefix: %q", compressed.prefix())
+	}
+	if compressed.btype() != BNODE_LEAF || string(compressed.getKey(1)) != "key-0002" || string(compressed.getVal(1)) != "v2" {
+		t.Fatalf("wrong KV pair after copying to a compressed node")
+	}
+}
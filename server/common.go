@@ -1,7 +1,43 @@
 package server
 
+import (
+	"errors"
+	"fmt"
+)
+
+// 公开的方法返回这些错误，可以用errors.Is判断
+var (
+	ErrEmptyKey      = errors.New("empty key")
+	ErrKeyTooLarge   = errors.New("key too large")
+	ErrValueTooLarge = errors.New("value too large")
+	ErrBadMode       = errors.New("bad insert mode")
+	ErrBadType       = errors.New("bad value type")
+	ErrCorrupt       = errors.New("data corrupted")
+	ErrBadVersion    = errors.New("unsupported catalog version")
+	ErrFileVersion   = errors.New("unsupported file version")
+)
+
+// assert只用于内部的不变量，不满足说明代码有bug
 func assert(i bool, msg string) {
 	if !i {
 		panic("internal err: " + msg)
 	}
 }
+
+// 读到损坏的page时在深处panic(errCorrupt(...))，由公开的方法通过recoverCorrupt转换成返回的错误
+func errCorrupt(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrCorrupt, fmt.Sprintf(format, args...))
+}
+
+// usage: defer recoverCorrupt(&err)
+func recoverCorrupt(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if e, ok := r.(error); ok && errors.Is(e, ErrCorrupt) {
+		*err = e
+		return
+	}
+	panic(r)
+}
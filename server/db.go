@@ -1,8 +1,71 @@
 package server
 
+import (
+	"sync"
+	"time"
+)
+
+// the options of Open, 零值使用默认的设置
+type Options struct {
+	PageSize int  // the page size of a new file, see KV.PageSize
+	Verify   bool // check all pages on Open, see KV.Verify
+	WAL      bool // write-ahead log mode, see KV.WAL
+
+	CommitDelay time.Duration // the max delay of a group commit, see KV.CommitDelay
+	SyncMode    SyncMode      // fsync on commits or not, see KV.SyncMode
+}
+
 type DB struct {
 	Path string
+	Options
 
 	kv     KV
+	open   bool
+	mu     sync.Mutex // protects tables
 	tables map[string]*TableDef
 }
+
+// 打开或者创建数据库文件，用完之后需要Close
+func Open(path string, opts Options) (*DB, error) {
+	db := &DB{Path: path, Options: opts}
+	if err := db.Open(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// DB和KV一样需要先Open，新文件会写入catalog，已有的文件检查catalog的版本
+func (db *DB) Open() error {
+	db.kv = *InitKV(db.Path)
+	db.kv.PageSize = db.PageSize
+	db.kv.Verify = db.Verify
+	db.kv.WAL = db.WAL
+	db.kv.CommitDelay = db.CommitDelay
+	db.kv.SyncMode = db.SyncMode
+	if err := db.kv.Open(); err != nil {
+		return err
+	}
+	if err := db.update(catalogInit); err != nil {
+		db.kv.Close()
+		return err
+	}
+	db.open = true
+	return nil
+}
+
+// 所有已经提交的事务落盘之后关闭文件，重复调用没有影响
+func (db *DB) Close() error {
+	if !db.open {
+		return nil
+	}
+	db.open = false
+	err := db.kv.Sync()
+	db.kv.Close()
+	db.tables = nil
+	return err
+}
+
+// 让之前的提交都落盘，见KV.Sync
+func (db *DB) Sync() error {
+	return db.kv.Sync()
+}
@@ -4,42 +4,114 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"math"
 )
 
-func checkRecord(tdef *TableDef, rec Record) ([]Value, error) {
-	if len(rec.Cols) != tdef.PKeys {
-		return nil, fmt.Errorf("checkRecord fail, tdef.PKeys: %v, len(record.Val): %v", tdef.PKeys, len(rec.Cols))
-	}
-
-	if tdef.PKeys == len(tdef.Cols) {
-		return nil, fmt.Errorf("checkRecord fail, record has all columns, tdef.PKeys: %v", tdef.PKeys)
+// 按列名把record中的值放到表定义的位置上，record中列的顺序是任意的
+// n是期望的列数: 按主键读写(Get/Delete)时为tdef.PKeys，只能也必须包含所有主键列；
+// 写入整行(Insert/Update)时为len(tdef.Cols)，必须包含所有不能为NULL的列
+// 返回的values总是有len(tdef.Cols)个，只有前n个是record中的值
+func checkRecord(tdef *TableDef, rec Record, n int) ([]Value, error) {
+	if len(rec.Vals) != len(rec.Cols) {
+		return nil, fmt.Errorf("table %s: len(record.Cols): %v, len(record.Vals): %v", tdef.Name, len(rec.Cols), len(rec.Vals))
 	}
 
 	output := make([]Value, len(tdef.Cols))
-	copy(output, rec.Vals)
+	found := make([]bool, len(tdef.Cols))
+	for i, col := range rec.Cols {
+		idx := colIndex(tdef, col)
+		switch {
+		case idx < 0:
+			return nil, fmt.Errorf("table %s: unknown column: %s", tdef.Name, col)
+		case idx >= n:
+			return nil, fmt.Errorf("table %s: column %s is not a primary key", tdef.Name, col)
+		case found[idx]:
+			return nil, fmt.Errorf("table %s: duplicated column: %s", tdef.Name, col)
+		}
+		if err := checkValue(tdef, idx, rec.Vals[i]); err != nil {
+			return nil, err
+		}
+		output[idx] = rec.Vals[i]
+		found[idx] = true
+	}
+	// 没有给出的可以为NULL的列是NULL
+	for idx := 0; idx < n; idx++ {
+		switch {
+		case found[idx]:
+		case tdef.nullable(idx):
+			output[idx] = Value{Type: TYPE_NULL}
+		default:
+			return nil, fmt.Errorf("table %s: missing column: %s", tdef.Name, tdef.Cols[idx])
+		}
+	}
 
 	return output, nil
 }
 
+// the type of the column, NULL只能用于可以为NULL的列
+func checkValue(tdef *TableDef, idx int, v Value) error {
+	switch {
+	case v.Type == TYPE_NULL && !tdef.nullable(idx):
+		return fmt.Errorf("table %s: column %s is not nullable", tdef.Name, tdef.Cols[idx])
+	case v.Type != TYPE_NULL && v.Type != tdef.Types[idx]:
+		return fmt.Errorf("table %s: column %s expects %s, got %s: %w", tdef.Name, tdef.Cols[idx], typeName(tdef.Types[idx]), typeName(v.Type), ErrBadType)
+	}
+	return nil
+}
+
+// 值的类型已经由checkRecord等检查过
 func encodeValues(out []byte, vals []Value) []byte {
 	for _, v := range vals {
 		switch v.Type {
-		case TYPE_INT64:
-			var buf [8]byte
-			u := uint64(v.I64) + (1 << 63)
-			binary.BigEndian.PutUint64(buf[:], u)
+		case TYPE_INT64, TYPE_TIMESTAMP:
+			out = binary.BigEndian.AppendUint64(out, uint64(v.I64)+(1<<63))
+		case TYPE_UINT64:
+			out = binary.BigEndian.AppendUint64(out, uint64(v.I64))
+		case TYPE_FLOAT64:
+			out = binary.BigEndian.AppendUint64(out, encodeFloat64(v.Float64()))
+		case TYPE_BOOL:
+			b := byte(0)
+			if v.Bool() {
+				b = 1
+			}
+			out = append(out, b)
 
 		case TYPE_BYTES:
 			out = append(out, escapeString(v.Str)...)
 			out = append(out, 0)
 		default:
-			panic("wrong type")
+			panic(fmt.Sprintf("encodeValues, bad type: %d", v.Type))
 		}
 	}
 
 	return out
 }
 
+// IEEE 754的位: 正数翻转符号位，负数翻转所有的位，编码后的字节序和数值的顺序一致
+// -0和0是同一个值，所有的NaN也是同一个值，排在+Inf之后
+func encodeFloat64(f float64) uint64 {
+	switch {
+	case math.IsNaN(f):
+		f = math.NaN()
+	case f == 0:
+		f = 0
+	}
+	u := math.Float64bits(f)
+	if u>>63 != 0 {
+		return ^u
+	}
+	return u | 1<<63
+}
+
+func decodeFloat64(u uint64) float64 {
+	if u>>63 != 0 {
+		u &^= 1 << 63
+	} else {
+		u = ^u
+	}
+	return math.Float64frombits(u)
+}
+
 // encode过程使用\x00作为不同字符串的分界标志，所以字符串中的\x00需要转译成\x01；\x01需要转译成\x01\x02。可以保证顺序
 func escapeString(in []byte) []byte {
 	zeros := bytes.Count(in, []byte{0})
@@ -62,56 +134,67 @@ func escapeString(in []byte) []byte {
 	return out
 }
 
-func decodeValues(in []byte, out []Value) {
+// escapeString的逆过程，结果总是新分配的，不会引用page中的数据
+func unescapeString(in []byte) []byte {
+	out := make([]byte, 0, len(in))
+	for i := 0; i < len(in); i++ {
+		if in[i] == 0x01 && i+1 < len(in) {
+			i++
+			out = append(out, in[i]-1)
+		} else {
+			out = append(out, in[i])
+		}
+	}
+	return out
+}
+
+// out中的类型来自表定义，数据不完整时返回ErrCorrupt
+func decodeValues(in []byte, out []Value) error {
+	_, err := decodeValuesLen(in, out)
+	return err
+}
+
+// 同decodeValues，同时返回用掉的字节数
+func decodeValuesLen(in []byte, out []Value) (int, error) {
 	offset := 0
 	for i, v := range out {
 		switch v.Type {
-		case TYPE_INT64:
-			uint64Val := binary.BigEndian.Uint64(in[offset:])
-			int64Val := int64(uint64Val - (1 << 63))
-
-			out[i].I64 = int64Val
+		case TYPE_INT64, TYPE_TIMESTAMP, TYPE_UINT64, TYPE_FLOAT64:
+			if len(in[offset:]) < 8 {
+				return 0, fmt.Errorf("%w: decodeValues, %s is truncated", ErrCorrupt, typeName(v.Type))
+			}
+			u := binary.BigEndian.Uint64(in[offset:])
+			switch v.Type {
+			case TYPE_INT64, TYPE_TIMESTAMP:
+				out[i].I64 = int64(u - (1 << 63))
+			case TYPE_UINT64:
+				out[i].I64 = int64(u)
+			case TYPE_FLOAT64:
+				out[i].I64 = int64(math.Float64bits(decodeFloat64(u)))
+			}
 			offset += 8
 
-		case TYPE_BYTES:
-			zeroIdx := bytes.IndexByte(in[offset:], 0)
-			if zeroIdx == -1 {
-				assert(zeroIdx != -1, "decodeValues fail, cannot find zero")
+		case TYPE_BOOL:
+			if offset >= len(in) || in[offset] > 1 {
+				return 0, fmt.Errorf("%w: decodeValues, bad bool", ErrCorrupt)
 			}
+			out[i].I64 = int64(in[offset])
+			offset += 1
 
-			str := in[offset:zeroIdx]
-			escapeVal := make([]byte, 0)
-			pos := 0
-			for idx, ch := range str {
-				if ch == 0 {
-					break
-				}
-				if pos != idx {
-					continue
-				}
-
-				if ch == 1 {
-					if idx+1 < len(str) && str[idx+1] == 2 {
-						escapeVal = append(escapeVal, 1)
-						pos += 2
-					} else {
-						escapeVal = append(escapeVal, 0)
-						pos++
-					}
-
-				} else {
-					escapeVal = append(escapeVal, ch)
-					pos++
-				}
+		case TYPE_BYTES:
+			zeroIdx := bytes.IndexByte(in[offset:], 0)
+			if zeroIdx < 0 {
+				return 0, fmt.Errorf("%w: decodeValues, cannot find zero", ErrCorrupt)
 			}
 
-			out[i].Str = escapeVal
+			out[i].Str = unescapeString(in[offset : offset+zeroIdx])
 			offset += (zeroIdx + 1)
 
 		default:
-			panic("wrong type")
+			return 0, fmt.Errorf("%w: decodeValues, %d", ErrBadType, v.Type)
 		}
 	}
+	return offset, nil
 }
 
 func encodeKey(out []byte, prefix uint32, vals []Value) []byte {
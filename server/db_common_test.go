@@ -1,7 +1,68 @@
 package server
 
-import "testing"
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+)
 
 func TestDecodeValues(t *testing.T) {
+	vals := []Value{
+		{Type: TYPE_INT64, I64: -5},
+		{Type: TYPE_BYTES, Str: []byte("a\x00b\x01c")},
+		{Type: TYPE_INT64, I64: 42},
+	}
+	data := encodeValues(nil, vals)
 
+	out := []Value{{Type: TYPE_INT64}, {Type: TYPE_BYTES}, {Type: TYPE_INT64}}
+	if err := decodeValues(data, out); err != nil {
+		t.Fatal(err)
+	}
+	if out[0].I64 != -5 || !bytes.Equal(out[1].Str, vals[1].Str) || out[2].I64 != 42 {
+		t.Fatalf("wrong decoded values: %v", out)
+	}
+}
+
+// 编码后的字节序和值的顺序一致
+func TestEncodeOrder(t *testing.T) {
+	ordered := map[uint32][]Value{}
+	for _, f := range []float64{math.Inf(-1), -1e300, -1.5, -math.SmallestNonzeroFloat64, 0, math.SmallestNonzeroFloat64, 1, 1e300, math.Inf(1), math.NaN()} {
+		ordered[TYPE_FLOAT64] = append(ordered[TYPE_FLOAT64], *(&Record{}).AddFloat64("", f).Get(""))
+	}
+	for _, u := range []uint64{0, 1, 1 << 63, math.MaxUint64} {
+		ordered[TYPE_UINT64] = append(ordered[TYPE_UINT64], *(&Record{}).AddUint64("", u).Get(""))
+	}
+	for _, ts := range []time.Time{time.Unix(-1, 0), time.Unix(0, 0), time.Unix(0, 1), time.Unix(1700000000, 0)} {
+		ordered[TYPE_TIMESTAMP] = append(ordered[TYPE_TIMESTAMP], *(&Record{}).AddTime("", ts).Get(""))
+	}
+	for _, b := range []bool{false, true} {
+		ordered[TYPE_BOOL] = append(ordered[TYPE_BOOL], *(&Record{}).AddBool("", b).Get(""))
+	}
+
+	for typ, vals := range ordered {
+		for i, v := range vals {
+			data := encodeValues(nil, []Value{v})
+			out := []Value{{Type: typ}}
+			if err := decodeValues(data, out); err != nil {
+				t.Fatal(err)
+			}
+			if out[0].I64 != v.I64 && !(typ == TYPE_FLOAT64 && math.IsNaN(v.Float64())) {
+				t.Fatalf("%s: wrong decoded value: %v, expected: %v", typeName(typ), out[0], v)
+			}
+			if i > 0 && bytes.Compare(encodeValues(nil, vals[i-1:i]), data) >= 0 {
+				t.Fatalf("%s: wrong order at %d", typeName(typ), i)
+			}
+		}
+	}
+
+	// -0和0，不同的NaN都是同一个key
+	zero := encodeValues(nil, []Value{*(&Record{}).AddFloat64("", 0).Get("")})
+	if negZero := encodeValues(nil, []Value{*(&Record{}).AddFloat64("", math.Copysign(0, -1)).Get("")}); !bytes.Equal(zero, negZero) {
+		t.Fatalf("-0 should be the same as 0")
+	}
+	nan := encodeValues(nil, []Value{*(&Record{}).AddFloat64("", math.NaN()).Get("")})
+	if negNaN := encodeValues(nil, []Value{*(&Record{}).AddFloat64("", math.Float64frombits(0xfff8000000000123)).Get("")}); !bytes.Equal(nan, negNaN) {
+		t.Fatalf("all NaNs should be the same")
+	}
 }
@@ -1,22 +1,49 @@
 package server
 
-import "fmt"
-
 func (db *DB) Delete(table string, rec Record) (bool, error) {
-	tdef := getTableDef(db, table)
-	if tdef == nil {
-		return false, fmt.Errorf("table not found: %s", table)
+	deleted := false
+	err := db.update(func(tx *DBTX) (err error) {
+		deleted, err = tx.Delete(table, rec)
+		return err
+	})
+	return deleted, err
+}
+
+func (tx *DBTX) Delete(table string, rec Record) (bool, error) {
+	tdef, err := getTableDef(&tx.DBReader, table)
+	if err != nil {
+		return false, err
 	}
 
-	return dbDelete(db, tdef, rec)
+	return dbDelete(tx, tdef, rec)
 }
 
-func dbDelete(db *DB, tdef *TableDef, rec Record) (bool, error) {
-	values, err := checkRecord(tdef, rec)
+func dbDelete(tx *DBTX, tdef *TableDef, rec Record) (bool, error) {
+	values, err := checkRecord(tdef, rec, tdef.PKeys)
 	if err != nil {
 		return false, err
 	}
 
 	key := encodeKey(nil, tdef.Prefix, values[:tdef.PKeys])
-	return db.kv.Del(key)
+	if len(tdef.Indexes) == 0 {
+		return tx.kv.Del(key)
+	}
+
+	// 删除索引前需要先拿到旧的行
+	old, ok, err := tx.kv.Get(key)
+	if err != nil || !ok {
+		return false, err
+	}
+	for i := tdef.PKeys; i < len(tdef.Cols); i++ {
+		values[i].Type = tdef.Types[i]
+	}
+	if err := decodeRow(tdef, old, values[tdef.PKeys:]); err != nil {
+		return false, err
+	}
+
+	deleted, err := tx.kv.Del(key)
+	if err != nil || !deleted {
+		return deleted, err
+	}
+	return true, indexUpdate(tx, tdef, values, nil)
 }
@@ -1,31 +1,38 @@
 package server
 
-import "fmt"
-
 func (db *DB) Get(table string, rec *Record) (bool, error) {
-	tdef := getTableDef(db, table)
-	if tdef == nil {
-		return false, fmt.Errorf("tbale not found: %s", table)
+	tx := DBReader{}
+	db.BeginRead(&tx)
+	defer db.EndRead(&tx)
+	return tx.Get(table, rec)
+}
+
+func (tx *DBReader) Get(table string, rec *Record) (bool, error) {
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return false, err
 	}
-	return dbGet(db, tdef, rec)
+	return dbGet(tx, tdef, rec)
 }
 
-func dbGet(db *DB, tdef *TableDef, rec *Record) (bool, error) {
-	values, err := checkRecord(tdef, *rec)
+func dbGet(tx *DBReader, tdef *TableDef, rec *Record) (bool, error) {
+	values, err := checkRecord(tdef, *rec, tdef.PKeys)
 	if err != nil {
 		return false, err
 	}
 
 	key := encodeKey(nil, tdef.Prefix, values[:tdef.PKeys])
-	val, ok := db.kv.Get(key)
-	if !ok {
-		return false, nil
+	val, ok, err := tx.kv.Get(key)
+	if err != nil || !ok {
+		return false, err
 	}
 
 	for i := tdef.PKeys; i < len(tdef.Cols); i++ {
 		values[i].Type = tdef.Types[i]
 	}
-	decodeValues(val, values[tdef.PKeys:])
+	if err := decodeRow(tdef, val, values[tdef.PKeys:]); err != nil {
+		return false, err
+	}
 
 	rec.Cols = append(rec.Cols, tdef.Cols[tdef.PKeys:]...)
 	rec.Vals = append(rec.Vals, values[tdef.PKeys:]...)
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+)
+
+/*
+*
+secondary index的key-value格式:
+
+	key: | index prefix | index cols (含补齐的主键列) |, 可以为NULL的列见db_null.go
+	val: 空
+
+通过索引查询到主键后，再用主键查询整行
+*/
+func encodeIndexKey(tdef *TableDef, idx int, values []Value) []byte {
+	index := tdef.Indexes[idx]
+	vals := make([]Value, len(index))
+	for i, col := range index {
+		vals[i] = values[colIndex(tdef, col)]
+	}
+	return encodeKeyNullable(nil, tdef.IndexPrefixes[idx], vals, tdef.colsNullable(index))
+}
+
+// maintain all indexes of a row
+// oldVals为nil表示新增的行，newVals为nil表示删除的行
+func indexUpdate(tx *DBTX, tdef *TableDef, oldVals, newVals []Value) error {
+	for i := range tdef.Indexes {
+		var oldKey, newKey []byte
+		if oldVals != nil {
+			oldKey = encodeIndexKey(tdef, i, oldVals)
+		}
+		if newVals != nil {
+			newKey = encodeIndexKey(tdef, i, newVals)
+		}
+		// 索引列没有变化
+		if bytes.Equal(oldKey, newKey) {
+			continue
+		}
+
+		if oldKey != nil {
+			if _, err := tx.kv.Del(oldKey); err != nil {
+				return err
+			}
+		}
+		if newKey != nil {
+			if _, err := tx.kv.Update(&InsertReq{Key: newKey}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 选择一个和查询列匹配的索引，查询的列必须是索引列的前缀
+// -1表示使用主键
+func findIndex(tdef *TableDef, keys []string) (int, error) {
+	if isPrefix(tdef.Cols[:tdef.PKeys], keys) {
+		return -1, nil
+	}
+
+	// 多个索引都匹配时，选择列最少的那个
+	winner := -2
+	for i, index := range tdef.Indexes {
+		if !isPrefix(index, keys) {
+			continue
+		}
+		if winner == -2 || len(index) < len(tdef.Indexes[winner]) {
+			winner = i
+		}
+	}
+	if winner == -2 {
+		return -2, fmt.Errorf("no index found for columns: %v", keys)
+	}
+	return winner, nil
+}
+
+func isPrefix(long []string, short []string) bool {
+	if len(long) < len(short) {
+		return false
+	}
+	for i, c := range short {
+		if long[i] != c {
+			return false
+		}
+	}
+	return true
+}
@@ -1,12 +1,24 @@
 package server
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"strings"
 )
 
 const TABLE_PREFIX_MIN uint32 = 3
 
+// the format of the catalog and the records, 保存在@meta的version中
+// 格式不兼容的修改需要增加版本，旧的代码不会打开新版本的文件
+//
+//	1: the first version
+//	2: TableDef.Nullable and the null bitmap, 见db_null.go
+const CATALOG_VERSION uint32 = 2
+
+// 内部表的名字以@开头，用户不能创建或者直接访问
+const INTERNAL_TABLE_PREFIX = "@"
+
 var TDEF_META = &TableDef{
 	Prefix: 1,
 	Name:   "@meta",
@@ -23,31 +35,94 @@ var TDEF_TABLE = &TableDef{
 	PKeys:  1,
 }
 
-func getTableDef(db *DB, name string) *TableDef {
+// 新文件写入catalog的版本和内部表的定义，已有的文件检查版本
+// 旧的版本都兼容，新的格式只用于之后创建的表，打开时升级到当前的版本
+// 在加入版本之前创建的文件没有version，格式和版本1相同
+func catalogInit(tx *DBTX) error {
+	meta := (&Record{}).AddStr("key", []byte("version"))
+	ok, err := dbGet(&tx.DBReader, TDEF_META, meta)
+	if err != nil {
+		return err
+	}
+	version := uint32(0)
+	if ok {
+		val := meta.Get("val").Str
+		if len(val) != 4 {
+			return fmt.Errorf("%w: version: %v", ErrCorrupt, val)
+		}
+		version = binary.LittleEndian.Uint32(val)
+	}
+	switch {
+	case version == CATALOG_VERSION:
+		return nil
+	case version > CATALOG_VERSION:
+		return fmt.Errorf("%w: %d, expect %d", ErrBadVersion, version, CATALOG_VERSION)
+	}
+
+	meta = (&Record{}).AddStr("key", []byte("version"))
+	meta.AddStr("val", binary.LittleEndian.AppendUint32(nil, CATALOG_VERSION))
+	if _, err := dbUpdate(tx, TDEF_META, *meta, MODE_UPSERT); err != nil {
+		return err
+	}
+	if version > 0 {
+		return nil
+	}
+	// 内部表的定义只用于描述文件的内容，读写内部表使用TDEF_META和TDEF_TABLE
+	for _, tdef := range []*TableDef{TDEF_META, TDEF_TABLE} {
+		val, err := json.Marshal(tdef)
+		if err != nil {
+			return err
+		}
+		table := (&Record{}).AddStr("name", []byte(tdef.Name)).AddStr("def", val)
+		if _, err := dbUpdate(tx, TDEF_TABLE, *table, MODE_UPSERT); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 表定义创建后不会修改，读事务读到的都是已经提交的，可以缓存
+func getTableDef(tx *DBReader, name string) (*TableDef, error) {
+	if strings.HasPrefix(name, INTERNAL_TABLE_PREFIX) {
+		return nil, fmt.Errorf("internal table: %s", name)
+	}
+	db := tx.db
+	db.mu.Lock()
 	tdef, ok := db.tables[name]
-	if !ok {
+	db.mu.Unlock()
+	if ok {
+		return tdef, nil
+	}
+
+	tdef, err := getTableDefDB(tx, name)
+	if err != nil {
+		return nil, err
+	}
+	if tdef == nil {
+		return nil, fmt.Errorf("table not found: %s", name)
+	}
+	if !tx.writer {
+		db.mu.Lock()
 		if db.tables == nil {
 			db.tables = map[string]*TableDef{}
 		}
-
-		tdef = getTableDefDB(db, name)
-		if tdef != nil {
-			db.tables[name] = tdef
-		}
+		db.tables[name] = tdef
+		db.mu.Unlock()
 	}
-	return tdef
+	return tdef, nil
 }
 
-func getTableDefDB(db *DB, name string) *TableDef {
+// 表不存在时返回nil
+func getTableDefDB(tx *DBReader, name string) (*TableDef, error) {
 	rec := (&Record{}).AddStr("name", []byte(name))
-	ok, err := dbGet(db, TDEF_TABLE, rec)
-	assert(err == nil, fmt.Sprintf("getTableDefDB, fail to get db def, err: %s", err))
-	if !ok {
-		return nil
+	ok, err := dbGet(tx, TDEF_TABLE, rec)
+	if err != nil || !ok {
+		return nil, err
 	}
 
 	tdef := &TableDef{}
-	err = json.Unmarshal(rec.Get("def").Str, tdef)
-	assert(err == nil, fmt.Sprintf("getTableDefDB, fail to unmarshal db def, tdef:%v", rec.Get("def")))
-	return tdef
+	if err := json.Unmarshal(rec.Get("def").Str, tdef); err != nil {
+		return nil, fmt.Errorf("%w: the definition of table %s: %v", ErrCorrupt, name, err)
+	}
+	return tdef, nil
 }
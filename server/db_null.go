@@ -0,0 +1,127 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+)
+
+/*
+*
+TableDef.Nullable中为true的列可以是NULL，主键列不能是NULL。NULL的值是Type为TYPE_NULL的Value。
+
+有可以为NULL的列的表，行的值前面是非主键列的null bitmap，NULL的列不占用空间:
+
+	| bitmap (n+7)/8 bytes | values except NULLs |
+
+第i个非主键列是NULL时bitmap第i/8个字节的第i%8位为1。没有这样的列的表和原来的格式一样。
+
+索引key中可以为NULL的列前面有一个标记，NULL是0x00，其他的值是0x01，所以NULL排在所有的值前面:
+
+	| 0x00 | or | 0x01 | value |
+*/
+
+const (
+	NULL_MARK_NULL  = 0x00
+	NULL_MARK_VALUE = 0x01
+)
+
+func (t *TableDef) nullable(col int) bool {
+	return col < len(t.Nullable) && t.Nullable[col]
+}
+
+func (t *TableDef) hasNullable() bool {
+	return slices.Contains(t.Nullable, true)
+}
+
+// the nullability of the columns by name, 用于索引的key
+func (t *TableDef) colsNullable(cols []string) []bool {
+	out := make([]bool, len(cols))
+	for i, col := range cols {
+		out[i] = t.nullable(colIndex(t, col))
+	}
+	return out
+}
+
+// vals是非主键列的值
+func encodeRow(tdef *TableDef, vals []Value) []byte {
+	if !tdef.hasNullable() {
+		return encodeValues(nil, vals)
+	}
+	out := make([]byte, (len(vals)+7)/8)
+	for i, v := range vals {
+		if v.Type == TYPE_NULL {
+			out[i/8] |= 1 << (i % 8)
+		} else {
+			out = encodeValues(out, vals[i:i+1])
+		}
+	}
+	return out
+}
+
+// out中的类型来自表定义，NULL的列会改成TYPE_NULL
+func decodeRow(tdef *TableDef, in []byte, out []Value) error {
+	if !tdef.hasNullable() {
+		return decodeValues(in, out)
+	}
+	offset := (len(out) + 7) / 8
+	if len(in) < offset {
+		return fmt.Errorf("%w: decodeRow, the null bitmap is truncated", ErrCorrupt)
+	}
+	for i := range out {
+		if in[i/8]&(1<<(i%8)) != 0 {
+			out[i] = Value{Type: TYPE_NULL}
+			continue
+		}
+		n, err := decodeValuesLen(in[offset:], out[i:i+1])
+		if err != nil {
+			return err
+		}
+		offset += n
+	}
+	return nil
+}
+
+// 同encodeKey，nullable的列加上NULL的标记，vals可以比nullable短(范围查询的边界)
+func encodeKeyNullable(out []byte, prefix uint32, vals []Value, nullable []bool) []byte {
+	out = binary.BigEndian.AppendUint32(out, prefix)
+	for i, v := range vals {
+		switch {
+		case !nullable[i]:
+		case v.Type == TYPE_NULL:
+			out = append(out, NULL_MARK_NULL)
+			continue
+		default:
+			out = append(out, NULL_MARK_VALUE)
+		}
+		out = encodeValues(out, vals[i:i+1])
+	}
+	return out
+}
+
+// encodeKeyNullable去掉prefix之后的部分
+func decodeKeyNullable(in []byte, out []Value, nullable []bool) error {
+	offset := 0
+	for i := range out {
+		if nullable[i] {
+			if offset >= len(in) {
+				return fmt.Errorf("%w: decodeKey, the null mark is truncated", ErrCorrupt)
+			}
+			mark := in[offset]
+			offset++
+			if mark == NULL_MARK_NULL {
+				out[i] = Value{Type: TYPE_NULL}
+				continue
+			}
+			if mark != NULL_MARK_VALUE {
+				return fmt.Errorf("%w: decodeKey, bad null mark: %d", ErrCorrupt, mark)
+			}
+		}
+		n, err := decodeValuesLen(in[offset:], out[i:i+1])
+		if err != nil {
+			return err
+		}
+		offset += n
+	}
+	return nil
+}
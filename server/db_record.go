@@ -1,55 +1,120 @@
 package server
 
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
 const (
 	TYPE_ERROR = iota
 	TYPE_BYTES
 	TYPE_INT64
+	TYPE_FLOAT64
+	TYPE_BOOL
+	TYPE_TIMESTAMP
+	TYPE_UINT64
+	TYPE_NULL // the value of a nullable column, 不能作为列的类型
 )
 
+func typeName(typ uint32) string {
+	switch typ {
+	case TYPE_BYTES:
+		return "bytes"
+	case TYPE_INT64:
+		return "int64"
+	case TYPE_FLOAT64:
+		return "float64"
+	case TYPE_BOOL:
+		return "bool"
+	case TYPE_TIMESTAMP:
+		return "timestamp"
+	case TYPE_UINT64:
+		return "uint64"
+	case TYPE_NULL:
+		return "null"
+	default:
+		return fmt.Sprintf("type(%d)", typ)
+	}
+}
+
+func validType(typ uint32) bool {
+	return TYPE_BYTES <= typ && typ <= TYPE_UINT64
+}
+
+// 除了bytes以外的类型都保存在I64中，用Float64、Bool、Time、Uint64读取:
+//
+//	float64:   math.Float64bits
+//	bool:      0 or 1
+//	timestamp: nanoseconds since the Unix epoch
+//	uint64:    the same bits
 type Value struct {
 	Type uint32
 	I64  int64
 	Str  []byte
 }
 
+func (v Value) IsNull() bool {
+	return v.Type == TYPE_NULL
+}
+
+func (v Value) Float64() float64 {
+	return math.Float64frombits(uint64(v.I64))
+}
+
+func (v Value) Bool() bool {
+	return v.I64 != 0
+}
+
+func (v Value) Time() time.Time {
+	return time.Unix(0, v.I64)
+}
+
+func (v Value) Uint64() uint64 {
+	return uint64(v.I64)
+}
+
 type Record struct {
 	Cols []string
 	Vals []Value
 }
 
 func (r *Record) AddStr(key string, val []byte) *Record {
-	if r.Cols == nil {
-		r.Cols = make([]string, 0)
-	}
-	r.Cols = append(r.Cols, key)
+	return r.add(key, Value{Type: TYPE_BYTES, Str: val})
+}
 
-	v := Value{
-		Type: TYPE_BYTES,
-		Str:  val,
-	}
-	if r.Vals == nil {
-		r.Vals = make([]Value, 0)
-	}
-	r.Vals = append(r.Vals, v)
+func (r *Record) AddInt64(key string, val int64) *Record {
+	return r.add(key, Value{Type: TYPE_INT64, I64: val})
+}
 
-	return r
+func (r *Record) AddFloat64(key string, val float64) *Record {
+	return r.add(key, Value{Type: TYPE_FLOAT64, I64: int64(math.Float64bits(val))})
 }
 
-func (r *Record) AddInt64(key string, val int64) *Record {
-	if r.Cols == nil {
-		r.Cols = make([]string, 0)
+func (r *Record) AddBool(key string, val bool) *Record {
+	v := Value{Type: TYPE_BOOL}
+	if val {
+		v.I64 = 1
 	}
-	r.Cols = append(r.Cols, key)
+	return r.add(key, v)
+}
 
-	v := Value{
-		Type: TYPE_BYTES,
-		I64:  val,
-	}
-	if r.Vals == nil {
-		r.Vals = make([]Value, 0)
-	}
-	r.Vals = append(r.Vals, v)
+// 时间保存为纳秒，超出int64范围(1678年到2262年之外)的时间会溢出
+func (r *Record) AddTime(key string, val time.Time) *Record {
+	return r.add(key, Value{Type: TYPE_TIMESTAMP, I64: val.UnixNano()})
+}
 
+func (r *Record) AddUint64(key string, val uint64) *Record {
+	return r.add(key, Value{Type: TYPE_UINT64, I64: int64(val)})
+}
+
+func (r *Record) AddNull(key string) *Record {
+	return r.add(key, Value{Type: TYPE_NULL})
+}
+
+func (r *Record) add(key string, val Value) *Record {
+	r.Cols = append(r.Cols, key)
+	r.Vals = append(r.Vals, val)
 	return r
 }
 
@@ -0,0 +1,272 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// the iterator for range queries
+// Key1和Key2可以只包含主键或者某个索引的前几列，缺少的列视为任意值
+type Scanner struct {
+	// the range, from Key1 to Key2
+	Cmp1 int // CMP_??
+	Cmp2 int
+	Key1 Record
+	Key2 Record
+
+	// internal
+	tx      *DBReader
+	own     bool // the read transaction is started by DB.Scan
+	tdef    *TableDef
+	indexNo int    // -1: use the primary key; >= 0: use an index
+	prefix  uint32 // the prefix of the primary key or the index
+	iter    KVIter // the underlying KV iterator
+	keyEnd  []byte // the encoded Key2
+	cmpEnd  int    // Cmp2 adjusted for keyEnd
+	err     error  // 移动iterator时发现的数据损坏，由Deref返回
+}
+
+// within the range or not? 数据损坏时仍然返回true，错误由Deref返回
+func (sc *Scanner) Valid() bool {
+	if sc.err != nil {
+		return true
+	}
+	if sc.iter == nil {
+		return false // closed
+	}
+	ok, err := scanValid(sc)
+	if err != nil {
+		sc.err = err
+		return true
+	}
+	if !ok {
+		sc.Close()
+		return false
+	}
+	return true
+}
+
+func scanValid(sc *Scanner) (ok bool, err error) {
+	defer recoverCorrupt(&err)
+	if !sc.iter.Valid() {
+		return false, nil
+	}
+	key := sc.iter.Key()
+	// 不会越过当前表或索引的前缀
+	if !bytes.HasPrefix(key, encodeKey(nil, sc.prefix, nil)) {
+		return false, nil
+	}
+	return cmpOK(key, sc.cmpEnd, sc.keyEnd), nil
+}
+
+// 释放DB.Scan开始的读事务，可以重复调用，遍历到结尾时会自动调用
+// 没有Close的Scanner会一直持有读事务的快照，之后释放的page都不能重用，文件会不断增长
+func (sc *Scanner) Close() {
+	if sc.own {
+		sc.tx.db.EndRead(sc.tx)
+		sc.own = false
+		sc.iter = nil
+	}
+}
+
+// move the underlying B-tree iterator, 数据损坏之后的Next结束遍历
+func (sc *Scanner) Next() {
+	assert(sc.Valid(), "scanner next, scanner is not valid")
+	if sc.err != nil {
+		sc.err = nil
+		sc.Close()
+		sc.iter = nil
+		return
+	}
+	defer recoverCorrupt(&sc.err)
+	if sc.Cmp1 > 0 {
+		sc.iter.Next()
+	} else {
+		sc.iter.Prev()
+	}
+}
+
+// fetch the current row, 数据损坏时返回ErrCorrupt
+func (sc *Scanner) Deref(rec *Record) (err error) {
+	assert(sc.Valid(), "scanner deref, scanner is not valid")
+	if sc.err != nil {
+		return sc.err
+	}
+	defer recoverCorrupt(&err)
+
+	tdef := sc.tdef
+	if sc.indexNo < 0 {
+		// primary key, decode the KV pair
+		key, val := sc.iter.Deref()
+		values := make([]Value, len(tdef.Cols))
+		for i := range values {
+			values[i].Type = tdef.Types[i]
+		}
+		if err := decodeValues(key[4:], values[:tdef.PKeys]); err != nil {
+			return err
+		}
+		if err := decodeRow(tdef, val, values[tdef.PKeys:]); err != nil {
+			return err
+		}
+
+		rec.Cols = append([]string{}, tdef.Cols...)
+		rec.Vals = values
+		return nil
+	}
+
+	// secondary index, 从索引key中解出主键，再查询整行，索引的value是空的
+	key := sc.iter.Key()
+	index := tdef.Indexes[sc.indexNo]
+	ivals := make([]Value, len(index))
+	for i, col := range index {
+		ivals[i].Type = tdef.Types[colIndex(tdef, col)]
+	}
+	if err := decodeKeyNullable(key[4:], ivals, tdef.colsNullable(index)); err != nil {
+		return err
+	}
+	icol := Record{Cols: index, Vals: ivals}
+
+	rec.Cols = append([]string{}, tdef.Cols[:tdef.PKeys]...)
+	rec.Vals = rec.Vals[:0]
+	for _, col := range rec.Cols {
+		rec.Vals = append(rec.Vals, *icol.Get(col))
+	}
+	ok, err := dbGet(sc.tx, tdef, rec)
+	if err == nil && !ok {
+		err = fmt.Errorf("%w: scanner deref, index points to a missing row", ErrCorrupt)
+	}
+	return err
+}
+
+// 不在事务中的Scan会开始一个读事务，由Scanner持有，调用者必须在用完之后Close:
+//
+//	if err := db.Scan(table, sc); err != nil { ... }
+//	defer sc.Close()
+//
+// 事务中的Scan(DBReader.Scan和DBTX.Scan)使用事务本身，Close没有作用
+func (db *DB) Scan(table string, req *Scanner) error {
+	tx := &DBReader{}
+	db.BeginRead(tx)
+	if err := tx.Scan(table, req); err != nil {
+		db.EndRead(tx)
+		return err
+	}
+	req.own = true
+	return nil
+}
+
+func (tx *DBReader) Scan(table string, req *Scanner) error {
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return err
+	}
+	return dbScan(tx, tdef, req)
+}
+
+func dbScan(tx *DBReader, tdef *TableDef, req *Scanner) (err error) {
+	// sanity checks
+	switch {
+	case !validCmp(req.Cmp1) || !validCmp(req.Cmp2):
+		return fmt.Errorf("bad range, cmp1: %v, cmp2: %v", req.Cmp1, req.Cmp2)
+	case req.Cmp1 > 0 && req.Cmp2 < 0:
+	case req.Cmp2 > 0 && req.Cmp1 < 0:
+	default:
+		return fmt.Errorf("bad range, cmp1: %v, cmp2: %v", req.Cmp1, req.Cmp2)
+	}
+
+	// 两个边界的列需要是同一个前缀，用较长的那个选择索引
+	keys := req.Key1.Cols
+	if len(req.Key2.Cols) > len(keys) {
+		keys = req.Key2.Cols
+	}
+	if !isPrefix(keys, req.Key1.Cols) || !isPrefix(keys, req.Key2.Cols) {
+		return fmt.Errorf("bad range, key1: %v, key2: %v", req.Key1.Cols, req.Key2.Cols)
+	}
+	indexNo, err := findIndex(tdef, keys)
+	if err != nil {
+		return err
+	}
+
+	cols, prefix := tdef.Cols[:tdef.PKeys], tdef.Prefix
+	if indexNo >= 0 {
+		cols, prefix = tdef.Indexes[indexNo], tdef.IndexPrefixes[indexNo]
+	}
+	values1, err := checkKeyPrefix(tdef, cols, req.Key1)
+	if err != nil {
+		return err
+	}
+	values2, err := checkKeyPrefix(tdef, cols, req.Key2)
+	if err != nil {
+		return err
+	}
+
+	req.tx = tx
+	req.tdef = tdef
+	req.indexNo = indexNo
+	req.prefix = prefix
+	nullable := tdef.colsNullable(cols)
+	keyStart, cmpStart := encodeKeyRange(prefix, nullable, values1, req.Cmp1)
+	req.keyEnd, req.cmpEnd = encodeKeyRange(prefix, nullable, values2, req.Cmp2)
+
+	// seek to the start key
+	req.iter, req.err = nil, nil
+	defer recoverCorrupt(&err)
+	req.iter = tx.kv.Seek(keyStart, cmpStart, req.keyEnd, req.cmpEnd)
+	return nil
+}
+
+// 范围的边界可以只包含主键或索引的前几列，但列的顺序必须一致
+func checkKeyPrefix(tdef *TableDef, cols []string, rec Record) ([]Value, error) {
+	if len(rec.Cols) > len(cols) {
+		return nil, fmt.Errorf("checkKeyPrefix fail, len(cols): %v, len(record.Cols): %v", len(cols), len(rec.Cols))
+	}
+	if len(rec.Vals) != len(rec.Cols) {
+		return nil, fmt.Errorf("checkKeyPrefix fail, len(record.Cols): %v, len(record.Vals): %v", len(rec.Cols), len(rec.Vals))
+	}
+	for i, col := range rec.Cols {
+		if col != cols[i] {
+			return nil, fmt.Errorf("checkKeyPrefix fail, column %s is not the key column at %d", col, i)
+		}
+		if err := checkValue(tdef, colIndex(tdef, col), rec.Vals[i]); err != nil {
+			return nil, fmt.Errorf("checkKeyPrefix fail, %w", err)
+		}
+	}
+	return rec.Vals, nil
+}
+
+/*
+*
+编码范围的边界。当只给出部分key列时，编码结果P是所有匹配行的key的前缀:
+
+	>= P 和 < P 不需要调整
+	>  P 需要跳过所有以P开头的key, 即 >= succ(P)
+	<= P 需要包含所有以P开头的key, 即 <  succ(P)
+
+succ(P)是比所有以P开头的key都大的最小字节串
+*/
+func encodeKeyRange(prefix uint32, nullable []bool, vals []Value, cmp int) ([]byte, int) {
+	key := encodeKeyNullable(nil, prefix, vals, nullable)
+	if len(vals) == len(nullable) {
+		return key, cmp
+	}
+
+	switch cmp {
+	case CMP_GT:
+		return prefixSucc(key), CMP_GE
+	case CMP_LE:
+		return prefixSucc(key), CMP_LT
+	default:
+		return key, cmp
+	}
+}
+
+func prefixSucc(prefix []byte) []byte {
+	out := append([]byte{}, prefix...)
+	for i := len(out) - 1; i >= 0; i-- {
+		if out[i] != 0xff {
+			out[i]++
+			return out[:i+1]
+		}
+	}
+	panic("prefixSucc, prefix is all 0xff")
+}
@@ -4,6 +4,8 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"slices"
+	"strings"
 )
 
 type TableDef struct {
@@ -12,15 +14,56 @@ type TableDef struct {
 	Cols   []string // col names
 	PKeys  int
 	Prefix uint32
+	// 可以为NULL的列，为空时所有的列都不能为NULL，见db_null.go
+	Nullable []bool
+	// secondary indexes, 每个索引末尾会补齐缺少的主键列，保证索引key唯一
+	Indexes       [][]string
+	IndexPrefixes []uint32
 }
 
+// 成功之后tdef中是分配的prefix和补齐主键列的索引
 func (db *DB) TableNew(tdef *TableDef) error {
+	// 冲突时重试，每次都从调用者的tdef开始
+	var created *TableDef
+	err := db.update(func(tx *DBTX) error {
+		created = tdef.clone()
+		return tableNew(tx, created)
+	})
+	if err == nil {
+		*tdef = *created
+	}
+	return err
+}
+
+func (tx *DBTX) TableNew(tdef *TableDef) error {
+	created := tdef.clone()
+	if err := tableNew(tx, created); err != nil {
+		return err
+	}
+	*tdef = *created
+	return nil
+}
+
+func (t *TableDef) clone() *TableDef {
+	out := *t
+	out.Types = slices.Clone(t.Types)
+	out.Cols = slices.Clone(t.Cols)
+	out.Nullable = slices.Clone(t.Nullable)
+	out.Indexes = slices.Clone(t.Indexes)
+	for i, index := range out.Indexes {
+		out.Indexes[i] = slices.Clone(index)
+	}
+	out.IndexPrefixes = slices.Clone(t.IndexPrefixes)
+	return &out
+}
+
+func tableNew(tx *DBTX, tdef *TableDef) error {
 	if err := tdef.tableDefCheck(); err != nil {
 		return err
 	}
 
 	table := (&Record{}).AddStr("name", []byte(tdef.Name))
-	ok, err := dbGet(db, TDEF_TABLE, table)
+	ok, err := dbGet(&tx.DBReader, TDEF_TABLE, table)
 	if err != nil {
 		return err
 	}
@@ -28,24 +71,34 @@ func (db *DB) TableNew(tdef *TableDef) error {
 		return fmt.Errorf("table exists: %s", tdef.Name)
 	}
 
-	// allocate a new prefix
-	assert(tdef.Prefix == 0, fmt.Sprintf("tableNew, tdef.prefix is not zero, prefix:%v", tdef.Prefix))
+	// allocate new prefixes, one for the table and one for each index
 	tdef.Prefix = TABLE_PREFIX_MIN
 	meta := (&Record{}).AddStr("key", []byte("next_prefix"))
-	ok, err = dbGet(db, TDEF_META, meta)
+	ok, err = dbGet(&tx.DBReader, TDEF_META, meta)
 	if err != nil {
 		return err
 	}
 	if ok {
-		tdef.Prefix = binary.LittleEndian.Uint32(meta.Get("val").Str)
-		assert(tdef.Prefix > TABLE_PREFIX_MIN, fmt.Sprintf("tdef.prefix: %d is over table_prefix_min: %d", tdef.Prefix, TABLE_PREFIX_MIN))
+		val := meta.Get("val").Str
+		if len(val) != 4 {
+			return fmt.Errorf("%w: next_prefix: %v", ErrCorrupt, val)
+		}
+		tdef.Prefix = binary.LittleEndian.Uint32(val)
+		if tdef.Prefix <= TABLE_PREFIX_MIN {
+			return fmt.Errorf("%w: next_prefix %d is not over table_prefix_min: %d", ErrCorrupt, tdef.Prefix, TABLE_PREFIX_MIN)
+		}
 	} else {
 		meta.AddStr("val", make([]byte, 4))
 	}
 
+	for i := range tdef.Indexes {
+		tdef.IndexPrefixes = append(tdef.IndexPrefixes, tdef.Prefix+1+uint32(i))
+	}
+
 	// update the next prefix
-	binary.LittleEndian.PutUint32(meta.Get("val").Str, tdef.Prefix+1)
-	_, err = dbUpdate(db, TDEF_META, *meta, MODE_UPSERT)
+	next := tdef.Prefix + 1 + uint32(len(tdef.Indexes))
+	binary.LittleEndian.PutUint32(meta.Get("val").Str, next)
+	_, err = dbUpdate(tx, TDEF_META, *meta, MODE_UPSERT)
 	if err != nil {
 		return err
 	}
@@ -56,7 +109,7 @@ func (db *DB) TableNew(tdef *TableDef) error {
 		return err
 	}
 	table.AddStr("def", val)
-	_, err = dbUpdate(db, TDEF_TABLE, *table, MODE_UPSERT)
+	_, err = dbUpdate(tx, TDEF_TABLE, *table, MODE_UPSERT)
 	return err
 }
 
@@ -64,6 +117,20 @@ func (t *TableDef) tableDefCheck() error {
 	if t.Name == "" {
 		return fmt.Errorf("name should not be empty")
 	}
+	if strings.HasPrefix(t.Name, INTERNAL_TABLE_PREFIX) {
+		return fmt.Errorf("the name %s is reserved for internal tables", t.Name)
+	}
+
+	// 前缀由TableNew分配
+	if t.Prefix != 0 || len(t.IndexPrefixes) != 0 {
+		return fmt.Errorf("prefixes should not be set, prefix: %v, index prefixes: %v", t.Prefix, t.IndexPrefixes)
+	}
+
+	for _, typ := range t.Types {
+		if !validType(typ) {
+			return fmt.Errorf("%w: %d", ErrBadType, typ)
+		}
+	}
 
 	if len(t.Cols) != len(t.Types) {
 		return fmt.Errorf("cols should be equal to types")
@@ -72,6 +139,61 @@ func (t *TableDef) tableDefCheck() error {
 	if t.PKeys == len(t.Cols) {
 		return fmt.Errorf("pkeys should be smaller than cols length")
 	}
+	if t.PKeys < 1 || t.PKeys > len(t.Cols) {
+		return fmt.Errorf("pkeys out of range: %v", t.PKeys)
+	}
+
+	if len(t.Nullable) != 0 && len(t.Nullable) != len(t.Cols) {
+		return fmt.Errorf("nullable should be empty or equal to cols")
+	}
+	for i := 0; i < t.PKeys; i++ {
+		if t.nullable(i) {
+			return fmt.Errorf("the primary key column %s should not be nullable", t.Cols[i])
+		}
+	}
+
+	for i, index := range t.Indexes {
+		index, err := checkIndexKeys(t, index)
+		if err != nil {
+			return err
+		}
+		t.Indexes[i] = index
+	}
 
 	return nil
 }
+
+// 检查索引的列，并在末尾补齐缺少的主键列
+func checkIndexKeys(tdef *TableDef, index []string) ([]string, error) {
+	if len(index) == 0 {
+		return nil, fmt.Errorf("index should not be empty")
+	}
+
+	seen := map[string]bool{}
+	for _, col := range index {
+		if colIndex(tdef, col) < 0 {
+			return nil, fmt.Errorf("unknown index column: %s", col)
+		}
+		if seen[col] {
+			return nil, fmt.Errorf("duplicated index column: %s", col)
+		}
+		seen[col] = true
+	}
+
+	out := append([]string{}, index...)
+	for _, col := range tdef.Cols[:tdef.PKeys] {
+		if !seen[col] {
+			out = append(out, col)
+		}
+	}
+	return out, nil
+}
+
+func colIndex(tdef *TableDef, col string) int {
+	for i, c := range tdef.Cols {
+		if c == col {
+			return i
+		}
+	}
+	return -1
+}
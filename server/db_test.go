@@ -0,0 +1,885 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestDB(t *testing.T) *DB {
+	path := t.TempDir() + "/test.db"
+	// the tests don't need durability
+	db, err := Open(path, Options{SyncMode: SyncNever})
+	if err != nil {
+		t.Fatalf("fail to open db, err: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func newOrdersTable(t *testing.T, db *DB) {
+	tdef := &TableDef{
+		Name:  "orders",
+		Types: []uint32{TYPE_BYTES, TYPE_BYTES, TYPE_BYTES},
+		Cols:  []string{"customer_id", "order_id", "item"},
+		PKeys: 2,
+	}
+	if err := db.TableNew(tdef); err != nil {
+		t.Fatalf("fail to create table, err: %s", err)
+	}
+	for c := 1; c <= 3; c++ {
+		for o := 1; o <= 5; o++ {
+			rec := (&Record{}).
+				AddStr("customer_id", []byte(fmt.Sprintf("c%d", c))).
+				AddStr("order_id", []byte(fmt.Sprintf("o%02d", o))).
+				AddStr("item", []byte(fmt.Sprintf("item-%d-%d", c, o)))
+			if ok, err := db.Insert("orders", *rec); !ok || err != nil {
+				t.Fatalf("fail to insert, ok: %v, err: %v", ok, err)
+			}
+		}
+	}
+}
+
+func scanAll(t *testing.T, db *DB, table string, sc *Scanner) []Record {
+	if err := db.Scan(table, sc); err != nil {
+		t.Fatalf("fail to scan, err: %s", err)
+	}
+	defer sc.Close()
+	out := []Record{}
+	for ; sc.Valid(); sc.Next() {
+		rec := Record{}
+		sc.Deref(&rec)
+		out = append(out, rec)
+	}
+	return out
+}
+
+func TestDBGetSet(t *testing.T) {
+	db := newTestDB(t)
+	newOrdersTable(t, db)
+
+	rec := (&Record{}).AddStr("customer_id", []byte("c1")).AddStr("order_id", []byte("o01"))
+	if ok, err := db.Get("orders", rec); !ok || err != nil {
+		t.Fatalf("fail to get, ok: %v, err: %v", ok, err)
+	}
+	if string(rec.Get("item").Str) != "item-1-1" {
+		t.Fatalf("wrong item, got: %s", rec.Get("item").Str)
+	}
+
+	dup := (&Record{}).AddStr("customer_id", []byte("c1")).AddStr("order_id", []byte("o01")).AddStr("item", []byte("x"))
+	if ok, err := db.Insert("orders", *dup); ok || err != nil {
+		t.Fatalf("insert should not overwrite, ok: %v, err: %v", ok, err)
+	}
+
+	key := (&Record{}).AddStr("customer_id", []byte("c1")).AddStr("order_id", []byte("o01"))
+	if ok, err := db.Delete("orders", *key); !ok || err != nil {
+		t.Fatalf("fail to delete, ok: %v, err: %v", ok, err)
+	}
+	rec = (&Record{}).AddStr("customer_id", []byte("c1")).AddStr("order_id", []byte("o01"))
+	if ok, _ := db.Get("orders", rec); ok {
+		t.Fatalf("deleted row should not be found")
+	}
+}
+
+func TestDBScan(t *testing.T) {
+	db := newTestDB(t)
+	newOrdersTable(t, db)
+
+	// another table right after orders, the scan should not cross into it
+	other := &TableDef{Name: "other", Types: []uint32{TYPE_BYTES, TYPE_BYTES}, Cols: []string{"k", "v"}, PKeys: 1}
+	if err := db.TableNew(other); err != nil {
+		t.Fatalf("fail to create table, err: %s", err)
+	}
+	if _, err := db.Insert("other", *(&Record{}).AddStr("k", []byte("k")).AddStr("v", []byte("v"))); err != nil {
+		t.Fatalf("fail to insert, err: %s", err)
+	}
+
+	c2 := func() Record { return *(&Record{}).AddStr("customer_id", []byte("c2")) }
+
+	// all orders of c2
+	rows := scanAll(t, db, "orders", &Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: c2(), Key2: c2()})
+	if len(rows) != 5 {
+		t.Fatalf("wrong number of rows, got: %d, expected: 5", len(rows))
+	}
+	for i, rec := range rows {
+		if string(rec.Get("item").Str) != fmt.Sprintf("item-2-%d", i+1) {
+			t.Fatalf("wrong row, idx: %d, item: %s", i, rec.Get("item").Str)
+		}
+	}
+
+	// 提前结束的遍历需要Close，否则读事务一直存在
+	sc := &Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: c2(), Key2: c2()}
+	if err := db.Scan("orders", sc); err != nil || !sc.Valid() {
+		t.Fatalf("fail to scan, err: %v", err)
+	}
+	sc.Close()
+	sc.Close()
+	if n := len(db.kv.readers); n != 0 {
+		t.Fatalf("the read transaction is not released, readers: %d", n)
+	}
+
+	// paging: orders of c2 after o03
+	start := c2()
+	start.AddStr("order_id", []byte("o03"))
+	rows = scanAll(t, db, "orders", &Scanner{Cmp1: CMP_GT, Cmp2: CMP_LE, Key1: start, Key2: c2()})
+	if len(rows) != 2 || string(rows[0].Get("order_id").Str) != "o04" {
+		t.Fatalf("wrong paging result: %v", rows)
+	}
+
+	// descending, customers after c2
+	rows = scanAll(t, db, "orders", &Scanner{Cmp1: CMP_LE, Cmp2: CMP_GT, Key1: Record{}, Key2: c2()})
+	if len(rows) != 5 || string(rows[0].Get("item").Str) != "item-3-5" {
+		t.Fatalf("wrong descending result: %v", rows)
+	}
+
+	// the whole table
+	rows = scanAll(t, db, "orders", &Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: Record{}, Key2: Record{}})
+	if len(rows) != 15 {
+		t.Fatalf("wrong number of rows, got: %d, expected: 15", len(rows))
+	}
+
+	if err := db.Scan("orders", &Scanner{Cmp1: CMP_GE, Cmp2: CMP_GE}); err == nil {
+		t.Fatalf("bad range should fail")
+	}
+}
+
+func TestDBIndex(t *testing.T) {
+	db := newTestDB(t)
+	tdef := &TableDef{
+		Name:    "users",
+		Types:   []uint32{TYPE_BYTES, TYPE_BYTES, TYPE_BYTES},
+		Cols:    []string{"id", "name", "city"},
+		PKeys:   1,
+		Indexes: [][]string{{"city"}, {"name", "city"}},
+	}
+	if err := db.TableNew(tdef); err != nil {
+		t.Fatalf("fail to create table, err: %s", err)
+	}
+
+	user := func(id, name, city string) Record {
+		return *(&Record{}).AddStr("id", []byte(id)).AddStr("name", []byte(name)).AddStr("city", []byte(city))
+	}
+	for _, rec := range []Record{
+		user("u1", "alice", "paris"),
+		user("u2", "bob", "berlin"),
+		user("u3", "carol", "paris"),
+		user("u4", "dave", "rome"),
+	} {
+		if _, err := db.Insert("users", rec); err != nil {
+			t.Fatalf("fail to insert, err: %s", err)
+		}
+	}
+
+	byCity := func(city string) []string {
+		key := *(&Record{}).AddStr("city", []byte(city))
+		ids := []string{}
+		for _, rec := range scanAll(t, db, "users", &Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: key, Key2: key}) {
+			ids = append(ids, string(rec.Get("id").Str))
+		}
+		return ids
+	}
+	if ids := byCity("paris"); fmt.Sprint(ids) != "[u1 u3]" {
+		t.Fatalf("wrong index scan result: %v", ids)
+	}
+
+	// the stale index entry is removed when the indexed column changes
+	if _, err := db.Update("users", user("u1", "alice", "rome")); err != nil {
+		t.Fatalf("fail to update, err: %s", err)
+	}
+	if ids := byCity("paris"); fmt.Sprint(ids) != "[u3]" {
+		t.Fatalf("wrong index scan result after update: %v", ids)
+	}
+	if ids := byCity("rome"); fmt.Sprint(ids) != "[u1 u4]" {
+		t.Fatalf("wrong index scan result after update: %v", ids)
+	}
+
+	if _, err := db.Delete("users", *(&Record{}).AddStr("id", []byte("u4"))); err != nil {
+		t.Fatalf("fail to delete, err: %s", err)
+	}
+	if ids := byCity("rome"); fmt.Sprint(ids) != "[u1]" {
+		t.Fatalf("wrong index scan result after delete: %v", ids)
+	}
+
+	// the second index
+	key := *(&Record{}).AddStr("name", []byte("carol"))
+	rows := scanAll(t, db, "users", &Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: key, Key2: key})
+	if len(rows) != 1 || string(rows[0].Get("city").Str) != "paris" {
+		t.Fatalf("wrong index scan result: %v", rows)
+	}
+
+	// no index on this column
+	key = *(&Record{}).AddStr("nope", []byte("x"))
+	if err := db.Scan("users", &Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: key, Key2: key}); err == nil {
+		t.Fatalf("scan without a matching index should fail")
+	}
+}
+
+func TestDBTX(t *testing.T) {
+	db := newTestDB(t)
+	newOrdersTable(t, db)
+
+	order := func(c, o, item string) Record {
+		return *(&Record{}).AddStr("customer_id", []byte(c)).AddStr("order_id", []byte(o)).AddStr("item", []byte(item))
+	}
+	get := func(c, o string) bool {
+		rec := (&Record{}).AddStr("customer_id", []byte(c)).AddStr("order_id", []byte(o))
+		ok, err := db.Get("orders", rec)
+		if err != nil {
+			t.Fatalf("fail to get, err: %s", err)
+		}
+		return ok
+	}
+
+	tx := DBTX{}
+	db.Begin(&tx)
+	tx.Insert("orders", order("c9", "o01", "x"))
+	tx.Delete("orders", *(&Record{}).AddStr("customer_id", []byte("c1")).AddStr("order_id", []byte("o01")))
+	sc := &Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE}
+	if err := tx.Scan("orders", sc); err != nil {
+		t.Fatalf("fail to scan, err: %s", err)
+	}
+	count := 0
+	for ; sc.Valid(); sc.Next() {
+		count++
+	}
+	if count != 15 {
+		t.Fatalf("transaction should see its own writes, rows: %d", count)
+	}
+	db.Abort(&tx)
+	if get("c9", "o01") || !get("c1", "o01") {
+		t.Fatalf("aborted transaction should change nothing")
+	}
+
+	db.Begin(&tx)
+	tx.Insert("orders", order("c9", "o01", "x"))
+	tx.Delete("orders", *(&Record{}).AddStr("customer_id", []byte("c1")).AddStr("order_id", []byte("o01")))
+	if err := db.Commit(&tx); err != nil {
+		t.Fatalf("fail to commit, err: %s", err)
+	}
+	if !get("c9", "o01") || get("c1", "o01") {
+		t.Fatalf("committed transaction should apply all changes")
+	}
+}
+
+func TestDBConcurrent(t *testing.T) {
+	db := newTestDB(t)
+	tdef := &TableDef{Name: "accounts", Types: []uint32{TYPE_BYTES, TYPE_BYTES}, Cols: []string{"id", "balance"}, PKeys: 1}
+	if err := db.TableNew(tdef); err != nil {
+		t.Fatalf("fail to create table, err: %s", err)
+	}
+	account := func(id string, balance int) Record {
+		return *(&Record{}).AddStr("id", []byte(id)).AddStr("balance", []byte(fmt.Sprint(balance)))
+	}
+	db.Insert("accounts", account("a", 100))
+	db.Insert("accounts", account("b", 0))
+
+	// the writer moves money between two accounts, readers always see the same total
+	done := make(chan struct{})
+	errs := make(chan error, 4)
+	for r := 0; r < 3; r++ {
+		go func() {
+			for {
+				select {
+				case <-done:
+					errs <- nil
+					return
+				default:
+				}
+				sc := &Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE}
+				if err := db.Scan("accounts", sc); err != nil {
+					errs <- err
+					return
+				}
+				total := 0
+				for ; sc.Valid(); sc.Next() {
+					rec, n := Record{}, 0
+					sc.Deref(&rec)
+					fmt.Sscan(string(rec.Get("balance").Str), &n)
+					total += n
+				}
+				sc.Close()
+				if total != 100 {
+					errs <- fmt.Errorf("reader sees a partial transaction, total: %d", total)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 1; i <= 100; i++ {
+		tx := DBTX{}
+		db.Begin(&tx)
+		tx.Update("accounts", account("a", 100-i))
+		tx.Update("accounts", account("b", i))
+		if err := db.Commit(&tx); err != nil {
+			t.Fatalf("fail to commit, err: %s", err)
+		}
+	}
+	close(done)
+	for r := 0; r < 3; r++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDBConcurrentWriters(t *testing.T) {
+	db := newTestDB(t)
+	tdef := &TableDef{Name: "counters", Types: []uint32{TYPE_BYTES, TYPE_BYTES}, Cols: []string{"id", "n"}, PKeys: 1}
+	if err := db.TableNew(tdef); err != nil {
+		t.Fatalf("fail to create table, err: %s", err)
+	}
+	counter := func(n int) Record {
+		return *(&Record{}).AddStr("id", []byte("c")).AddStr("n", []byte(fmt.Sprint(n)))
+	}
+	db.Insert("counters", counter(0))
+
+	// read-modify-write in concurrent transactions, conflicts are retried
+	errs := make(chan error, 4)
+	for w := 0; w < 4; w++ {
+		go func() {
+			for i := 0; i < 25; i++ {
+				err := db.update(func(tx *DBTX) error {
+					rec := (&Record{}).AddStr("id", []byte("c"))
+					if _, err := tx.Get("counters", rec); err != nil {
+						return err
+					}
+					n := 0
+					fmt.Sscan(string(rec.Get("n").Str), &n)
+					_, err := tx.Update("counters", counter(n+1))
+					return err
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+	// 等所有的writer结束之后再检查，db在测试结束时关闭
+	var err error
+	for w := 0; w < 4; w++ {
+		err = errors.Join(err, <-errs)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := (&Record{}).AddStr("id", []byte("c"))
+	if ok, err := db.Get("counters", rec); !ok || err != nil {
+		t.Fatalf("fail to get, ok: %v, err: %v", ok, err)
+	}
+	if n := string(rec.Get("n").Str); n != "100" {
+		t.Fatalf("lost update, got: %s, expected: 100", n)
+	}
+}
+
+// 冲突重试时tdef中不能留下上一次分配的prefix
+func TestDBConcurrentTableNew(t *testing.T) {
+	db := newTestDB(t)
+	tdefs := make([]*TableDef, 32)
+	errs := make(chan error, len(tdefs))
+	for i := range tdefs {
+		tdefs[i] = &TableDef{
+			Name:    fmt.Sprintf("t%d", i),
+			Types:   []uint32{TYPE_BYTES, TYPE_BYTES},
+			Cols:    []string{"k", "v"},
+			PKeys:   1,
+			Indexes: [][]string{{"v"}},
+		}
+		go func(tdef *TableDef) {
+			errs <- db.TableNew(tdef)
+		}(tdefs[i])
+	}
+	var err error
+	for range tdefs {
+		err = errors.Join(err, <-errs)
+	}
+	if err != nil {
+		t.Fatalf("fail to create table, err: %s", err)
+	}
+
+	tx := DBReader{}
+	db.BeginRead(&tx)
+	defer db.EndRead(&tx)
+	prefixes := map[uint32]bool{}
+	for _, tdef := range tdefs {
+		stored, err := getTableDef(&tx, tdef.Name)
+		if err != nil {
+			t.Fatalf("fail to get the table def, err: %s", err)
+		}
+		if stored.Prefix != tdef.Prefix || len(tdef.IndexPrefixes) != 1 || stored.IndexPrefixes[0] != tdef.IndexPrefixes[0] {
+			t.Fatalf("wrong prefixes, got: %+v, stored: %+v", tdef, stored)
+		}
+		for _, prefix := range append([]uint32{tdef.Prefix}, tdef.IndexPrefixes...) {
+			if prefixes[prefix] {
+				t.Fatalf("duplicated prefix: %d", prefix)
+			}
+			prefixes[prefix] = true
+		}
+	}
+}
+
+func TestDBErrors(t *testing.T) {
+	db := newTestDB(t)
+	newOrdersTable(t, db)
+
+	rec := (&Record{}).AddStr("customer_id", []byte("c1")).AddStr("order_id", []byte("o01"))
+	rec.Vals[1].Type = 100
+	if _, err := db.Get("orders", rec); !errors.Is(err, ErrBadType) {
+		t.Fatalf("expect ErrBadType, got: %v", err)
+	}
+	row := (&Record{}).AddStr("customer_id", []byte("c1")).AddStr("order_id", []byte("o01")).AddStr("item", nil)
+	row.Vals[2].Type = TYPE_ERROR
+	if _, err := db.Upsert("orders", *row); !errors.Is(err, ErrBadType) {
+		t.Fatalf("expect ErrBadType, got: %v", err)
+	}
+
+	key := strings.Repeat("k", BTREE_KEY_LIMIT)
+	row = (&Record{}).AddStr("customer_id", []byte(key)).AddStr("order_id", []byte("o01")).AddStr("item", nil)
+	if _, err := db.Insert("orders", *row); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("expect ErrKeyTooLarge, got: %v", err)
+	}
+
+	tdef := &TableDef{Name: "bad", Types: []uint32{TYPE_BYTES, 100}, Cols: []string{"a", "b"}, PKeys: 1}
+	if err := db.TableNew(tdef); !errors.Is(err, ErrBadType) {
+		t.Fatalf("expect ErrBadType, got: %v", err)
+	}
+	if _, err := db.Get("missing", rec); err == nil {
+		t.Fatalf("expect an error for a missing table")
+	}
+}
+
+func TestDBOpen(t *testing.T) {
+	path := t.TempDir() + "/test.db"
+	db, err := Open(path, Options{SyncMode: SyncNever})
+	if err != nil {
+		t.Fatalf("fail to open db, err: %s", err)
+	}
+	newOrdersTable(t, db)
+	if err := db.Close(); err != nil {
+		t.Fatalf("fail to close db, err: %s", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close twice, err: %s", err)
+	}
+
+	// reopen, the catalog and the rows are kept
+	db, err = Open(path, Options{})
+	if err != nil {
+		t.Fatalf("fail to reopen db, err: %s", err)
+	}
+	rec := (&Record{}).AddStr("customer_id", []byte("c3")).AddStr("order_id", []byte("o05"))
+	if ok, err := db.Get("orders", rec); !ok || err != nil || string(rec.Get("item").Str) != "item-3-5" {
+		t.Fatalf("fail to get after reopen, ok: %v, err: %v", ok, err)
+	}
+	tx := DBReader{}
+	db.BeginRead(&tx)
+	for _, tdef := range []*TableDef{TDEF_META, TDEF_TABLE} {
+		if stored, err := getTableDefDB(&tx, tdef.Name); err != nil || stored == nil || stored.Prefix != tdef.Prefix {
+			t.Fatalf("internal table not bootstrapped: %s, got: %v, err: %v", tdef.Name, stored, err)
+		}
+	}
+	db.EndRead(&tx)
+
+	// the internal tables are not accessible by name
+	if _, err := db.Get("@table", (&Record{}).AddStr("name", []byte("orders"))); err == nil {
+		t.Fatalf("internal table should not be accessible")
+	}
+	if err := db.TableNew(&TableDef{Name: "@t", Types: []uint32{TYPE_BYTES, TYPE_BYTES}, Cols: []string{"k", "v"}, PKeys: 1}); err == nil {
+		t.Fatalf("internal table name should be rejected")
+	}
+
+	// an older catalog version is upgraded, a newer one is rejected
+	setVersion := func(version uint32) {
+		err := db.update(func(tx *DBTX) error {
+			val := binary.LittleEndian.AppendUint32(nil, version)
+			meta := (&Record{}).AddStr("key", []byte("version")).AddStr("val", val)
+			_, err := dbUpdate(tx, TDEF_META, *meta, MODE_UPDATE_ONLY)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("fail to update version, err: %s", err)
+		}
+		db.Close()
+	}
+	setVersion(1)
+	if db, err = Open(path, Options{}); err != nil {
+		t.Fatalf("fail to open an old version, err: %s", err)
+	}
+	meta := (&Record{}).AddStr("key", []byte("version"))
+	db.BeginRead(&tx)
+	ok, err := dbGet(&tx, TDEF_META, meta)
+	db.EndRead(&tx)
+	if !ok || err != nil || binary.LittleEndian.Uint32(meta.Get("val").Str) != CATALOG_VERSION {
+		t.Fatalf("the catalog is not upgraded, ok: %v, err: %v, meta: %v", ok, err, meta)
+	}
+
+	setVersion(CATALOG_VERSION + 1)
+	if _, err := Open(path, Options{}); !errors.Is(err, ErrBadVersion) {
+		t.Fatalf("expected ErrBadVersion, got: %v", err)
+	}
+	// the failed Open has released the file
+	if _, err := Open(path, Options{}); !errors.Is(err, ErrBadVersion) {
+		t.Fatalf("expected ErrBadVersion again, got: %v", err)
+	}
+}
+
+func TestDBRecordBinding(t *testing.T) {
+	db := newTestDB(t)
+	tdef := &TableDef{
+		Name:  "accounts",
+		Types: []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64},
+		Cols:  []string{"id", "name", "balance"},
+		PKeys: 1,
+	}
+	if err := db.TableNew(tdef); err != nil {
+		t.Fatalf("fail to create table, err: %s", err)
+	}
+
+	// the columns in any order
+	row := (&Record{}).AddInt64("balance", 100).AddStr("name", []byte("alice")).AddInt64("id", 1)
+	if ok, err := db.Insert("accounts", *row); !ok || err != nil {
+		t.Fatalf("fail to insert, ok: %v, err: %v", ok, err)
+	}
+	rec := (&Record{}).AddInt64("id", 1)
+	if ok, err := db.Get("accounts", rec); !ok || err != nil {
+		t.Fatalf("fail to get, ok: %v, err: %v", ok, err)
+	}
+	if string(rec.Get("name").Str) != "alice" || rec.Get("balance").I64 != 100 {
+		t.Fatalf("wrong row: %v", rec)
+	}
+
+	// 错误信息包含出错的列
+	cases := []struct {
+		rec  *Record
+		full bool
+		msg  string
+	}{
+		{(&Record{}).AddInt64("id", 1).AddStr("name", nil), true, "missing column: balance"},
+		{(&Record{}).AddInt64("id", 1).AddStr("name", nil).AddInt64("balance", 0).AddInt64("age", 0), true, "unknown column: age"},
+		{(&Record{}).AddInt64("id", 1).AddStr("name", nil).AddInt64("id", 2), true, "duplicated column: id"},
+		{(&Record{}).AddStr("id", []byte("1")).AddStr("name", nil).AddInt64("balance", 0), true, "column id expects int64, got bytes"},
+		{(&Record{}).AddInt64("id", 1).AddStr("name", nil), false, "column name is not a primary key"},
+		{&Record{}, false, "missing column: id"},
+	}
+	for _, c := range cases {
+		var err error
+		if c.full {
+			_, err = db.Upsert("accounts", *c.rec)
+		} else {
+			_, err = db.Get("accounts", c.rec)
+		}
+		if err == nil || !strings.Contains(err.Error(), c.msg) {
+			t.Fatalf("expect error %q, got: %v", c.msg, err)
+		}
+	}
+}
+
+func TestDBUpdateColumns(t *testing.T) {
+	db := newTestDB(t)
+	tdef := &TableDef{
+		Name:    "users",
+		Types:   []uint32{TYPE_BYTES, TYPE_BYTES, TYPE_BYTES, TYPE_INT64},
+		Cols:    []string{"id", "name", "city", "visits"},
+		PKeys:   1,
+		Indexes: [][]string{{"city"}},
+	}
+	if err := db.TableNew(tdef); err != nil {
+		t.Fatalf("fail to create table, err: %s", err)
+	}
+	row := (&Record{}).AddStr("id", []byte("u1")).AddStr("name", []byte("alice")).AddStr("city", []byte("paris")).AddInt64("visits", 1)
+	if _, err := db.Insert("users", *row); err != nil {
+		t.Fatalf("fail to insert, err: %s", err)
+	}
+
+	pk := *(&Record{}).AddStr("id", []byte("u1"))
+	changes := *(&Record{}).AddInt64("visits", 2).AddStr("city", []byte("rome"))
+	if ok, err := db.UpdateColumns("users", pk, changes); !ok || err != nil {
+		t.Fatalf("fail to update columns, ok: %v, err: %v", ok, err)
+	}
+	rec := (&Record{}).AddStr("id", []byte("u1"))
+	if ok, err := db.Get("users", rec); !ok || err != nil {
+		t.Fatalf("fail to get, ok: %v, err: %v", ok, err)
+	}
+	if string(rec.Get("name").Str) != "alice" || string(rec.Get("city").Str) != "rome" || rec.Get("visits").I64 != 2 {
+		t.Fatalf("wrong row after update: %v", rec)
+	}
+
+	// the index follows the changed column
+	for city, n := range map[string]int{"paris": 0, "rome": 1} {
+		key := *(&Record{}).AddStr("city", []byte(city))
+		if rows := scanAll(t, db, "users", &Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: key, Key2: key}); len(rows) != n {
+			t.Fatalf("wrong index scan result, city: %s, rows: %v", city, rows)
+		}
+	}
+
+	// nothing changed, or no such row
+	if ok, err := db.UpdateColumns("users", pk, changes); ok || err != nil {
+		t.Fatalf("unchanged row should not be updated, ok: %v, err: %v", ok, err)
+	}
+	missing := *(&Record{}).AddStr("id", []byte("u2"))
+	if ok, err := db.UpdateColumns("users", missing, changes); ok || err != nil {
+		t.Fatalf("missing row should not be updated, ok: %v, err: %v", ok, err)
+	}
+
+	for _, bad := range []*Record{
+		(&Record{}).AddStr("id", []byte("u3")),
+		(&Record{}).AddStr("age", []byte("1")),
+		(&Record{}).AddStr("visits", []byte("1")),
+		&Record{},
+	} {
+		if _, err := db.UpdateColumns("users", pk, *bad); err == nil {
+			t.Fatalf("expect an error for changes: %v", bad)
+		}
+	}
+}
+
+func TestDBTypes(t *testing.T) {
+	db := newTestDB(t)
+	tdef := &TableDef{
+		Name:    "events",
+		Types:   []uint32{TYPE_TIMESTAMP, TYPE_UINT64, TYPE_FLOAT64, TYPE_BOOL},
+		Cols:    []string{"at", "seq", "score", "done"},
+		PKeys:   2,
+		Indexes: [][]string{{"score"}, {"done"}},
+	}
+	if err := db.TableNew(tdef); err != nil {
+		t.Fatalf("fail to create table, err: %s", err)
+	}
+	base := time.Unix(1700000000, 123)
+	scores := []float64{2.5, -1, 0, -7.25, 1e10}
+	for i, score := range scores {
+		row := (&Record{}).AddTime("at", base.Add(time.Duration(i))).AddUint64("seq", math.MaxUint64-uint64(i)).
+			AddFloat64("score", score).AddBool("done", i%2 == 0)
+		if _, err := db.Insert("events", *row); err != nil {
+			t.Fatalf("fail to insert, err: %s", err)
+		}
+	}
+
+	rec := (&Record{}).AddTime("at", base.Add(3)).AddUint64("seq", math.MaxUint64-3)
+	if ok, err := db.Get("events", rec); !ok || err != nil {
+		t.Fatalf("fail to get, ok: %v, err: %v", ok, err)
+	}
+	if rec.Get("score").Float64() != -7.25 || rec.Get("done").Bool() {
+		t.Fatalf("wrong row: %v", rec)
+	}
+
+	// the float index is in the numeric order
+	all := scanAll(t, db, "events", &Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE,
+		Key1: *(&Record{}).AddFloat64("score", math.Inf(-1)), Key2: *(&Record{}).AddFloat64("score", math.Inf(1))})
+	got := []float64{}
+	for _, rec := range all {
+		got = append(got, rec.Get("score").Float64())
+	}
+	if fmt.Sprint(got) != "[-7.25 -1 0 2.5 1e+10]" {
+		t.Fatalf("wrong order of the float index: %v", got)
+	}
+	done := *(&Record{}).AddBool("done", true)
+	if rows := scanAll(t, db, "events", &Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: done, Key2: done}); len(rows) != 3 {
+		t.Fatalf("wrong number of done events: %d", len(rows))
+	}
+	// the primary key of timestamps
+	rows := scanAll(t, db, "events", &Scanner{Cmp1: CMP_GT, Cmp2: CMP_LE,
+		Key1: *(&Record{}).AddTime("at", base.Add(2)), Key2: *(&Record{}).AddTime("at", base.Add(time.Hour))})
+	if len(rows) != 2 || !rows[0].Get("at").Time().Equal(base.Add(3)) || rows[0].Get("seq").Uint64() != math.MaxUint64-3 {
+		t.Fatalf("wrong timestamp range: %v", rows)
+	}
+}
+
+func TestDBNull(t *testing.T) {
+	db := newTestDB(t)
+	tdef := &TableDef{
+		Name:     "people",
+		Types:    []uint32{TYPE_BYTES, TYPE_BYTES, TYPE_INT64, TYPE_BYTES},
+		Cols:     []string{"id", "name", "age", "email"},
+		PKeys:    1,
+		Nullable: []bool{false, false, true, true},
+		Indexes:  [][]string{{"age"}},
+	}
+	if err := db.TableNew(tdef); err != nil {
+		t.Fatalf("fail to create table, err: %s", err)
+	}
+
+	rows := []*Record{
+		(&Record{}).AddStr("id", []byte("p1")).AddStr("name", []byte("alice")).AddInt64("age", 30).AddStr("email", []byte("a@x")),
+		(&Record{}).AddStr("id", []byte("p2")).AddStr("name", []byte("bob")).AddNull("age").AddStr("email", []byte("")),
+		// the omitted nullable column is NULL
+		(&Record{}).AddStr("id", []byte("p3")).AddStr("name", []byte("carol")).AddInt64("age", -5),
+		(&Record{}).AddStr("id", []byte("p4")).AddStr("name", []byte("dave")),
+	}
+	for _, rec := range rows {
+		if ok, err := db.Insert("people", *rec); !ok || err != nil {
+			t.Fatalf("fail to insert, ok: %v, err: %v", ok, err)
+		}
+	}
+
+	rec := (&Record{}).AddStr("id", []byte("p3"))
+	if ok, err := db.Get("people", rec); !ok || err != nil {
+		t.Fatalf("fail to get, ok: %v, err: %v", ok, err)
+	}
+	if rec.Get("age").I64 != -5 || !rec.Get("email").IsNull() {
+		t.Fatalf("wrong row: %v", rec)
+	}
+	rec = (&Record{}).AddStr("id", []byte("p2"))
+	if ok, err := db.Get("people", rec); !ok || err != nil || !rec.Get("age").IsNull() || rec.Get("email").IsNull() {
+		t.Fatalf("wrong row: %v, ok: %v, err: %v", rec, ok, err)
+	}
+
+	// NULL排在所有的值前面
+	ids := func(sc *Scanner) string {
+		out := []string{}
+		for _, rec := range scanAll(t, db, "people", sc) {
+			out = append(out, string(rec.Get("id").Str))
+		}
+		return fmt.Sprint(out)
+	}
+	null := *(&Record{}).AddNull("age")
+	if got := ids(&Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: null, Key2: *(&Record{}).AddInt64("age", math.MaxInt64)}); got != "[p2 p4 p3 p1]" {
+		t.Fatalf("wrong index order: %s", got)
+	}
+	if got := ids(&Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: null, Key2: null}); got != "[p2 p4]" {
+		t.Fatalf("wrong NULL scan: %s", got)
+	}
+	if got := ids(&Scanner{Cmp1: CMP_GT, Cmp2: CMP_LE, Key1: null, Key2: *(&Record{}).AddInt64("age", 0)}); got != "[p3]" {
+		t.Fatalf("wrong scan after NULL: %s", got)
+	}
+
+	// NULL to a value and back, the index follows
+	pk := *(&Record{}).AddStr("id", []byte("p4"))
+	if ok, err := db.UpdateColumns("people", pk, *(&Record{}).AddInt64("age", 40)); !ok || err != nil {
+		t.Fatalf("fail to update, ok: %v, err: %v", ok, err)
+	}
+	if ok, err := db.UpdateColumns("people", *(&Record{}).AddStr("id", []byte("p1")), *(&Record{}).AddNull("age")); !ok || err != nil {
+		t.Fatalf("fail to update, ok: %v, err: %v", ok, err)
+	}
+	if got := ids(&Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: null, Key2: null}); got != "[p1 p2]" {
+		t.Fatalf("wrong NULL scan after update: %s", got)
+	}
+
+	// NOT NULL
+	if _, err := db.Upsert("people", *(&Record{}).AddStr("id", []byte("p5")).AddNull("name")); err == nil || !strings.Contains(err.Error(), "column name is not nullable") {
+		t.Fatalf("expect a NOT NULL error, got: %v", err)
+	}
+	if _, err := db.Upsert("people", *(&Record{}).AddStr("id", []byte("p5"))); err == nil || !strings.Contains(err.Error(), "missing column: name") {
+		t.Fatalf("expect a missing column error, got: %v", err)
+	}
+	if _, err := db.UpdateColumns("people", pk, *(&Record{}).AddNull("name")); err == nil {
+		t.Fatalf("expect a NOT NULL error")
+	}
+	bad := &TableDef{Name: "bad", Types: []uint32{TYPE_BYTES, TYPE_BYTES}, Cols: []string{"k", "v"}, PKeys: 1, Nullable: []bool{true, true}}
+	if err := db.TableNew(bad); err == nil {
+		t.Fatalf("the primary key should not be nullable")
+	}
+}
+
+// 索引指向的行不存在时返回ErrCorrupt，不能panic
+func TestDBIndexDangling(t *testing.T) {
+	db := newTestDB(t)
+	tdef := &TableDef{Name: "users", Types: []uint32{TYPE_BYTES, TYPE_BYTES}, Cols: []string{"id", "city"}, PKeys: 1, Indexes: [][]string{{"city"}}}
+	if err := db.TableNew(tdef); err != nil {
+		t.Fatalf("fail to create table, err: %s", err)
+	}
+	if _, err := db.Insert("users", *(&Record{}).AddStr("id", []byte("u1")).AddStr("city", []byte("paris"))); err != nil {
+		t.Fatalf("fail to insert, err: %s", err)
+	}
+	// remove the row but leave the index entry
+	err := db.update(func(tx *DBTX) error {
+		tdef, err := getTableDef(&tx.DBReader, "users")
+		if err != nil {
+			return err
+		}
+		key := encodeKey(nil, tdef.Prefix, []Value{{Type: TYPE_BYTES, Str: []byte("u1")}})
+		_, err = tx.kv.Del(key)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("fail to delete the row, err: %s", err)
+	}
+
+	key := *(&Record{}).AddStr("city", []byte("paris"))
+	sc := &Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: key, Key2: key}
+	if err := db.Scan("users", sc); err != nil {
+		t.Fatalf("fail to scan, err: %s", err)
+	}
+	defer sc.Close()
+	if !sc.Valid() {
+		t.Fatalf("the index entry should be found")
+	}
+	if err := sc.Deref(&Record{}); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expect ErrCorrupt, got: %v", err)
+	}
+}
+
+// 遍历到损坏的page时Deref返回ErrCorrupt，不能panic
+func TestDBScanCorrupt(t *testing.T) {
+	db := newTestDB(t)
+	tdef := &TableDef{Name: "t", Types: []uint32{TYPE_BYTES, TYPE_BYTES}, Cols: []string{"id", "v"}, PKeys: 1}
+	if err := db.TableNew(tdef); err != nil {
+		t.Fatalf("fail to create table, err: %s", err)
+	}
+	n := 300
+	for i := 0; i < n; i++ {
+		rec := (&Record{}).AddStr("id", []byte(fmt.Sprintf("%04d", i))).AddStr("v", bytes.Repeat([]byte("v"), 100))
+		if _, err := db.Insert("t", *rec); err != nil {
+			t.Fatalf("fail to insert, err: %s", err)
+		}
+	}
+	// the leaf of a row in the middle
+	key := encodeKey(nil, tdef.Prefix, []Value{{Type: TYPE_BYTES, Str: []byte("0200")}})
+	iter := db.kv.tree.SeekLE(key)
+	last := len(iter.path) - 1
+	if last < 1 {
+		t.Fatalf("expect more than one level")
+	}
+	ptr := iter.path[last-1].getPtr(iter.pos[last-1])
+	size := db.kv.tree.layout.size
+	db.Close()
+
+	fp, err := os.OpenFile(db.Path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.WriteAt([]byte("garbage"), int64(ptr)*int64(size)+int64(size/2)); err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+
+	db, err = Open(db.Path, Options{SyncMode: SyncNever})
+	if err != nil {
+		t.Fatalf("fail to reopen, err: %s", err)
+	}
+	defer db.Close()
+	sc := &Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE}
+	if err := db.Scan("t", sc); err != nil {
+		t.Fatalf("fail to scan, err: %s", err)
+	}
+	defer sc.Close()
+	rows := 0
+	for ; sc.Valid(); sc.Next() {
+		if err = sc.Deref(&Record{}); err != nil {
+			break
+		}
+		rows++
+	}
+	if !errors.Is(err, ErrCorrupt) || rows == 0 || rows >= n {
+		t.Fatalf("expect ErrCorrupt in the middle, rows: %d, err: %v", rows, err)
+	}
+	sc.Next()
+	if sc.Valid() {
+		t.Fatalf("the scanner should end after the error")
+	}
+
+	// starting from the bad page
+	sc = &Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: *(&Record{}).AddStr("id", []byte("0200")), Key2: *(&Record{}).AddStr("id", []byte("9999"))}
+	if err := db.Scan("t", sc); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expect ErrCorrupt from the seek, got: %v", err)
+	}
+}
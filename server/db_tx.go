@@ -0,0 +1,65 @@
+package server
+
+import "errors"
+
+// the read operations shared by KVReader and KVTX
+type KVView interface {
+	Get(key []byte) ([]byte, bool, error)
+	Seek(key1 []byte, cmp1 int, key2 []byte, cmp2 int) KVIter
+}
+
+// read-only DB transaction
+// DB的所有读写操作都在事务中进行，DB上的方法是只包含一个操作的事务
+type DBReader struct {
+	db *DB
+	kv KVView // 写事务中指向KVTX，能读到本事务的修改
+	// 写事务中读到的表定义可能还没有提交，不能放进缓存
+	writer bool
+}
+
+// read-write DB transaction, 读操作来自DBReader
+type DBTX struct {
+	DBReader
+	kv KVTX
+}
+
+func (db *DB) BeginRead(tx *DBReader) {
+	reader := &KVReader{}
+	db.kv.BeginRead(reader)
+	*tx = DBReader{db: db, kv: reader}
+}
+
+func (db *DB) EndRead(tx *DBReader) {
+	db.kv.EndRead(tx.kv.(*KVReader))
+}
+
+func (db *DB) Begin(tx *DBTX) {
+	db.kv.Begin(&tx.kv)
+	tx.DBReader = DBReader{db: db, kv: &tx.kv, writer: true}
+}
+
+// ErrConflict表示和并发的事务冲突，事务可以重试
+func (db *DB) Commit(tx *DBTX) error {
+	return db.kv.Commit(&tx.kv)
+}
+
+func (db *DB) Abort(tx *DBTX) {
+	db.kv.Abort(&tx.kv)
+}
+
+// run fn in a transaction, retry on conflicts up to TX_MAX_ATTEMPTS times
+func (db *DB) update(fn func(tx *DBTX) error) error {
+	for attempt := 1; ; attempt++ {
+		tx := DBTX{}
+		db.Begin(&tx)
+		if err := fn(&tx); err != nil {
+			db.Abort(&tx)
+			return err
+		}
+		err := db.Commit(&tx)
+		if !errors.Is(err, ErrConflict) || attempt == TX_MAX_ATTEMPTS {
+			return err
+		}
+		txBackoff(attempt)
+	}
+}
@@ -1,6 +1,10 @@
 package server
 
-import "fmt"
+import (
+	"bytes"
+	"fmt"
+	"slices"
+)
 
 const (
 	MODE_UPSERT      = 0
@@ -21,21 +25,145 @@ func (db *DB) Upsert(table string, rec Record) (bool, error) {
 }
 
 func (db *DB) Set(table string, rec Record, mode int) (bool, error) {
-	tdef := getTableDef(db, table)
-	if tdef == nil {
-		return false, fmt.Errorf("table not found: %s", table)
+	updated := false
+	err := db.update(func(tx *DBTX) (err error) {
+		updated, err = tx.Set(table, rec, mode)
+		return err
+	})
+	return updated, err
+}
+
+func (tx *DBTX) Insert(table string, rec Record) (bool, error) {
+	return tx.Set(table, rec, MODE_INSERT_ONLY)
+}
+
+func (tx *DBTX) Update(table string, rec Record) (bool, error) {
+	return tx.Set(table, rec, MODE_UPDATE_ONLY)
+}
+
+func (tx *DBTX) Upsert(table string, rec Record) (bool, error) {
+	return tx.Set(table, rec, MODE_UPSERT)
+}
+
+func (tx *DBTX) Set(table string, rec Record, mode int) (bool, error) {
+	tdef, err := getTableDef(&tx.DBReader, table)
+	if err != nil {
+		return false, err
+	}
+
+	return dbUpdate(tx, tdef, rec, mode)
+}
+
+func dbUpdate(tx *DBTX, tdef *TableDef, rec Record, mode int) (bool, error) {
+	values, err := checkRecord(tdef, rec, len(tdef.Cols))
+	if err != nil {
+		return false, err
+	}
+
+	req := &InsertReq{Mode: mode}
+	req.Key = encodeKey(nil, tdef.Prefix, values[:tdef.PKeys])
+	req.Val = encodeRow(tdef, values[tdef.PKeys:])
+	updated, err := tx.kv.Update(req)
+	if err != nil || !updated || len(tdef.Indexes) == 0 {
+		return updated, err
+	}
+
+	// maintain indexes
+	var oldValues []Value
+	if !req.Added {
+		oldValues = make([]Value, len(tdef.Cols))
+		copy(oldValues, values[:tdef.PKeys])
+		for i := tdef.PKeys; i < len(tdef.Cols); i++ {
+			oldValues[i].Type = tdef.Types[i]
+		}
+		if err := decodeRow(tdef, req.Old, oldValues[tdef.PKeys:]); err != nil {
+			return false, err
+		}
 	}
+	return true, indexUpdate(tx, tdef, oldValues, values)
+}
 
-	return dbUpdate(db, tdef, rec, mode)
+// 只修改changes中的列，其他的列保持不变，行不存在时返回false
+// 读旧的行和写入新的行在同一个事务中，并发的修改会导致冲突重试
+func (db *DB) UpdateColumns(table string, pk Record, changes Record) (bool, error) {
+	updated := false
+	err := db.update(func(tx *DBTX) (err error) {
+		updated, err = tx.UpdateColumns(table, pk, changes)
+		return err
+	})
+	return updated, err
 }
 
-func dbUpdate(db *DB, tdef *TableDef, rec Record, mode int) (bool, error) {
-	values, err := checkRecord(tdef, rec)
+func (tx *DBTX) UpdateColumns(table string, pk Record, changes Record) (bool, error) {
+	tdef, err := getTableDef(&tx.DBReader, table)
+	if err != nil {
+		return false, err
+	}
+
+	return dbUpdateColumns(tx, tdef, pk, changes)
+}
+
+func dbUpdateColumns(tx *DBTX, tdef *TableDef, pk Record, changes Record) (bool, error) {
+	values, err := checkRecord(tdef, pk, tdef.PKeys)
+	if err != nil {
+		return false, err
+	}
+	cols, err := checkChanges(tdef, changes)
 	if err != nil {
 		return false, err
 	}
 
 	key := encodeKey(nil, tdef.Prefix, values[:tdef.PKeys])
-	val := encodeValues(nil, values[tdef.PKeys:])
-	return db.kv.Update(key, val, mode)
+	old, ok, err := tx.kv.Get(key)
+	if err != nil || !ok {
+		return false, err
+	}
+	for i := tdef.PKeys; i < len(tdef.Cols); i++ {
+		values[i].Type = tdef.Types[i]
+	}
+	if err := decodeRow(tdef, old, values[tdef.PKeys:]); err != nil {
+		return false, err
+	}
+
+	oldValues := append([]Value{}, values...)
+	for i, idx := range cols {
+		values[idx] = changes.Vals[i]
+	}
+	val := encodeRow(tdef, values[tdef.PKeys:])
+	if bytes.Equal(old, val) {
+		return false, nil
+	}
+	if err := tx.kv.Set(key, val); err != nil {
+		return false, err
+	}
+	// 只有包含修改的列的索引会变化
+	return true, indexUpdate(tx, tdef, oldValues, values)
+}
+
+// the column index of each change, 主键不能修改
+func checkChanges(tdef *TableDef, changes Record) ([]int, error) {
+	if len(changes.Vals) != len(changes.Cols) {
+		return nil, fmt.Errorf("table %s: len(changes.Cols): %v, len(changes.Vals): %v", tdef.Name, len(changes.Cols), len(changes.Vals))
+	}
+	if len(changes.Cols) == 0 {
+		return nil, fmt.Errorf("table %s: no columns to update", tdef.Name)
+	}
+
+	cols := make([]int, len(changes.Cols))
+	for i, col := range changes.Cols {
+		idx := colIndex(tdef, col)
+		switch {
+		case idx < 0:
+			return nil, fmt.Errorf("table %s: unknown column: %s", tdef.Name, col)
+		case idx < tdef.PKeys:
+			return nil, fmt.Errorf("table %s: cannot update the primary key column: %s", tdef.Name, col)
+		case slices.Contains(cols[:i], idx):
+			return nil, fmt.Errorf("table %s: duplicated column: %s", tdef.Name, col)
+		}
+		if err := checkValue(tdef, idx, changes.Vals[i]); err != nil {
+			return nil, err
+		}
+		cols[i] = idx
+	}
+	return cols, nil
 }
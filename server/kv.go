@@ -1,17 +1,32 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"sync"
 	"syscall"
+	"time"
 )
 
 //  持久化和空闲页管理
 type KV struct {
 	Path string
-	fp   *os.File
-
-	tree BTree
+	// the page size of a new file, 0 for BTREE_PAGE_SIZE, 4K/8K/16K, 不支持更大的page
+	// 已有的文件使用master page中记录的page size，不为0时必须一致
+	PageSize int
+	// check the checksums of all pages on Open
+	Verify bool
+	// write-ahead log mode, 提交时只fsync log(见kv_wal.go)
+	WAL bool
+	// the max delay of a group commit, 0 for no waiting(见kv_commit.go)
+	CommitDelay time.Duration
+	// fsync on commits or not, SyncAlways by default(见kv_sync.go)
+	SyncMode SyncMode
+
+	fp *os.File
+
+	tree BTree // tree.root是最新提交的root，写事务在自己的tree上修改
 	free FreeList
 
 	mmap struct {
@@ -22,12 +37,41 @@ type KV struct {
 
 	page struct {
 		flushed uint64 // database size in number of pages, 已经分配了mmap对应位置
-		nfree   int    // number of pages taken from the free list
 		nappend int    // number of pages to be appended
 		// newly allocated or deallocated pages keyed by the pointer
 		// nil value denotes a deallocated page
 		updates map[uint64][]byte
 	}
+	masterSlot int    // the slot of the latest master page, 下一次写入另一个slot
+	synced     uint64 // the latest version whose master page is on disk
+
+	wal struct {
+		fp         *os.File      // the log, nil if not in WAL mode
+		size       int64         // the log size
+		checkpoint uint64        // the version of the master page in the file
+		err        error         // the failed checkpoint
+		notify     chan struct{} // wake up the checkpointer
+		stop       chan struct{}
+		done       chan struct{}
+	}
+
+	flusher struct {
+		stop chan struct{} // nil if not running
+		done chan struct{}
+		err  error // the failed fsync
+	}
+
+	// concurrency, 多个事务可以同时进行，提交是串行的
+	queue struct {
+		mu     sync.Mutex
+		reqs   []*commitReq  // waiting for the next group commit
+		notify chan struct{} // wake up the leader waiting for CommitDelay
+	}
+	writer  sync.Mutex    // only one commit at a time, protects the history
+	history []CommittedTX // committed write sets for conflict detection
+	mu      sync.Mutex    // protects the fields below, tree.root and mmap.chunks
+	version uint64        // incremented by each commit
+	readers ReaderList    // active transactions, a heap ordered by version
 }
 
 func InitKV(path string) *KV {
@@ -44,7 +88,6 @@ func InitKV(path string) *KV {
 
 		page: struct {
 			flushed uint64
-			nfree   int
 			nappend int
 			updates map[uint64][]byte
 		}{
@@ -54,26 +97,60 @@ func InitKV(path string) *KV {
 }
 
 // 操作
-func (db *KV) Get(key []byte) ([]byte, bool) {
-	return db.tree.Get(key)
+// 单个读操作也是一个读事务，返回的value是拷贝，读事务结束后page可能被复用
+func (db *KV) Get(key []byte) ([]byte, bool, error) {
+	tx := KVReader{}
+	db.BeginRead(&tx)
+	defer db.EndRead(&tx)
+
+	val, ok, err := tx.Get(key)
+	if !ok {
+		return nil, false, err
+	}
+	return append([]byte{}, val...), true, nil
 }
 
+// 单个操作也是一个事务，冲突时重试
 func (db *KV) Set(key []byte, val []byte) error {
-	db.tree.Insert(key, val)
-	return flushPages(db)
+	return db.update(func(tx *KVTX) error {
+		return tx.Set(key, val)
+	})
 }
 
-func (db *KV) Update(key []byte, val []byte, mode int) (bool, error) {
-
-	
-
-
-	return false, nil
+// 按照req.Mode插入或更新，返回值表示是否有数据被修改
+func (db *KV) Update(req *InsertReq) (bool, error) {
+	updated := false
+	err := db.update(func(tx *KVTX) (err error) {
+		updated, err = tx.Update(req)
+		return err
+	})
+	return updated, err
 }
 
 func (db *KV) Del(key []byte) (bool, error) {
-	deleted := db.tree.Delete(key)
-	return deleted, flushPages(db)
+	deleted := false
+	err := db.update(func(tx *KVTX) (err error) {
+		deleted, err = tx.Del(key)
+		return err
+	})
+	return deleted, err
+}
+
+// run fn in a transaction, retry on conflicts up to TX_MAX_ATTEMPTS times
+func (db *KV) update(fn func(tx *KVTX) error) error {
+	for attempt := 1; ; attempt++ {
+		tx := KVTX{}
+		db.Begin(&tx)
+		if err := fn(&tx); err != nil {
+			db.Abort(&tx)
+			return err
+		}
+		err := db.Commit(&tx)
+		if !errors.Is(err, ErrConflict) || attempt == TX_MAX_ATTEMPTS {
+			return err
+		}
+		txBackoff(attempt)
+	}
 }
 
 func (db *KV) Open() error {
@@ -83,8 +160,23 @@ func (db *KV) Open() error {
 	}
 	db.fp = fp
 
+	// 同一个文件只能被一个进程打开，多个进程需要通过网络服务共享
+	if err := syscall.Flock(int(fp.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer db.fp.Close()
+		return fmt.Errorf("lock %s: %w", db.Path, err)
+	}
+
+	// page size在mmap之前确定，新文件使用db.PageSize
+	layout, err := masterLayout(db.fp, db.PageSize)
+	if err != nil {
+		defer db.fp.Close()
+		return err
+	}
+	db.tree.layout = layout
+	db.free.layout = layout
+
 	// mmap映射 初始化mmap
-	sz, chunk, err := mmapInit(db.fp)
+	sz, chunk, err := mmapInit(db.fp, layout.size)
 	if err != nil {
 		defer db.fp.Close()
 		return err
@@ -94,19 +186,30 @@ func (db *KV) Open() error {
 	db.mmap.total = len(chunk)
 	db.mmap.chunks = [][]byte{chunk}
 
-	// tree如何操作page
+	// tree如何操作page, 写事务开始时会拷贝一份
 	db.tree.get = db.pageGet
 	db.tree.new = db.pageNew
 	db.tree.del = db.pageDel
 
 	db.free.get = db.pageGet
 	db.free.new = db.pageAppend
-	db.free.use = db.pageUse
+	db.free.set = db.pageWrite
+	db.free.put = db.pagePut
 
 	// 初始化 tree 和 flush
 	err = masterLoad(db)
+	if err == nil && db.Verify {
+		err = verifyPages(db)
+	}
+	if err == nil {
+		err = walOpen(db)
+	}
+	if err == nil {
+		flusherStart(db)
+	}
 	if err != nil {
-		defer db.fp.Close()
+		// mmap也持有文件锁
+		db.Close()
 		return err
 	}
 
@@ -114,6 +217,11 @@ func (db *KV) Open() error {
 }
 
 func (db *KV) Close() {
+	flusherStop(db)
+	if db.SyncMode.nosync && db.wal.fp == nil && db.fp != nil {
+		db.Sync()
+	}
+	walClose(db)
 	for _, chunk := range db.mmap.chunks {
 		err := syscall.Munmap(chunk)
 		assert(err == nil, "kv close err")
@@ -129,33 +237,40 @@ func (db *KV) pageGet(ptr uint64) BNode {
 		return BNode{page}
 	}
 
-	return pageGetMapped(db, ptr)
+	return pageGetMapped(db.mmap.chunks, db.tree.layout, ptr)
 }
 
-func pageGetMapped(db *KV, ptr uint64) BNode {
-	start := uint64(0)
-	for _, chunk := range db.mmap.chunks {
-		end := start + uint64(len(chunk))/BTREE_PAGE_SIZE
+// 从mmap读出的page会校验checksum
+func pageGetMapped(chunks [][]byte, layout pageLayout, ptr uint64) BNode {
+	node := pageMapped(chunks, layout.size, ptr)
+	if layout.checksum && !pageVerify(node.data) {
+		panic(errCorrupt("bad checksum, page: %d", ptr))
+	}
+	return node
+}
+
+// the page in the mmap without checking, 写入时使用
+func pageMapped(chunks [][]byte, pageSize int, ptr uint64) BNode {
+	start, size := uint64(0), uint64(pageSize)
+	for _, chunk := range chunks {
+		end := start + uint64(len(chunk))/size
 		if ptr < end {
-			offset := BTREE_PAGE_SIZE * (ptr - start)
-			return BNode{chunk[offset : offset+BTREE_PAGE_SIZE]}
+			offset := size * (ptr - start)
+			return BNode{chunk[offset : offset+size]}
 		}
 		start = end
 	}
-	panic("bad ptr")
+	panic(errCorrupt("bad ptr: %d", ptr))
 }
 
 // callback for tree
 
 // 若有空闲 则先分配空闲页 如果没有 则append个新页
 func (db *KV) pageNew(node BNode) uint64 {
-	assert(len(node.data) <= BTREE_PAGE_SIZE, "function:pageNew, node data size exceed PAGE_SIZE")
+	assert(len(node.data) == db.tree.layout.size, "function:pageNew, node data size is not PAGE_SIZE")
 
-	ptr := uint64(0)
-	if db.page.nfree < db.free.Total() {
-		ptr = db.free.Get(db.page.nfree)
-		db.page.nfree++
-	} else {
+	ptr := db.free.PopHead()
+	if ptr == 0 {
 		ptr = db.page.flushed + uint64(db.page.nappend)
 		db.page.nappend++
 	}
@@ -169,13 +284,28 @@ func (db *KV) pageDel(ptr uint64) {
 
 // callback for freelist
 func (db *KV) pageAppend(node BNode) uint64 {
-	assert(len(node.data) <= BTREE_PAGE_SIZE, "")
+	assert(len(node.data) == db.tree.layout.size, "function:pageAppend, node data size is not PAGE_SIZE")
 	ptr := db.page.flushed + uint64(db.page.nappend)
 	db.page.nappend++
 	db.page.updates[ptr] = node.data
 	return ptr
 }
 
-func (db *KV) pageUse(ptr uint64, node BNode) {
+// 复用的page不需要原来的内容，同一个事务中分配又释放的page从来没有写入文件，没有checksum
+func (db *KV) pagePut(ptr uint64, node BNode) {
+	assert(len(node.data) == db.tree.layout.size, "function:pagePut, node data size is not PAGE_SIZE")
 	db.page.updates[ptr] = node.data
 }
+
+// 返回一个可以原地修改的page，修改会在提交时写入文件
+func (db *KV) pageWrite(ptr uint64) BNode {
+	if page, ok := db.page.updates[ptr]; ok {
+		assert(page != nil, "pageWrite, page is nil")
+		return BNode{page}
+	}
+
+	page := make([]byte, db.tree.layout.size)
+	copy(page, pageGetMapped(db.mmap.chunks, db.tree.layout, ptr).data)
+	db.page.updates[ptr] = page
+	return BNode{page}
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+/*
+*
+每个page的最后PAGE_CHECKSUM_SIZE字节是前面所有数据的CRC32C，page写入文件时计算，从mmap读出时校验。
+torn write或者位翻转会被发现，返回带有page编号的ErrCorrupt，而不是读出错误的数据。
+master page有自己的checksum(见kv_master_page.go)。
+
+旧的文件没有checksum，master page的flags中没有MASTER_FLAG_CHECKSUM，node可以使用整个page
+*/
+
+const PAGE_CHECKSUM_SIZE = 4
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+func pageSetChecksum(page []byte) {
+	n := len(page) - PAGE_CHECKSUM_SIZE
+	binary.LittleEndian.PutUint32(page[n:], crc32.Checksum(page[:n], crc32c))
+}
+
+func pageVerify(page []byte) bool {
+	n := len(page) - PAGE_CHECKSUM_SIZE
+	return crc32.Checksum(page[:n], crc32c) == binary.LittleEndian.Uint32(page[n:])
+}
+
+// KV.Verify, Open时检查master page能访问到的page: B+tree的节点，overflow page和free list的node
+// 空闲的page不检查，崩溃时没有提交的写入只会在空闲的page中
+func verifyPages(db *KV) (err error) {
+	if !db.tree.layout.checksum {
+		return nil // the old format
+	}
+	defer recoverCorrupt(&err)
+	if db.tree.root != 0 {
+		verifyNode(&db.tree, db.tree.get(db.tree.root))
+	}
+	flNodes(&db.free, func(ptr uint64, node BNode) {
+		if node.btype() != BNODE_FREE_LIST {
+			panic(errCorrupt("bad free list node type: %d, page: %d", node.btype(), ptr))
+		}
+	})
+	return nil
+}
+
+// 读出所有的key和overflow中的值
+func verifyNode(tree *BTree, node BNode) {
+	switch node.btype() {
+	case BNODE_NODE:
+		for i := uint16(0); i < node.nkeys(); i++ {
+			verifyNode(tree, tree.get(node.getPtr(i)))
+		}
+	case BNODE_LEAF:
+		for i := uint16(0); i < node.nkeys(); i++ {
+			nodeGetKey(tree, node, i)
+			leafGetVal(tree, node, i)
+		}
+	default:
+		panic(errCorrupt("bad node type: %d", node.btype()))
+	}
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"bytes"
+	"sort"
+	"time"
+)
+
+/*
+*
+group commit: 并发提交的事务合并成一批，一起写入page，只flush一次
+
+提交的事务先进入队列，再等待kv.writer。拿到kv.writer的事务是这一批的leader，
+它把队列中所有的事务一起提交，包括上一批fsync期间到达的事务，
+之后拿到kv.writer的事务如果已经被提交了，直接返回自己的结果。
+
+每个事务有自己的结果: 冲突的事务返回ErrConflict，其他的事务一起成功或者一起失败。
+同一批的事务是同一个版本，它们都没有看到彼此的修改，所以后面的事务还要和前面的事务检查冲突。
+
+KV.CommitDelay > 0时leader最多等待这么久，让更多的事务进入这一批
+*/
+
+// leader不再等待的队列长度
+const COMMIT_BATCH_MAX = 1024
+
+type commitReq struct {
+	tx   *KVTX
+	done bool // set by the leader, protected by kv.writer
+	err  error
+}
+
+func (kv *KV) groupCommit(tx *KVTX) error {
+	req := &commitReq{tx: tx}
+	kv.queue.mu.Lock()
+	kv.queue.reqs = append(kv.queue.reqs, req)
+	if kv.queue.notify != nil {
+		select {
+		case kv.queue.notify <- struct{}{}:
+		default:
+		}
+	}
+	kv.queue.mu.Unlock()
+
+	kv.writer.Lock()
+	defer kv.writer.Unlock()
+	if req.done {
+		return req.err // committed by another leader
+	}
+
+	if kv.CommitDelay > 0 {
+		commitWait(kv)
+	}
+	kv.queue.mu.Lock()
+	batch := kv.queue.reqs
+	kv.queue.reqs = nil
+	kv.queue.mu.Unlock()
+
+	commitBatch(kv, batch)
+	return req.err
+}
+
+// 等待更多的事务进入队列，最多等待CommitDelay
+func commitWait(kv *KV) {
+	timer := time.NewTimer(kv.CommitDelay)
+	defer timer.Stop()
+	for {
+		kv.queue.mu.Lock()
+		if kv.queue.notify == nil {
+			kv.queue.notify = make(chan struct{}, 1)
+		}
+		n, notify := len(kv.queue.reqs), kv.queue.notify
+		kv.queue.mu.Unlock()
+		if n >= COMMIT_BATCH_MAX {
+			return
+		}
+		select {
+		case <-notify:
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+// 把一批事务的修改写入最新的tree，然后一起flush
+func commitBatch(kv *KV, batch []*commitReq) {
+	for _, req := range batch {
+		req.done = true
+		req.err = kv.flusher.err // the failed fsync
+	}
+	if kv.flusher.err != nil {
+		return
+	}
+
+	kv.mu.Lock()
+	// 本批释放的page属于下一个版本，只有版本不新于最老的读事务的page才能复用
+	kv.free.version = kv.version + 1
+	kv.free.minReader = kv.version
+	if len(kv.readers) > 0 {
+		kv.free.minReader = kv.readers[0].version
+	}
+	kv.mu.Unlock()
+	// WAL模式下checkpoint的tree也不能被覆盖
+	if kv.wal.fp != nil && versionBefore(kv.wal.checkpoint, kv.free.minReader) {
+		kv.free.minReader = kv.wal.checkpoint
+	}
+	// 没有fsync的提交，磁盘上的master page可能还是旧的版本，它的tree也不能被覆盖
+	if kv.wal.fp == nil && versionBefore(kv.synced, kv.free.minReader) {
+		kv.free.minReader = kv.synced
+	}
+
+	free := kv.free // for the rollback
+	version := kv.version
+	committed := []*commitReq{}
+	fail := func(err error) {
+		// 新版本还没有发布时，回到这一批开始时的状态
+		if kv.version == version {
+			kv.free = free
+			kv.page.nappend = 0
+			kv.page.updates = make(map[uint64][]byte)
+		}
+		// 还没有处理的事务也一起失败，它们的修改都没有写入
+		for _, req := range batch {
+			if req.err != ErrConflict {
+				req.err = err
+			}
+		}
+	}
+
+	// apply the pending updates to the latest tree
+	tree := kv.tree
+	batchWrites := [][][]byte{} // sorted writes of each transaction
+	ops := []walOp{}
+	for _, req := range batch {
+		tx := req.tx
+		if detectConflicts(kv, tx, batchWrites) {
+			req.err = ErrConflict
+			continue
+		}
+		committed = append(committed, req)
+
+		writes := [][]byte{}
+		for iter := tx.pending.Seek(nil, CMP_GT); iter.Valid(); iter.Next() {
+			key, val := iter.Deref()
+			var err error
+			if val[0] == FLAG_DELETED {
+				_, err = tree.Delete(key)
+			} else {
+				err = tree.Insert(key, val[1:])
+			}
+			if err != nil {
+				fail(err)
+				return
+			}
+			writes = append(writes, append([]byte{}, key...))
+			if kv.wal.fp != nil {
+				ops = append(ops, walOp{flag: val[0], key: key, val: val[1:]})
+			}
+		}
+		batchWrites = append(batchWrites, writes)
+	}
+	if len(committed) == 0 {
+		return // all conflicted
+	}
+
+	var err error
+	if kv.wal.fp != nil {
+		err = walCommit(kv, tree.root, ops)
+	} else {
+		err = flushPages(kv, tree.root)
+	}
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	// 保留可能和正在进行的事务冲突的记录
+	writes := [][]byte{}
+	for _, w := range batchWrites {
+		writes = append(writes, w...)
+	}
+	sort.Slice(writes, func(i, j int) bool {
+		return bytes.Compare(writes[i], writes[j]) < 0
+	})
+	kv.history = append(kv.history, CommittedTX{version: kv.version, writes: writes})
+	kv.mu.Lock()
+	minVersion := kv.version
+	if len(kv.readers) > 0 {
+		minVersion = kv.readers[0].version
+	}
+	kv.mu.Unlock()
+	for len(kv.history) > 0 && !versionBefore(minVersion, kv.history[0].version) {
+		kv.history = kv.history[1:]
+	}
+}
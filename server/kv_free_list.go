@@ -2,181 +2,231 @@ package server
 
 import (
 	"encoding/binary"
-	"fmt"
 )
 
 /**
+free list是一个队列，从head取出可以复用的page，新释放的page加到tail
+每个元素记录了page被释放时的版本，只有当所有读事务都看不到这个page时才能复用
 
 |   node1   |     |   node2   |     |   node3   |
 +-----------+     +-----------+     +-----------+
-| total=xxx |     |           |     |           |
-| next=yyy  | ==> | next=qqq  | ==> | next=eee  | ==> ...
-| size=zzz  |     | size=ppp  |     | size=rrr  |
+| next=yyy  | ==> | next=qqq  | ==> | next=rrr  |
 | pointers  |     | pointers  |     | pointers  |
+    head                              tail
 
-The node format:
-| type | size | total | next | pointers  |
-|  2B  |  2B  |  8B   |  8B  | size * 8B |
+headSeq和tailSeq是单调递增的序号，[headSeq, tailSeq)是队列中的元素，
+序号为seq的元素在node中的位置是seq % flCap，flCap由page size决定
+free list中至少有一个node，master page能访问到的page都不会被原地修改:
+
+  - tail node在每次提交中第一次修改时复制到一个新的page(tailPage)，旧的copy被释放
+  - tail node的next是它预留的位置，前一个node的next也指向这里，tail node满了之后才写入这个位置，
+    然后新的tail node预留下一个位置
+  - head和tail在同一个node中时从tailPage读，headPage总是node预留的位置
+
+旧的文件中tail node的next是0，它的位置就是tailPage
 
+The node format:
+| type | unused | next | pointer-version pairs |
+|  2B  |   2B   |  8B  |      size * 16B       |
 */
 
 const (
 	BNODE_FREE_LIST  = 3
-	FREE_LIST_HEADER = 4 + 8 + 8
-	FREE_LIST_CAP    = (BTREE_PAGE_SIZE - FREE_LIST_HEADER) / 8
+	FREE_LIST_HEADER = 4 + 8
 )
 
 // 内存结构中的数据链表，具体的page信息需要到通过get获取到
 type FreeList struct {
-	head uint64
-
-	get func(uint64) BNode
-	new func(BNode) uint64
-	use func(uint64, BNode)
+	// persisted in the master page
+	headPage uint64
+	headSeq  uint64
+	tailPage uint64
+	tailSeq  uint64
+
+	layout pageLayout // set when the file is opened
+
+	// set at the beginning of each write transaction
+	version   uint64 // the version of pages freed by the current transaction
+	minReader uint64 // the minimum version of active readers
+	copied    uint64 // the version in which the tail node was copied
+
+	get func(uint64) BNode  // read a page
+	new func(BNode) uint64  // append a new page
+	set func(uint64) BNode  // update an existing page in place
+	put func(uint64, BNode) // reuse a page, the old content is not read
 }
 
-func (fl *FreeList) Total() int {
-	if fl.head == 0 {
-		return 0
+// 取出一个可以复用的page，没有时返回0
+func (fl *FreeList) PopHead() uint64 {
+	ptr, head := flPop(fl)
+	if head != 0 {
+		// the empty head node is recycled
+		fl.PushTail(head)
 	}
-	headPage := fl.get(fl.head)
-	return int(binary.LittleEndian.Uint64(headPage.data[32:]))
+	return ptr
 }
 
-/*
-	topn对应的 pointer位置
-
-| next | ==> | next | ==> | next |
-|   2  |     |   5  |     |   8  |
-|   1  |     |   4  |     |   7  |
-|   0  |     |   3  |     |   6  |
-*/
-func (fl *FreeList) Get(topn int) uint64 {
-	assert(0 <= topn && topn < fl.Total(), fmt.Sprintf("function:freelist.get, topn out of range, topn: %d, total: %d", topn, fl.Total()))
-
-	node := fl.get(fl.head)
-	for flnSize(node) <= topn {
-		topn -= flnSize(node)
-		next := flnNext(node)
-		assert(next != 0, "function:freelist.get, next is nil")
-		node = fl.get(next)
+// 加入一个被释放的page
+func (fl *FreeList) PushTail(ptr uint64) {
+	flTailCopy(fl)
+	flnSetItem(fl.set(fl.tailPage), fl.seq2idx(fl.tailSeq), ptr, fl.version)
+	if fl.seq2idx(fl.tailSeq+1) != 0 {
+		fl.tailSeq++
+		return
 	}
 
-	return flnPtr(node, flnSize(node)-topn-1)
-
+	// the tail node is full
+	freed := flTailSeal(fl)
+	fl.tailSeq++
+	for _, ptr := range freed {
+		fl.PushTail(ptr)
+	}
 }
 
-func (fl *FreeList) Update(popn int, freed []uint64) {
-	assert(popn <= fl.Total(), fmt.Sprintf("function:FreeList.update, popn is out of range, popn: %d, total: %d", popn, fl.Total()))
-	if popn == 0 && len(freed) == 0 {
+// copy-on-write, 每次提交中第一次修改tail node时复制到新的page
+func flTailCopy(fl *FreeList) {
+	if fl.copied == fl.version {
 		return
 	}
+	fl.copied = fl.version
 
-	total := fl.Total()
-	reuse := []uint64{}
-	for fl.head != 0 && len(reuse)*FREE_LIST_CAP < len(freed) {
-		node := fl.get(fl.head)
-		freed = append(freed, fl.head)
-		if popn >= flnSize(node) {
-			popn -= flnSize(node)
-		} else {
-			remain := flnSize(node) - popn
-			popn = 0
-
-			for remain > 0 && len(reuse)*FREE_LIST_CAP < len(freed)+remain {
-				remain--
-				reuse = append(reuse, flnPtr(node, remain))
-			}
-
-			for i := 0; i < remain; i++ {
-				freed = append(freed, flnPtr(node, i))
-			}
-		}
+	old := fl.tailPage
+	node := BNode{append([]byte(nil), fl.get(old).data...)}
+	if flnNext(node) == 0 {
+		flnSetNext(node, old) // the old format
+	}
+	var head uint64
+	fl.tailPage, head = flAlloc(fl, node)
+	if old != flnNext(node) {
+		fl.PushTail(old)
+	}
+	if head != 0 {
+		fl.PushTail(head)
+	}
+}
+
+// 满了的tail node写入它预留的位置，新的tail node预留下一个位置，返回需要加入tail的page
+// 调用时tailSeq还没有增加，从head取出的不会是最后一个元素，head不会移动到还没有写入的node
+func flTailSeal(fl *FreeList) []uint64 {
+	old := fl.tailPage
+	node := BNode{append([]byte(nil), fl.get(old).data...)}
+	final := flnNext(node)
 
-		total -= flnSize(node)
-		fl.head = flnNext(node)
+	next, head1 := flAlloc(fl, flnNew(fl.layout.size))
+	flnSetNext(node, next)
+	fl.put(final, node)
+
+	tail := flnNew(fl.layout.size)
+	flnSetNext(tail, next)
+	var head2 uint64
+	fl.tailPage, head2 = flAlloc(fl, tail)
+
+	freed := []uint64{}
+	for _, ptr := range []uint64{old, head1, head2} {
+		if ptr != 0 && ptr != final {
+			freed = append(freed, ptr)
+		}
 	}
-	assert(len(reuse)*FREE_LIST_CAP >= len(freed) || fl.head == 0, fmt.Sprintf("freelist.update error, len(reuse): %d, fl.head: %v", len(reuse), fl.head))
+	return freed
+}
 
-	flPush(fl, freed, reuse)
-	flnSetTotal(fl.get(fl.head), uint64(total+len(freed)))
+// a page for the free list itself, 从head取出的node需要调用者加入tail
+func flAlloc(fl *FreeList, node BNode) (ptr uint64, head uint64) {
+	ptr, head = flPop(fl)
+	if ptr == 0 {
+		ptr = fl.new(node)
+	} else {
+		fl.put(ptr, node)
+	}
+	return ptr, head
 }
 
-func flPush(fl *FreeList, freed []uint64, reuse []uint64) {
-	for len(freed) > 0 {
-		new := BNode{make([]byte, BTREE_PAGE_SIZE)}
+func flPop(fl *FreeList) (ptr uint64, head uint64) {
+	if fl.headSeq == fl.tailSeq {
+		return 0, 0 // empty
+	}
 
-		size := len(freed)
-		if size > FREE_LIST_CAP {
-			size = FREE_LIST_CAP
-		}
+	node := fl.get(flHeadPage(fl))
+	ptr, version := flnItem(node, fl.seq2idx(fl.headSeq))
+	if versionBefore(fl.minReader, version) {
+		return 0, 0 // still visible to a reader
+	}
 
-		flnSetHeader(new, uint16(size), fl.head)
-		for i, ptr := range freed[:size] {
-			flnSetPtr(new, i, ptr)
+	fl.headSeq++
+	if fl.seq2idx(fl.headSeq) == 0 {
+		// the head node is empty, move to the next one
+		head, fl.headPage = fl.headPage, flnNext(node)
+		if fl.headPage == 0 {
+			panic(errCorrupt("freelist pop, next of head is nil, head: %d", head))
 		}
-		freed = freed[size:]
+	}
+	return ptr, head
+}
 
-		if len(reuse) > 0 {
-			fl.head, reuse = reuse[0], reuse[1:]
-			fl.use(fl.head, new)
-		} else {
-			fl.head = fl.new(new)
-		}
+// head node是tail node时从tailPage读
+func flHeadPage(fl *FreeList) uint64 {
+	flCap := uint64(fl.layout.flCap)
+	if fl.headSeq/flCap == fl.tailSeq/flCap {
+		return fl.tailPage
+	}
+	return fl.headPage
+}
 
+// 从head到tail的node，KV.Verify使用
+func flNodes(fl *FreeList, fn func(ptr uint64, node BNode)) {
+	flCap := uint64(fl.layout.flCap)
+	ptr := fl.headPage
+	for n := fl.headSeq / flCap; n < fl.tailSeq/flCap; n++ {
+		node := fl.get(ptr)
+		fn(ptr, node)
+		ptr = flnNext(node)
 	}
-	assert(len(reuse) == 0, fmt.Sprintf("flPush err, len(reuse) is not 0, len(reuse):%d", len(reuse)))
+	fn(fl.tailPage, fl.get(fl.tailPage))
+}
+
+func (fl *FreeList) seq2idx(seq uint64) int {
+	return int(seq % uint64(fl.layout.flCap))
+}
+
+// a < b, 版本号回绕时也成立
+func versionBefore(a, b uint64) bool {
+	return int64(a-b) < 0
 }
 
 /*
 *
 The node format:
-| type | size | total | next | pointers  |
-|  2B  |  2B  |  8B   |  8B  | size * 8B |
+| type | unused | next | pointer-version pairs |
+|  2B  |   2B   |  8B  |      size * 16B       |
 */
-func flnSize(node BNode) int {
-	if node.data == nil {
-		return 0
-	}
-	return int(binary.LittleEndian.Uint16(node.data[16:]))
+func flnNew(pageSize int) BNode {
+	node := BNode{make([]byte, pageSize)}
+	flnInit(node)
+	return node
 }
 
-func flnSetSize(node BNode, size uint16) {
-	binary.LittleEndian.PutUint16(node.data[16:], size)
+func flnInit(node BNode) {
+	binary.LittleEndian.PutUint16(node.data[0:], BNODE_FREE_LIST)
+	flnSetNext(node, 0)
 }
 
 func flnNext(node BNode) uint64 {
-	if node.data == nil {
-		return 0
-	}
-	return binary.LittleEndian.Uint64(node.data[96:])
+	return binary.LittleEndian.Uint64(node.data[4:])
 }
 
 func flnSetNext(node BNode, next uint64) {
-	binary.LittleEndian.PutUint64(node.data[96:], next)
+	binary.LittleEndian.PutUint64(node.data[4:], next)
 }
 
-func flnPtr(node BNode, idx int) uint64 {
-	if node.data == nil {
-		return 0
-	}
-	headOffSet := FREE_LIST_HEADER * 8
-	ptrOffSet := headOffSet + 8*idx
-	return binary.LittleEndian.Uint64(node.data[ptrOffSet:])
-}
-
-func flnSetPtr(node BNode, idx int, ptr uint64) {
-	headOffSet := FREE_LIST_HEADER * 8
-	ptrOffSet := headOffSet + 8*idx
-
-	binary.LittleEndian.PutUint64(node.data[ptrOffSet:], ptr)
-}
-
-func flnSetHeader(node BNode, size uint16, next uint64) {
-	flnSetSize(node, size)
-	flnSetNext(node, next)
+func flnItem(node BNode, idx int) (ptr uint64, version uint64) {
+	pos := FREE_LIST_HEADER + 16*idx
+	ptr = binary.LittleEndian.Uint64(node.data[pos:])
+	version = binary.LittleEndian.Uint64(node.data[pos+8:])
+	return ptr, version
 }
 
-func flnSetTotal(node BNode, total uint64) {
-	binary.LittleEndian.PutUint64(node.data[32:], total)
+func flnSetItem(node BNode, idx int, ptr uint64, version uint64) {
+	pos := FREE_LIST_HEADER + 16*idx
+	binary.LittleEndian.PutUint64(node.data[pos:], ptr)
+	binary.LittleEndian.PutUint64(node.data[pos+8:], version)
 }
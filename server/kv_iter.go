@@ -0,0 +1,96 @@
+package server
+
+import "bytes"
+
+// the iterator returned by the Seek of KVReader and KVTX
+type KVIter interface {
+	Valid() bool
+	Deref() ([]byte, []byte)
+	Key() []byte // the key of Deref() without reading the value
+	Next()
+	Prev()
+}
+
+// 合并事务中未提交的修改和快照，只能按照Seek时的方向移动
+// top中的key覆盖bot中相同的key，top中被标记删除的key会被跳过
+type CombinedIter struct {
+	top *BIter // pending updates, values are prefixed by a flag
+	bot *BIter // the snapshot
+	dir int    // > 0: forward; < 0: backward
+}
+
+func newCombinedIter(top, bot *BIter, dir int) *CombinedIter {
+	iter := &CombinedIter{top: top, bot: bot, dir: dir}
+	iter.skipDeleted()
+	return iter
+}
+
+func (iter *CombinedIter) Valid() bool {
+	return iter.top.Valid() || iter.bot.Valid()
+}
+
+func (iter *CombinedIter) Deref() ([]byte, []byte) {
+	if iter.which() <= 0 {
+		key, val := iter.top.Deref()
+		return key, val[1:]
+	}
+	return iter.bot.Deref()
+}
+
+func (iter *CombinedIter) Key() []byte {
+	if iter.which() <= 0 {
+		return iter.top.Key()
+	}
+	return iter.bot.Key()
+}
+
+func (iter *CombinedIter) Next() {
+	assert(iter.dir > 0, "CombinedIter, Next on a backward iterator")
+	iter.move()
+	iter.skipDeleted()
+}
+
+func (iter *CombinedIter) Prev() {
+	assert(iter.dir < 0, "CombinedIter, Prev on a forward iterator")
+	iter.move()
+	iter.skipDeleted()
+}
+
+// 当前位置来自哪个iterator: < 0: top; > 0: bot; 0: 两个的key相同，以top为准
+func (iter *CombinedIter) which() int {
+	switch {
+	case !iter.top.Valid():
+		return +1
+	case !iter.bot.Valid():
+		return -1
+	}
+	return bytes.Compare(iter.top.Key(), iter.bot.Key()) * iter.dir
+}
+
+func (iter *CombinedIter) move() {
+	r := iter.which()
+	if r <= 0 {
+		iterMove(iter.top, iter.dir)
+	}
+	if r >= 0 {
+		iterMove(iter.bot, iter.dir)
+	}
+}
+
+func (iter *CombinedIter) skipDeleted() {
+	for iter.Valid() && iter.which() <= 0 {
+		_, val := iter.top.Deref()
+		if val[0] != FLAG_DELETED {
+			return
+		}
+		iter.move()
+	}
+}
+
+func iterMove(iter *BIter, dir int) {
+	if dir > 0 {
+		iter.Next()
+	} else {
+		iter.Prev()
+	}
+}
@@ -3,54 +3,191 @@ package server
 import (
 	"bytes"
 	"encoding/binary"
-	"errors"
 	"fmt"
+	"hash/crc32"
+	"os"
 )
 
-const DB_SIG = "BuildYourOwnDB05"
+const DB_SIG = "BuildYourOwnDB06"
+
+// 签名的最后两位是文件格式的版本，05及之前的版本的free list格式不同，不能打开
+const DB_SIG_PREFIX = "BuildYourOwnDB"
 
 // the master page format.
 // it contains the pointer to the root and other important bits.
-// | sig | btree_root | page_used | free_list |
-// | 16B | 8B         | 8B        | 8B        |
+// | sig | btree_root | page_used | free_head | free_head_seq | free_tail | free_tail_seq | version | page_size | flags | checksum |
+// | 16B | 8B         | 8B        | 8B        | 8B            | 8B        | 8B            | 8B      | 8B        | 8B    | 4B       |
+// 旧的文件没有page_size和flags，读到的是0，表示BTREE_PAGE_SIZE并且没有checksum
+// checksum是前面所有字段的CRC32C，flags不为0时检查
+//
+// page 0中有两个master slot，每次提交写入不是最新的那个，写入时崩溃最多损坏正在写的slot，
+// 另一个slot仍然是上一个版本。读取时使用version最新的有效slot，旧的文件只有第一个slot
+const (
+	MASTER_SIZE      = 92
+	MASTER_SLOT_SIZE = 512 // a slot in a sector
+	MASTER_SLOTS     = 2
+
+	MASTER_FLAG_CHECKSUM = 1 // all pages have checksums
+	MASTER_FLAG_SLOTS    = 2 // written in alternating slots
+)
+
 func masterLoad(db *KV) error {
 	if db.mmap.file == 0 {
+		// empty file, page 0 is the master page and page 1 is reserved for the first free list node,
+		// page 2 is its copy
 		db.page.flushed = 1
-		return nil
+		db.free.headPage = db.pageAppend(flnNew(db.tree.layout.size))
+		tail := flnNew(db.tree.layout.size)
+		flnSetNext(tail, db.free.headPage)
+		db.free.tailPage = db.pageAppend(tail)
+		return flushPages(db, 0)
 	}
 
-	data := db.mmap.chunks[0]
+	slot, err := masterSelect(db.mmap.chunks[0])
+	if err != nil {
+		return err
+	}
+	data := db.mmap.chunks[0][slot*MASTER_SLOT_SIZE:]
 	root := binary.LittleEndian.Uint64(data[16:])
 	used := binary.LittleEndian.Uint64(data[24:])
-	free := binary.LittleEndian.Uint64(data[32:])
-
-	if !bytes.Equal([]byte(DB_SIG), data[:16]) {
-		return errors.New("bad singature")
-	}
+	headPage := binary.LittleEndian.Uint64(data[32:])
+	headSeq := binary.LittleEndian.Uint64(data[40:])
+	tailPage := binary.LittleEndian.Uint64(data[48:])
+	tailSeq := binary.LittleEndian.Uint64(data[56:])
+	version := binary.LittleEndian.Uint64(data[64:])
+	pageSize := masterGetPageSize(data)
+	flags := binary.LittleEndian.Uint64(data[80:])
 
-	bad := !(1 <= used && used <= uint64(db.mmap.file/BTREE_PAGE_SIZE))
+	bad := pageSize != uint64(db.tree.layout.size)
+	bad = bad || (flags&MASTER_FLAG_CHECKSUM != 0) != db.tree.layout.checksum
+	bad = bad || !(2 <= used && used <= uint64(db.mmap.file/db.tree.layout.size))
 	bad = bad || !(root < used)
+	bad = bad || !(1 <= headPage && headPage < used && 1 <= tailPage && tailPage < used)
+	bad = bad || !(headSeq <= tailSeq)
 	if bad {
-		return errors.New("bad master page")
+		return fmt.Errorf("%w: bad master page", ErrCorrupt)
 	}
 
 	db.tree.root = root
 	db.page.flushed = used
-	db.free.head = free
+	db.free.headPage = headPage
+	db.free.headSeq = headSeq
+	db.free.tailPage = tailPage
+	db.free.tailSeq = tailSeq
+	db.version = version
+	db.synced = version
+	db.masterSlot = slot
 	return nil
 }
 
+// 写入另一个slot，调用者在之后fsync
 func masterStore(db *KV) error {
-	var data [40]byte
+	var data [MASTER_SIZE]byte
+
+	flags := uint64(MASTER_FLAG_SLOTS)
+	if db.tree.layout.checksum {
+		flags |= MASTER_FLAG_CHECKSUM
+	}
 
 	copy(data[:16], []byte(DB_SIG))
 	binary.LittleEndian.PutUint64(data[16:], db.tree.root)
 	binary.LittleEndian.PutUint64(data[24:], db.page.flushed)
-	binary.LittleEndian.PutUint64(data[32:], db.free.head)
+	binary.LittleEndian.PutUint64(data[32:], db.free.headPage)
+	binary.LittleEndian.PutUint64(data[40:], db.free.headSeq)
+	binary.LittleEndian.PutUint64(data[48:], db.free.tailPage)
+	binary.LittleEndian.PutUint64(data[56:], db.free.tailSeq)
+	binary.LittleEndian.PutUint64(data[64:], db.version)
+	binary.LittleEndian.PutUint64(data[72:], uint64(db.tree.layout.size))
+	binary.LittleEndian.PutUint64(data[80:], flags)
+	binary.LittleEndian.PutUint32(data[88:], crc32.Checksum(data[:88], crc32c))
 
-	_, err := db.fp.WriteAt(data[:], 0)
+	slot := (db.masterSlot + 1) % MASTER_SLOTS
+	_, err := db.fp.WriteAt(data[:], int64(slot*MASTER_SLOT_SIZE))
 	if err != nil {
 		return fmt.Errorf("write master page: %w", err)
 	}
+	db.masterSlot = slot
 	return nil
 }
+
+// the signature and the checksum of a slot
+func masterCheck(data []byte) error {
+	if !bytes.Equal([]byte(DB_SIG), data[:16]) {
+		if bytes.HasPrefix(data[:16], []byte(DB_SIG_PREFIX)) {
+			return fmt.Errorf("%w: %q, expect %q", ErrFileVersion, data[:16], DB_SIG)
+		}
+		return fmt.Errorf("%w: bad signature", ErrCorrupt)
+	}
+	flags := binary.LittleEndian.Uint64(data[80:])
+	if flags != 0 && crc32.Checksum(data[:88], crc32c) != binary.LittleEndian.Uint32(data[88:]) {
+		return fmt.Errorf("%w: bad checksum, page: 0", ErrCorrupt)
+	}
+	return nil
+}
+
+// the valid slot with the latest version
+func masterSelect(page []byte) (int, error) {
+	slot, latest, err := -1, uint64(0), error(nil)
+	for i := 0; i < MASTER_SLOTS; i++ {
+		data := page[i*MASTER_SLOT_SIZE:]
+		if e := masterCheck(data); e != nil {
+			if err == nil {
+				err = e
+			}
+			continue
+		}
+		version := binary.LittleEndian.Uint64(data[64:])
+		if slot < 0 || versionBefore(latest, version) {
+			slot, latest = i, version
+		}
+	}
+	if slot < 0 {
+		return 0, err
+	}
+	return slot, nil
+}
+
+func masterGetPageSize(data []byte) uint64 {
+	size := binary.LittleEndian.Uint64(data[72:])
+	if size == 0 {
+		size = BTREE_PAGE_SIZE
+	}
+	return size
+}
+
+// mmap之前需要知道page size和是否有checksum，直接从文件读master page
+// 新文件使用pageSize并且有checksum，pageSize为0表示BTREE_PAGE_SIZE
+func masterLayout(fp *os.File, pageSize int) (pageLayout, error) {
+	fi, err := fp.Stat()
+	if err != nil {
+		return pageLayout{}, fmt.Errorf("stat: %w", err)
+	}
+	if fi.Size() == 0 {
+		if pageSize == 0 {
+			pageSize = BTREE_PAGE_SIZE
+		}
+		if err := checkPageSize(pageSize); err != nil {
+			return pageLayout{}, err
+		}
+		return newPageLayout(pageSize, true), nil
+	}
+
+	var page [MASTER_SLOTS * MASTER_SLOT_SIZE]byte
+	if _, err := fp.ReadAt(page[:], 0); err != nil {
+		return pageLayout{}, fmt.Errorf("%w: read master page: %v", ErrCorrupt, err)
+	}
+	slot, err := masterSelect(page[:])
+	if err != nil {
+		return pageLayout{}, err
+	}
+	data := page[slot*MASTER_SLOT_SIZE:]
+	size := masterGetPageSize(data)
+	if size > BTREE_MAX_PAGE_SIZE || checkPageSize(int(size)) != nil {
+		return pageLayout{}, fmt.Errorf("%w: bad page size: %d", ErrCorrupt, size)
+	}
+	if pageSize != 0 && pageSize != int(size) {
+		return pageLayout{}, fmt.Errorf("page size mismatch, the file uses %d, not %d", size, pageSize)
+	}
+	flags := binary.LittleEndian.Uint64(data[80:])
+	return newPageLayout(int(size), flags&MASTER_FLAG_CHECKSUM != 0), nil
+}
@@ -1,7 +1,6 @@
 package server
 
 import (
-	"errors"
 	"fmt"
 	"os"
 	"syscall"
@@ -9,18 +8,18 @@ import (
 
 // 文件映射到mmap 后续直接操作mmap中数据
 // BNODE中的addr实际上是mmap中的位移
-func mmapInit(fp *os.File) (int, []byte, error) {
+func mmapInit(fp *os.File, pageSize int) (int, []byte, error) {
 	fi, err := fp.Stat()
 	if err != nil {
 		return 0, nil, fmt.Errorf("stat: %w", err)
 	}
 
-	if fi.Size()%BTREE_PAGE_SIZE != 0 {
-		return 0, nil, errors.New("file size is not a multiple of page size")
+	if fi.Size()%int64(pageSize) != 0 {
+		return 0, nil, fmt.Errorf("%w: file size is not a multiple of page size", ErrCorrupt)
 	}
 
 	mmapSize := 64 << 20
-	assert(mmapSize%BTREE_PAGE_SIZE == 0, "function:mmapInit, mmapSize ist not multiple of page size")
+	assert(mmapSize%pageSize == 0, "function:mmapInit, mmapSize ist not multiple of page size")
 	for mmapSize < int(fi.Size()) {
 		mmapSize *= 2
 	}
@@ -32,22 +31,29 @@ func mmapInit(fp *os.File) (int, []byte, error) {
 	return int(fi.Size()), chunk, nil
 }
 
-func flushPages(db *KV) error {
+// root是要提交的新root
+func flushPages(db *KV, root uint64) error {
 	if err := writePages(db); err != nil {
 		return err
 	}
-	return syncPages(db)
+	return syncPages(db, root)
 }
 
 // 将temp中的page写入到file中
-func writePages(db *KV) error {
+func writePages(db *KV) (err error) {
+	// the free list reads pages in place
+	defer recoverCorrupt(&err)
+
+	// update the free list
 	freed := []uint64{}
 	for ptr, page := range db.page.updates {
 		if page == nil {
 			freed = append(freed, ptr)
 		}
 	}
-	db.free.Update(db.page.nfree, freed)
+	for _, ptr := range freed {
+		db.free.PushTail(ptr)
+	}
 
 	npages := int(db.page.flushed) + db.page.nappend
 	if err := extendFile(db, npages); err != nil {
@@ -60,30 +66,51 @@ func writePages(db *KV) error {
 
 	for ptr, page := range db.page.updates {
 		if page != nil {
-			copy(pageGetMapped(db, ptr).data, page)
+			if db.tree.layout.checksum {
+				pageSetChecksum(page)
+			}
+			copy(pageMapped(db.mmap.chunks, db.tree.layout.size, ptr).data, page)
 		}
 	}
 	return nil
 }
 
-func syncPages(db *KV) error {
+func syncPages(db *KV, root uint64) error {
+	// master page不能先于它指向的page落盘，所以这个fsync在所有的SyncMode下都需要
 	if err := db.fp.Sync(); err != nil {
 		return fmt.Errorf("fsync: %w", err)
 	}
-	db.page.flushed += uint64(db.page.nappend)
-	db.page.updates = make(map[uint64][]byte)
+	// 上一次提交的master page也一起落盘了
+	db.synced = db.version
+
+	// 数据页已经落盘，从这里开始新的版本对读事务可见
+	publishPages(db, root)
 
 	if err := masterStore(db); err != nil {
 		return err
 	}
-	if err := db.fp.Sync(); err != nil {
+	if err := commitSync(db, db.fp.Sync); err != nil {
 		return fmt.Errorf("fsync: %w", err)
 	}
+	if !db.SyncMode.nosync {
+		db.synced = db.version
+	}
 	return nil
 }
 
+func publishPages(db *KV, root uint64) {
+	db.mu.Lock()
+	db.tree.root = root
+	db.version++
+	db.mu.Unlock()
+
+	db.page.flushed += uint64(db.page.nappend)
+	db.page.nappend = 0
+	db.page.updates = make(map[uint64][]byte)
+}
+
 func extendFile(db *KV, npages int) error {
-	filePages := db.mmap.file / BTREE_PAGE_SIZE
+	filePages := db.mmap.file / db.tree.layout.size
 	if filePages > npages {
 		return nil
 	}
@@ -96,7 +123,7 @@ func extendFile(db *KV, npages int) error {
 		filePages += inc
 	}
 
-	fileSize := filePages * BTREE_PAGE_SIZE
+	fileSize := filePages * db.tree.layout.size
 	err := syscall.Fallocate(int(db.fp.Fd()), 0, 0, int64(fileSize))
 	if err != nil {
 		return fmt.Errorf("fallocate: %w", err)
@@ -106,7 +133,7 @@ func extendFile(db *KV, npages int) error {
 }
 
 func extendMmap(db *KV, npages int) error {
-	if db.mmap.total >= npages*BTREE_PAGE_SIZE {
+	if db.mmap.total >= npages*db.tree.layout.size {
 		return nil
 	}
 
@@ -116,6 +143,8 @@ func extendMmap(db *KV, npages int) error {
 	}
 
 	db.mmap.total += db.mmap.total
+	db.mu.Lock()
 	db.mmap.chunks = append(db.mmap.chunks, chunk)
+	db.mu.Unlock()
 	return nil
 }
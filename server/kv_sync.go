@@ -0,0 +1,95 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+*
+提交时是否fsync(KV.SyncMode):
+
+	SyncAlways:   默认，提交返回时已经落盘
+	SyncNever:    master page之后不fsync。进程崩溃不会丢失数据，机器崩溃时可能丢失最近的提交
+	SyncEvery(d): 和SyncNever一样，后台每隔d调用一次KV.Sync
+
+写入master page之前的fsync在所有模式下都保留，master page不会先于它指向的page落盘。
+磁盘上的master page可能比最新的版本旧，它的tree中的page在落盘之前不会被复用(KV.synced)。
+WAL模式下指的是log的fsync，checkpoint总是fsync。
+不是SyncAlways时，KV.Sync让之前的提交都落盘，Close时也会调用
+*/
+type SyncMode struct {
+	nosync   bool          // no fsync on commits
+	interval time.Duration // the background flusher, 0 for none
+}
+
+var (
+	SyncAlways = SyncMode{}
+	SyncNever  = SyncMode{nosync: true}
+)
+
+func SyncEvery(interval time.Duration) SyncMode {
+	return SyncMode{nosync: true, interval: interval}
+}
+
+// fsync on commits, 除非是SyncNever或SyncEvery
+func commitSync(db *KV, sync func() error) error {
+	if db.SyncMode.nosync {
+		return nil
+	}
+	return sync()
+}
+
+// 让之前的提交都落盘
+// 失败之后不知道哪些数据已经落盘，之后的提交都返回这个错误
+func (db *KV) Sync() error {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	if db.flusher.err != nil {
+		return db.flusher.err
+	}
+	var err error
+	if db.wal.fp != nil {
+		err = db.wal.fp.Sync()
+	} else {
+		err = db.fp.Sync()
+	}
+	if err != nil {
+		db.flusher.err = fmt.Errorf("fsync: %w", err)
+	} else if db.wal.fp == nil {
+		db.synced = db.version
+	}
+	return db.flusher.err
+}
+
+// SyncEvery的后台flusher
+func flusherStart(db *KV) {
+	if db.SyncMode.interval <= 0 {
+		return
+	}
+	db.flusher.stop = make(chan struct{})
+	db.flusher.done = make(chan struct{})
+	go func() {
+		defer close(db.flusher.done)
+		ticker := time.NewTicker(db.SyncMode.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				db.Sync() // the error is kept in db.flusher.err
+			case <-db.flusher.stop:
+				return
+			}
+		}
+	}()
+}
+
+func flusherStop(db *KV) {
+	if db.flusher.stop == nil {
+		return
+	}
+	close(db.flusher.stop)
+	<-db.flusher.done
+	db.flusher.stop = nil
+}
@@ -1,9 +1,18 @@
 package server
 
-import "testing"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
 
 func TestKv(t *testing.T) {
-	kv := InitKV("./kv_file.hex")
+	kv := InitKV(t.TempDir() + "/kv_file.db")
 	defer kv.Close()
 
 	if err := kv.Open(); err != nil {
@@ -23,7 +32,7 @@ func TestKv(t *testing.T) {
 		t.Fatalf("fail to set key, err: %s", err)
 	}
 
-	if v, ok := kv.Get([]byte("a_key")); !ok {
+	if v, ok, _ := kv.Get([]byte("a_key")); !ok {
 		t.Fatalf("fail to get key")
 	} else {
 		if string(v) != "a_value" {
@@ -31,3 +40,1002 @@ func TestKv(t *testing.T) {
 		}
 	}
 }
+
+func TestKvUpdate(t *testing.T) {
+	kv := InitKV(t.TempDir() + "/kv_update.db")
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to open kv, err: %s", err)
+	}
+	defer kv.Close()
+
+	added, err := kv.Update(&InsertReq{Key: []byte("a_key"), Val: []byte("a_value"), Mode: MODE_INSERT_ONLY})
+	if err != nil || !added {
+		t.Fatalf("fail to insert key, added: %v, err: %v", added, err)
+	}
+	added, err = kv.Update(&InsertReq{Key: []byte("a_key"), Val: []byte("b_value"), Mode: MODE_INSERT_ONLY})
+	if err != nil || added {
+		t.Fatalf("insert only should fail on existing key, added: %v, err: %v", added, err)
+	}
+
+	req := &InsertReq{Key: []byte("a_key"), Val: []byte("c_value"), Mode: MODE_UPDATE_ONLY}
+	if _, err := kv.Update(req); err != nil {
+		t.Fatalf("fail to update key, err: %s", err)
+	}
+	if string(req.Old) != "a_value" {
+		t.Fatalf("wrong old value, got: %s, expected: %s", req.Old, "a_value")
+	}
+	if v, _, _ := kv.Get([]byte("a_key")); string(v) != "c_value" {
+		t.Fatalf("wrong value, got: %s, expected: %s", v, "c_value")
+	}
+}
+
+func TestKvTX(t *testing.T) {
+	path := t.TempDir() + "/kv_tx.db"
+	kv := InitKV(path)
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to open kv, err: %s", err)
+	}
+
+	tx := KVTX{}
+	kv.Begin(&tx)
+	tx.Set([]byte("a_key"), []byte("a_value"))
+	tx.Set([]byte("b_key"), []byte("b_value"))
+	if v, ok, _ := tx.Get([]byte("a_key")); !ok || string(v) != "a_value" {
+		t.Fatalf("transaction should see its own writes")
+	}
+	kv.Abort(&tx)
+	if _, ok, _ := kv.Get([]byte("a_key")); ok {
+		t.Fatalf("aborted write should not be visible")
+	}
+
+	kv.Begin(&tx)
+	tx.Set([]byte("a_key"), []byte("a_value"))
+	tx.Set([]byte("b_key"), []byte("b_value"))
+	if err := kv.Commit(&tx); err != nil {
+		t.Fatalf("fail to commit, err: %s", err)
+	}
+	kv.Close()
+
+	kv = InitKV(path)
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to reopen kv, err: %s", err)
+	}
+	defer kv.Close()
+	for _, key := range []string{"a_key", "b_key"} {
+		if _, ok, _ := kv.Get([]byte(key)); !ok {
+			t.Fatalf("committed key is lost after reopen: %s", key)
+		}
+	}
+}
+
+func TestKvReader(t *testing.T) {
+	kv := InitKV(t.TempDir() + "/kv_reader.db")
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to open kv, err: %s", err)
+	}
+	defer kv.Close()
+
+	setAll := func(round int) {
+		tx := KVTX{}
+		kv.Begin(&tx)
+		for i := 0; i < 200; i++ {
+			tx.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("val%03d-%d", i, round)))
+		}
+		if err := kv.Commit(&tx); err != nil {
+			t.Fatalf("fail to commit, err: %s", err)
+		}
+	}
+	setAll(0)
+
+	// the reader keeps seeing the old snapshot while the writer keeps rewriting
+	reader := KVReader{}
+	kv.BeginRead(&reader)
+	for round := 1; round <= 20; round++ {
+		setAll(round)
+	}
+	for i := 0; i < 200; i++ {
+		val, ok, _ := reader.Get([]byte(fmt.Sprintf("key%03d", i)))
+		if !ok || string(val) != fmt.Sprintf("val%03d-0", i) {
+			t.Fatalf("reader snapshot is changed, key%03d: %s", i, val)
+		}
+	}
+	kv.EndRead(&reader)
+	if v, _, _ := kv.Get([]byte("key000")); string(v) != "val000-20" {
+		t.Fatalf("wrong value, got: %s", v)
+	}
+
+	// without readers the freed pages are reused
+	setAll(21)
+	used := kv.page.flushed
+	for round := 22; round <= 40; round++ {
+		setAll(round)
+	}
+	if kv.page.flushed != used {
+		t.Fatalf("freed pages are not reused, pages before: %d, after: %d", used, kv.page.flushed)
+	}
+}
+
+func TestKvConflict(t *testing.T) {
+	kv := InitKV(t.TempDir() + "/kv_conflict.db")
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to open kv, err: %s", err)
+	}
+	defer kv.Close()
+	kv.Set([]byte("a_key"), []byte("0"))
+	kv.Set([]byte("b_key"), []byte("0"))
+
+	// write skew: each transaction reads one key and writes the other
+	tx1, tx2 := KVTX{}, KVTX{}
+	kv.Begin(&tx1)
+	kv.Begin(&tx2)
+	tx1.Get([]byte("a_key"))
+	tx1.Set([]byte("b_key"), []byte("1"))
+	tx2.Get([]byte("b_key"))
+	tx2.Set([]byte("a_key"), []byte("2"))
+	if err := kv.Commit(&tx1); err != nil {
+		t.Fatalf("fail to commit, err: %s", err)
+	}
+	if err := kv.Commit(&tx2); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expect a conflict, err: %v", err)
+	}
+	if v, _, _ := kv.Get([]byte("a_key")); string(v) != "0" {
+		t.Fatalf("conflicting write should not be visible, got: %s", v)
+	}
+
+	// a range read conflicts with an insert into the range
+	kv.Begin(&tx1)
+	kv.Begin(&tx2)
+	for iter := tx1.Seek([]byte("a"), CMP_GE, []byte("c"), CMP_LE); iter.Valid(); iter.Next() {
+	}
+	tx1.Set([]byte("x_key"), []byte("1"))
+	tx2.Set([]byte("a_key2"), []byte("2"))
+	if err := kv.Commit(&tx2); err != nil {
+		t.Fatalf("fail to commit, err: %s", err)
+	}
+	if err := kv.Commit(&tx1); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expect a conflict, err: %v", err)
+	}
+
+	// disjoint transactions both succeed
+	kv.Begin(&tx1)
+	kv.Begin(&tx2)
+	tx1.Get([]byte("a_key"))
+	tx1.Set([]byte("a_key"), []byte("3"))
+	tx2.Get([]byte("b_key"))
+	tx2.Set([]byte("b_key"), []byte("3"))
+	if err := kv.Commit(&tx1); err != nil {
+		t.Fatalf("fail to commit, err: %s", err)
+	}
+	if err := kv.Commit(&tx2); err != nil {
+		t.Fatalf("fail to commit, err: %s", err)
+	}
+}
+
+func TestKvTXSeek(t *testing.T) {
+	kv := InitKV(t.TempDir() + "/kv_tx_seek.db")
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to open kv, err: %s", err)
+	}
+	defer kv.Close()
+	for _, key := range []string{"a", "c", "e"} {
+		kv.Set([]byte(key), []byte(key))
+	}
+
+	// the iterator merges the uncommitted updates with the snapshot
+	tx := KVTX{}
+	kv.Begin(&tx)
+	defer kv.Abort(&tx)
+	tx.Set([]byte("b"), []byte("b"))
+	tx.Set([]byte("c"), []byte("C"))
+	tx.Del([]byte("e"))
+
+	got := ""
+	for iter := tx.Seek([]byte("a"), CMP_GE, []byte("z"), CMP_LE); iter.Valid(); iter.Next() {
+		_, val := iter.Deref()
+		got += string(val)
+	}
+	if got != "abC" {
+		t.Fatalf("wrong forward scan, got: %s", got)
+	}
+
+	got = ""
+	for iter := tx.Seek([]byte("z"), CMP_LE, []byte("a"), CMP_GE); iter.Valid(); iter.Prev() {
+		_, val := iter.Deref()
+		got += string(val)
+	}
+	if got != "Cba" {
+		t.Fatalf("wrong backward scan, got: %s", got)
+	}
+}
+
+func TestKvLargeValue(t *testing.T) {
+	path := t.TempDir() + "/kv_large.db"
+	kv := InitKV(path)
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to open kv, err: %s", err)
+	}
+
+	large := func(round int) []byte {
+		return []byte(fmt.Sprintf("%020000d", round))
+	}
+	for i := 0; i < 10; i++ {
+		if err := kv.Set([]byte(fmt.Sprintf("key%d", i)), large(0)); err != nil {
+			t.Fatalf("fail to set, err: %s", err)
+		}
+	}
+	kv.Close()
+
+	kv = InitKV(path)
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to reopen kv, err: %s", err)
+	}
+	defer kv.Close()
+	if v, ok, _ := kv.Get([]byte("key3")); !ok || string(v) != string(large(0)) {
+		t.Fatalf("wrong large value after reopen, len: %d", len(v))
+	}
+
+	// the overflow pages of old values are reused
+	kv.Set([]byte("key0"), large(1))
+	used := kv.page.flushed
+	for round := 2; round < 20; round++ {
+		kv.Set([]byte("key0"), large(round))
+	}
+	if kv.page.flushed != used {
+		t.Fatalf("overflow pages are not reused, pages before: %d, after: %d", used, kv.page.flushed)
+	}
+	if _, err := kv.Del([]byte("key0")); err != nil {
+		t.Fatalf("fail to delete, err: %s", err)
+	}
+	if _, ok, _ := kv.Get([]byte("key0")); ok {
+		t.Fatalf("deleted key is still visible")
+	}
+}
+
+func TestKvErrors(t *testing.T) {
+	kv := InitKV(t.TempDir() + "/kv_errors.db")
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to open kv, err: %s", err)
+	}
+	defer kv.Close()
+
+	if err := kv.Set(nil, []byte("v")); !errors.Is(err, ErrEmptyKey) {
+		t.Fatalf("expect ErrEmptyKey, got: %v", err)
+	}
+	if _, _, err := kv.Get(nil); !errors.Is(err, ErrEmptyKey) {
+		t.Fatalf("expect ErrEmptyKey, got: %v", err)
+	}
+	if err := kv.Set(make([]byte, BTREE_KEY_LIMIT+1), []byte("v")); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("expect ErrKeyTooLarge, got: %v", err)
+	}
+	if err := kv.Set([]byte("k"), make([]byte, BTREE_VAL_LIMIT+1)); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("expect ErrValueTooLarge, got: %v", err)
+	} else if want := fmt.Sprintf("%d > %d", BTREE_VAL_LIMIT+1, BTREE_VAL_LIMIT); !strings.Contains(err.Error(), want) {
+		t.Fatalf("wrong size in the error: %v", err)
+	}
+	if _, err := kv.Update(&InsertReq{Key: []byte("k"), Mode: 100}); !errors.Is(err, ErrBadMode) {
+		t.Fatalf("expect ErrBadMode, got: %v", err)
+	}
+
+	// nothing is written by the failed operations
+	if _, ok, err := kv.Get([]byte("k")); ok || err != nil {
+		t.Fatalf("unexpected key, ok: %v, err: %v", ok, err)
+	}
+
+	// the flag in the pending tree is not counted
+	val := bytes.Repeat([]byte("v"), BTREE_VAL_LIMIT)
+	if err := kv.Set([]byte("k"), val); err != nil {
+		t.Fatalf("fail to set the max value, err: %s", err)
+	}
+	if got, ok, err := kv.Get([]byte("k")); !ok || err != nil || !bytes.Equal(got, val) {
+		t.Fatalf("wrong max value, ok: %v, err: %v, size: %d", ok, err, len(got))
+	}
+}
+
+func TestKvCorrupt(t *testing.T) {
+	path := t.TempDir() + "/kv_corrupt.db"
+	kv := InitKV(path)
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to open kv, err: %s", err)
+	}
+	if err := kv.Set([]byte("a_key"), []byte("a_value")); err != nil {
+		t.Fatalf("fail to set, err: %s", err)
+	}
+
+	// break the type of the root node
+	root := kv.tree.root
+	kv.Close()
+	fp, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.WriteAt([]byte{0xff, 0xff}, int64(root*BTREE_PAGE_SIZE)); err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+
+	kv = InitKV(path)
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to reopen kv, err: %s", err)
+	}
+	defer kv.Close()
+	if _, _, err := kv.Get([]byte("a_key")); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expect ErrCorrupt, got: %v", err)
+	}
+	if err := kv.Set([]byte("b_key"), []byte("b_value")); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expect ErrCorrupt, got: %v", err)
+	}
+}
+
+func TestKvPageSize(t *testing.T) {
+	path := t.TempDir() + "/kv_page_size.db"
+	kv := InitKV(path)
+	kv.PageSize = 16384
+	kv.SyncMode = SyncNever
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to open kv, err: %s", err)
+	}
+	// 16K的page能放下更大的值和key，更大的值仍然使用overflow page
+	vals := map[string]string{}
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		vals[key] = strings.Repeat("v", i%7*3000)
+		if i%100 == 0 {
+			vals[strings.Repeat("k", 5000)+key] = "long key"
+		}
+	}
+	for key, val := range vals {
+		if err := kv.Set([]byte(key), []byte(val)); err != nil {
+			t.Fatalf("fail to set, err: %s", err)
+		}
+	}
+	kv.Close()
+
+	// the page size is read from the file
+	kv = InitKV(path)
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to reopen kv, err: %s", err)
+	}
+	if kv.tree.layout.size != 16384 || kv.mmap.file%16384 != 0 {
+		t.Fatalf("wrong page size: %d", kv.tree.layout.size)
+	}
+	for key, val := range vals {
+		if v, ok, err := kv.Get([]byte(key)); !ok || err != nil || string(v) != val {
+			t.Fatalf("wrong value after reopen, key: %.20q, ok: %v, err: %v", key, ok, err)
+		}
+	}
+	kv.Close()
+
+	kv = InitKV(path)
+	kv.PageSize = 8192
+	if err := kv.Open(); err == nil {
+		kv.Close()
+		t.Fatalf("expect an error for a different page size")
+	}
+	for _, size := range []int{1024, 5000, 65536} {
+		kv = InitKV(t.TempDir() + "/kv_bad_page_size.db")
+		kv.PageSize = size
+		if err := kv.Open(); err == nil {
+			kv.Close()
+			t.Fatalf("expect an error for page size %d", size)
+		}
+	}
+}
+
+// 旧的文件的master page中没有page size
+func TestKvPageSizeOld(t *testing.T) {
+	path := t.TempDir() + "/kv_page_size_old.db"
+	kv := InitKV(path)
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to open kv, err: %s", err)
+	}
+	if err := kv.Set([]byte("k"), []byte("v")); err != nil {
+		t.Fatalf("fail to set, err: %s", err)
+	}
+	kv.Close()
+
+	fp, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the old format has a single master page in the first slot, without page_size, flags and checksum
+	if kv.masterSlot != 0 {
+		t.Fatalf("the latest master page is expected in the first slot")
+	}
+	if _, err := fp.WriteAt(make([]byte, MASTER_SLOT_SIZE*2-72), 72); err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+
+	kv = InitKV(path)
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to open the old file, err: %s", err)
+	}
+	defer kv.Close()
+	if v, ok, _ := kv.Get([]byte("k")); !ok || string(v) != "v" || kv.tree.layout.size != BTREE_PAGE_SIZE {
+		t.Fatalf("wrong value in the old file")
+	}
+}
+
+func TestKvChecksum(t *testing.T) {
+	path := t.TempDir() + "/kv_checksum.db"
+	kv := InitKV(path)
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to open kv, err: %s", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := kv.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("val%03d", i))); err != nil {
+			t.Fatalf("fail to set, err: %s", err)
+		}
+	}
+	root := kv.tree.root
+	kv.Close()
+
+	kv = InitKV(path)
+	kv.Verify = true
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to verify a good file, err: %s", err)
+	}
+	kv.Close()
+
+	// flip a bit in the middle of the root node
+	fp, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos := int64(root*BTREE_PAGE_SIZE + BTREE_PAGE_SIZE/2)
+	b := []byte{0}
+	fp.ReadAt(b, pos)
+	b[0] ^= 1
+	fp.WriteAt(b, pos)
+	fp.Close()
+
+	kv = InitKV(path)
+	kv.Verify = true
+	if err := kv.Open(); !errors.Is(err, ErrCorrupt) || !strings.Contains(err.Error(), fmt.Sprintf("page: %d", root)) {
+		t.Fatalf("expect ErrCorrupt with the page number, got: %v", err)
+	}
+
+	kv = InitKV(path)
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to open kv without verifying, err: %s", err)
+	}
+	if _, _, err := kv.Get([]byte("key001")); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expect ErrCorrupt, got: %v", err)
+	}
+	kv.Close()
+
+	// the master page
+	fp, err = os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp.WriteAt([]byte{0xff}, 20)
+	fp.WriteAt([]byte{0xff}, MASTER_SLOT_SIZE+20)
+	fp.Close()
+	kv = InitKV(path)
+	if err := kv.Open(); !errors.Is(err, ErrCorrupt) {
+		kv.Close()
+		t.Fatalf("expect ErrCorrupt for the master page, got: %v", err)
+	}
+}
+
+// 最新的master page损坏时使用上一个版本
+func TestKvMasterSlots(t *testing.T) {
+	path := t.TempDir() + "/kv_master_slots.db"
+	kv := InitKV(path)
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to open kv, err: %s", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := kv.Set([]byte("k"), []byte(fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatalf("fail to set, err: %s", err)
+		}
+	}
+	version, slot := kv.version, kv.masterSlot
+	kv.Close()
+
+	// a torn write of the latest slot
+	fp, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.WriteAt(make([]byte, 40), int64(slot*MASTER_SLOT_SIZE+50)); err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+
+	kv = InitKV(path)
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to open with the previous master page, err: %s", err)
+	}
+	if kv.version != version-1 || kv.masterSlot == slot {
+		t.Fatalf("wrong master page, version: %d, slot: %d", kv.version, kv.masterSlot)
+	}
+	if v, ok, _ := kv.Get([]byte("k")); !ok || string(v) != "v3" {
+		t.Fatalf("wrong value of the previous version: %s", v)
+	}
+
+	// the damaged slot is overwritten by the next commit
+	if err := kv.Set([]byte("k"), []byte("v5")); err != nil {
+		t.Fatalf("fail to set, err: %s", err)
+	}
+	if kv.masterSlot != slot {
+		t.Fatalf("the next master page is not written to the other slot")
+	}
+	kv.Close()
+
+	kv = InitKV(path)
+	kv.Verify = true
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to reopen kv, err: %s", err)
+	}
+	defer kv.Close()
+	if v, ok, _ := kv.Get([]byte("k")); !ok || string(v) != "v5" {
+		t.Fatalf("wrong value after reopen: %s", v)
+	}
+}
+
+// 提交写入的page都损坏(torn write)并且master page没有写入时，仍然是上一个版本
+func TestKvFreeListTorn(t *testing.T) {
+	path := t.TempDir() + "/kv_free_list_torn.db"
+	kv := InitKV(path)
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to open kv, err: %s", err)
+	}
+	// free list有多个node
+	for i := 0; i < 2000; i++ {
+		if err := kv.Set([]byte(fmt.Sprintf("key%d", i%100)), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("fail to set, err: %s", err)
+		}
+	}
+	if kv.free.tailSeq < uint64(2*kv.free.layout.flCap) {
+		t.Fatalf("the free list is too short: %d", kv.free.tailSeq)
+	}
+	kv.Close()
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kv = InitKV(path)
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to open kv, err: %s", err)
+	}
+	if err := kv.Set([]byte("key1"), []byte("new")); err != nil {
+		t.Fatalf("fail to set, err: %s", err)
+	}
+	kv.Close()
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 恢复master page，损坏这次提交写入的page
+	copy(after, before[:BTREE_PAGE_SIZE])
+	changed := 0
+	for start := BTREE_PAGE_SIZE; start < len(after); start += BTREE_PAGE_SIZE {
+		page := after[start : start+BTREE_PAGE_SIZE]
+		if start+BTREE_PAGE_SIZE <= len(before) && string(page) == string(before[start:start+BTREE_PAGE_SIZE]) {
+			continue
+		}
+		for i := range page[:BTREE_PAGE_SIZE/2] {
+			page[i] ^= 0xff
+		}
+		changed++
+	}
+	if changed == 0 {
+		t.Fatalf("no page is written")
+	}
+	if err := os.WriteFile(path, after, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	kv = InitKV(path)
+	kv.Verify = true
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to recover the previous version, err: %s", err)
+	}
+	if v, ok, err := kv.Get([]byte("key1")); !ok || err != nil || string(v) != "1901" {
+		t.Fatalf("wrong value of the previous version: %s, %v", v, err)
+	}
+	// 损坏的page是空闲的，可以复用
+	for i := 0; i < 500; i++ {
+		if err := kv.Set([]byte(fmt.Sprintf("key%d", i%100)), []byte("again")); err != nil {
+			t.Fatalf("fail to set, err: %s", err)
+		}
+	}
+	kv.Close()
+
+	kv = InitKV(path)
+	kv.Verify = true
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to reopen kv, err: %s", err)
+	}
+	defer kv.Close()
+	if v, ok, err := kv.Get([]byte("key99")); !ok || err != nil || string(v) != "again" {
+		t.Fatalf("wrong value after reopen: %s, %v", v, err)
+	}
+}
+
+// 模拟进程崩溃，WAL模式下不做checkpoint
+func kvCrash(kv *KV) {
+	if kv.wal.fp != nil {
+		close(kv.wal.stop)
+		<-kv.wal.done
+		kv.wal.fp.Close()
+		kv.wal.fp = nil
+	}
+	kv.Close()
+}
+
+func TestKvWAL(t *testing.T) {
+	path := t.TempDir() + "/kv_wal.db"
+	kv := InitKV(path)
+	kv.WAL = true
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to open kv, err: %s", err)
+	}
+
+	ref := map[string]string{}
+	update := func(round int) {
+		for i := 0; i < 50; i++ {
+			key := fmt.Sprintf("key%03d", (i*7+round)%100)
+			if (i+round)%5 == 0 {
+				delete(ref, key)
+				if _, err := kv.Del([]byte(key)); err != nil {
+					t.Fatalf("fail to delete, err: %s", err)
+				}
+				continue
+			}
+			ref[key] = fmt.Sprintf("val%d-%s", round, strings.Repeat("x", i%3*2000))
+			if err := kv.Set([]byte(key), []byte(ref[key])); err != nil {
+				t.Fatalf("fail to set, err: %s", err)
+			}
+		}
+	}
+	check := func(kv *KV) {
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key%03d", i)
+			val, ok, err := kv.Get([]byte(key))
+			if err != nil || ok != (ref[key] != "") || string(val) != ref[key] {
+				t.Fatalf("wrong value, key: %s, ok: %v, err: %v", key, ok, err)
+			}
+		}
+	}
+
+	for round := 0; round < 10; round++ {
+		update(round)
+	}
+	if kv.wal.checkpoint != 1 || kv.wal.size == 0 {
+		t.Fatalf("the commits are not in the log, checkpoint: %d, size: %d", kv.wal.checkpoint, kv.wal.size)
+	}
+	if err := walCheckpoint(kv); err != nil {
+		t.Fatalf("fail to checkpoint, err: %s", err)
+	}
+	if kv.wal.checkpoint != kv.version || kv.wal.size != 0 {
+		t.Fatalf("wrong checkpoint, checkpoint: %d, size: %d", kv.wal.checkpoint, kv.wal.size)
+	}
+	// the pages of the checkpoint are not reused before the next checkpoint
+	for round := 10; round < 20; round++ {
+		update(round)
+	}
+	version := kv.version
+	kvCrash(kv)
+
+	// a torn write at the end of the log
+	fp, err := os.OpenFile(walPath(path), os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp.Write(walEncode(version+1, []walOp{{flag: FLAG_UPDATED, key: []byte("key000"), val: []byte("torn")}})[:20])
+	fp.Close()
+
+	kv = InitKV(path)
+	kv.WAL = true
+	kv.Verify = true
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to reopen kv, err: %s", err)
+	}
+	if kv.version != version || kv.wal.checkpoint != version {
+		t.Fatalf("wrong version after replay, got: %d, expected: %d", kv.version, version)
+	}
+	check(kv)
+	for round := 20; round < 25; round++ {
+		update(round)
+	}
+	kvCrash(kv)
+
+	// the log is replayed and removed in the default mode
+	kv = InitKV(path)
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to reopen kv, err: %s", err)
+	}
+	check(kv)
+	if _, err := os.Stat(walPath(path)); !os.IsNotExist(err) {
+		t.Fatalf("the log is not removed, err: %v", err)
+	}
+	update(25)
+	kv.Close()
+
+	kv = InitKV(path)
+	kv.WAL = true
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to reopen kv, err: %s", err)
+	}
+	check(kv)
+	update(26)
+	kv.Close()
+	if fi, err := os.Stat(walPath(path)); err != nil || fi.Size() != 0 {
+		t.Fatalf("the log is not empty after close, err: %v", err)
+	}
+}
+
+func TestKvGroupCommit(t *testing.T) {
+	kv := InitKV(t.TempDir() + "/kv_group_commit.db")
+	kv.CommitDelay = 5 * time.Millisecond
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to open kv, err: %s", err)
+	}
+	defer kv.Close()
+
+	const writers, rounds = 16, 10
+	version := kv.version
+	wg := sync.WaitGroup{}
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				key := []byte(fmt.Sprintf("key%02d-%02d", w, i))
+				if err := kv.Set(key, key); err != nil {
+					t.Errorf("fail to set, err: %s", err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// 一批事务是一个版本
+	if commits := kv.version - version; commits >= writers*rounds {
+		t.Fatalf("commits are not batched, versions: %d", commits)
+	}
+	for w := 0; w < writers; w++ {
+		for i := 0; i < rounds; i++ {
+			key := fmt.Sprintf("key%02d-%02d", w, i)
+			if v, ok, _ := kv.Get([]byte(key)); !ok || string(v) != key {
+				t.Fatalf("missing key: %s", key)
+			}
+		}
+	}
+}
+
+// 同一批中后面的事务读了前面的事务写的key
+func TestKvGroupConflict(t *testing.T) {
+	kv := InitKV(t.TempDir() + "/kv_group_conflict.db")
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to open kv, err: %s", err)
+	}
+	defer kv.Close()
+
+	txs := []*KVTX{{}, {}, {}}
+	for i, tx := range txs {
+		kv.Begin(tx)
+		if i < 2 {
+			tx.Get([]byte("x"))
+		}
+		tx.Set([]byte(fmt.Sprintf("x%d", i)), []byte("v"))
+		tx.Set([]byte("x"), []byte(fmt.Sprintf("v%d", i)))
+	}
+	batch := []*commitReq{{tx: txs[0]}, {tx: txs[1]}, {tx: txs[2]}}
+	kv.writer.Lock()
+	commitBatch(kv, batch)
+	kv.writer.Unlock()
+	for _, tx := range txs {
+		kv.EndRead(&tx.KVReader)
+	}
+
+	if batch[0].err != nil || !errors.Is(batch[1].err, ErrConflict) || batch[2].err != nil {
+		t.Fatalf("wrong results: %v, %v, %v", batch[0].err, batch[1].err, batch[2].err)
+	}
+	if v, _, _ := kv.Get([]byte("x")); string(v) != "v2" {
+		t.Fatalf("wrong value: %s", v)
+	}
+	if _, ok, _ := kv.Get([]byte("x1")); ok {
+		t.Fatalf("the conflicted transaction is committed")
+	}
+}
+
+func TestKvSyncMode(t *testing.T) {
+	path := t.TempDir() + "/kv_sync_mode.db"
+	for _, mode := range []SyncMode{SyncNever, SyncEvery(time.Millisecond), SyncAlways} {
+		kv := InitKV(path)
+		kv.SyncMode = mode
+		if err := kv.Open(); err != nil {
+			t.Fatalf("fail to open kv, err: %s", err)
+		}
+		for i := 0; i < 100; i++ {
+			if err := kv.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprint(mode))); err != nil {
+				t.Fatalf("fail to set, err: %s", err)
+			}
+		}
+		if err := kv.Sync(); err != nil {
+			t.Fatalf("fail to sync, err: %s", err)
+		}
+		kv.Close()
+
+		kv = InitKV(path)
+		if err := kv.Open(); err != nil {
+			t.Fatalf("fail to reopen kv, err: %s", err)
+		}
+		if v, ok, _ := kv.Get([]byte("key099")); !ok || string(v) != fmt.Sprint(mode) {
+			t.Fatalf("wrong value after reopen: %s", v)
+		}
+		kv.Close()
+	}
+
+	// 后台fsync失败之后提交都失败
+	kv := InitKV(path)
+	kv.SyncMode = SyncEvery(time.Hour)
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to open kv, err: %s", err)
+	}
+	defer kv.Close()
+	kv.flusher.err = errors.New("fsync: test")
+	if err := kv.Set([]byte("k"), []byte("v")); err == nil || err.Error() != "fsync: test" {
+		t.Fatalf("expect the fsync error, got: %v", err)
+	}
+	if _, ok, _ := kv.Get([]byte("k")); ok {
+		t.Fatalf("the failed commit is visible")
+	}
+}
+
+// 没有fsync的提交不能覆盖磁盘上的master page指向的tree
+func TestKvSyncNeverReuse(t *testing.T) {
+	kv := InitKV(t.TempDir() + "/kv_sync_never.db")
+	kv.SyncMode = SyncNever
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to open kv, err: %s", err)
+	}
+	defer kv.Close()
+
+	if err := kv.Set([]byte("k"), []byte("v0")); err != nil {
+		t.Fatalf("fail to set, err: %s", err)
+	}
+	if err := kv.Sync(); err != nil {
+		t.Fatalf("fail to sync, err: %s", err)
+	}
+	if kv.synced != kv.version {
+		t.Fatalf("synced: %d, version: %d", kv.synced, kv.version)
+	}
+	// 已经落盘的tree，没有登记为读事务
+	durable := KVReader{}
+	kv.BeginRead(&durable)
+	kv.EndRead(&durable)
+
+	for i := 1; i <= 2; i++ {
+		if err := kv.Set([]byte("k"), []byte(fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatalf("fail to set, err: %s", err)
+		}
+		if kv.synced != kv.version-1 {
+			t.Fatalf("synced: %d, version: %d", kv.synced, kv.version)
+		}
+		// 机器崩溃后可能用的还是这个tree
+		if v, ok, err := durable.Get([]byte("k")); !ok || err != nil || string(v) != "v0" {
+			t.Fatalf("the durable tree is overwritten: %q, %v, %v", v, ok, err)
+		}
+	}
+}
+
+// 旧版本的文件返回ErrFileVersion，而不是ErrCorrupt
+func TestKvFileVersion(t *testing.T) {
+	path := t.TempDir() + "/old.db"
+	page := make([]byte, 2*BTREE_PAGE_SIZE)
+	copy(page, "BuildYourOwnDB05")
+	if err := os.WriteFile(path, page, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	kv := InitKV(path)
+	if err := kv.Open(); !errors.Is(err, ErrFileVersion) || !strings.Contains(err.Error(), "BuildYourOwnDB05") {
+		if err == nil {
+			kv.Close()
+		}
+		t.Fatalf("expect ErrFileVersion, got: %v", err)
+	}
+}
+
+func TestKvRetry(t *testing.T) {
+	kv := InitKV(t.TempDir() + "/kv_retry.db")
+	kv.SyncMode = SyncNever
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to open kv, err: %s", err)
+	}
+	defer kv.Close()
+
+	// the results of the last attempt, not the earlier ones
+	req := &InsertReq{Key: []byte("a_key"), Val: []byte("a_value")}
+	if added, err := kv.Update(req); !added || err != nil || !req.Added {
+		t.Fatalf("fail to insert, added: %v, err: %v", added, err)
+	}
+	if updated, err := kv.Update(req); updated || err != nil || req.Added || req.Updated || string(req.Old) != "a_value" {
+		t.Fatalf("the same value should not be updated, updated: %v, err: %v, req: %+v", updated, err, req)
+	}
+
+	// 每次都冲突的事务在TX_MAX_ATTEMPTS次之后返回ErrConflict
+	attempts := 0
+	err := kv.update(func(tx *KVTX) error {
+		attempts++
+		if _, _, err := tx.Get([]byte("a_key")); err != nil {
+			return err
+		}
+		if err := kv.Set([]byte("a_key"), []byte(fmt.Sprint(attempts))); err != nil {
+			return err
+		}
+		return tx.Set([]byte("b_key"), []byte("b_value"))
+	})
+	if !errors.Is(err, ErrConflict) || attempts != TX_MAX_ATTEMPTS {
+		t.Fatalf("expect ErrConflict after %d attempts, got: %v, attempts: %d", TX_MAX_ATTEMPTS, err, attempts)
+	}
+	if _, ok, _ := kv.Get([]byte("b_key")); ok {
+		t.Fatalf("the conflicting transaction should not be committed")
+	}
+}
+
+// 一个事务写入失败时，同一批中它之后的事务也返回错误
+func TestKvGroupFail(t *testing.T) {
+	kv := InitKV(t.TempDir() + "/kv_group_fail.db")
+	kv.SyncMode = SyncNever
+	if err := kv.Open(); err != nil {
+		t.Fatalf("fail to open kv, err: %s", err)
+	}
+	defer kv.Close()
+	err := kv.update(func(tx *KVTX) error {
+		for i := 0; i < 1000; i++ {
+			if err := tx.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(strings.Repeat("v", 100))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("fail to set, err: %s", err)
+	}
+
+	// corrupt the last leaf on disk, the first leaf is intact
+	node := kv.pageGet(kv.tree.root)
+	ptr := kv.tree.root
+	for node.btype() == BNODE_NODE {
+		ptr = node.getPtr(node.nkeys() - 1)
+		node = kv.pageGet(ptr)
+	}
+	if _, err := kv.fp.WriteAt([]byte("garbage"), int64(ptr)*int64(kv.tree.layout.size)+100); err != nil {
+		t.Fatal(err)
+	}
+
+	txs := []*KVTX{{}, {}, {}}
+	for i, tx := range txs {
+		kv.Begin(tx)
+		key := "key0000"
+		if i == 1 {
+			key = "key9999" // in the corrupted leaf
+		}
+		tx.Set([]byte(fmt.Sprintf("%s-%d", key, i)), []byte("v"))
+	}
+	batch := []*commitReq{{tx: txs[0]}, {tx: txs[1]}, {tx: txs[2]}}
+	kv.writer.Lock()
+	commitBatch(kv, batch)
+	kv.writer.Unlock()
+	for _, tx := range txs {
+		kv.EndRead(&tx.KVReader)
+	}
+
+	for i, req := range batch {
+		if !errors.Is(req.err, ErrCorrupt) {
+			t.Fatalf("transaction %d should fail, err: %v", i, req.err)
+		}
+	}
+	for _, key := range []string{"key0000-0", "key0000-2"} {
+		if _, ok, _ := kv.Get([]byte(key)); ok {
+			t.Fatalf("the failed batch is committed: %s", key)
+		}
+	}
+}
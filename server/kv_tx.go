@@ -0,0 +1,270 @@
+package server
+
+import (
+	"bytes"
+	"container/heap"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// read-only KV transaction
+// 读事务持有开始时的root和mmap，读到的是一个固定的快照，不受写事务影响
+// 写事务不会复用任何读事务还能看到的page
+type KVReader struct {
+	// the snapshot
+	version uint64
+	tree    BTree
+	mmap    struct {
+		chunks [][]byte // copied from struct KV. read-only.
+	}
+	// for removing from the heap
+	index int
+}
+
+func (kv *KV) BeginRead(tx *KVReader) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	tx.mmap.chunks = kv.mmap.chunks
+	tx.tree.root = kv.tree.root
+	tx.tree.layout = kv.tree.layout
+	tx.tree.get = tx.pageGetMapped
+	tx.version = kv.version
+	heap.Push(&kv.readers, tx)
+}
+
+func (kv *KV) EndRead(tx *KVReader) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	heap.Remove(&kv.readers, tx.index)
+}
+
+// callback for BTree & FreeList, dereference a pointer.
+func (tx *KVReader) pageGetMapped(ptr uint64) BNode {
+	return pageGetMapped(tx.mmap.chunks, tx.tree.layout, ptr)
+}
+
+func (tx *KVReader) Get(key []byte) ([]byte, bool, error) {
+	return tx.tree.Get(key)
+}
+
+// key2和cmp2是范围的另一端，读事务不需要
+func (tx *KVReader) Seek(key1 []byte, cmp1 int, key2 []byte, cmp2 int) KVIter {
+	return tx.tree.Seek(key1, cmp1)
+}
+
+// the heap of active readers, the minimum version is at the top
+type ReaderList []*KVReader
+
+func (h ReaderList) Len() int {
+	return len(h)
+}
+
+func (h ReaderList) Less(i, j int) bool {
+	return versionBefore(h[i].version, h[j].version)
+}
+
+func (h ReaderList) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *ReaderList) Push(x interface{}) {
+	tx := x.(*KVReader)
+	tx.index = len(*h)
+	*h = append(*h, tx)
+}
+
+func (h *ReaderList) Pop() interface{} {
+	old := *h
+	n := len(old)
+	tx := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return tx
+}
+
+// the conflict between concurrent transactions, the transaction can be retried
+var ErrConflict = errors.New("transaction conflict")
+
+// KV.update和DB.update最多尝试的次数，之后返回ErrConflict
+const TX_MAX_ATTEMPTS = 64
+
+// 冲突之后随机等待一段时间再重试，等待的上限随次数翻倍
+func txBackoff(attempt int) {
+	time.Sleep(time.Duration(rand.Int63n(int64((10 * time.Microsecond) << min(attempt, 12)))))
+}
+
+const (
+	FLAG_DELETED = byte(1)
+	FLAG_UPDATED = byte(2)
+)
+
+// KV transaction
+// 写事务读的是开始时的快照，修改暂存在内存中的pending tree里，多个写事务可以同时进行。
+// Commit时检查本事务读过的范围是否被之后提交的事务修改过，没有冲突才把修改写入最新的tree，
+// 修改的page都暂存在page.updates中，通过一次masterStore生效
+type KVTX struct {
+	KVReader            // the snapshot
+	db       *KV        //
+	pending  BTree      // uncommitted updates, values are prefixed by a flag
+	reads    []KeyRange // for conflict detection
+	done     bool       //
+}
+
+// the range [start, stop] read by a transaction
+type KeyRange struct {
+	start []byte
+	stop  []byte
+}
+
+// the keys written by a committed transaction
+type CommittedTX struct {
+	version uint64
+	writes  [][]byte // sorted
+}
+
+// begin a transaction
+func (kv *KV) Begin(tx *KVTX) {
+	tx.db = kv
+	tx.pending = newPendingTree(kv.tree.layout)
+	tx.reads = nil
+	tx.done = false
+	kv.BeginRead(&tx.KVReader)
+}
+
+// end a transaction: commit updates
+func (kv *KV) Commit(tx *KVTX) error {
+	assert(tx.db == kv && !tx.done, "KV commit, bad transaction")
+	tx.done = true
+	defer kv.EndRead(&tx.KVReader)
+
+	if tx.pending.root == 0 {
+		return nil // read only
+	}
+
+	return kv.groupCommit(tx)
+}
+
+// end a transaction: rollback
+func (kv *KV) Abort(tx *KVTX) {
+	assert(tx.db == kv && !tx.done, "KV abort, bad transaction")
+	tx.done = true
+	kv.EndRead(&tx.KVReader)
+}
+
+// 本事务开始之后提交的事务，以及同一批中前面的事务，是否修改了本事务读过的范围
+func detectConflicts(kv *KV, tx *KVTX, batch [][][]byte) bool {
+	for i := len(kv.history) - 1; i >= 0; i-- {
+		committed := kv.history[i]
+		if !versionBefore(tx.version, committed.version) {
+			break
+		}
+		if rangesWritten(tx.reads, committed.writes) {
+			return true
+		}
+	}
+	for _, writes := range batch {
+		if rangesWritten(tx.reads, writes) {
+			return true
+		}
+	}
+	return false
+}
+
+// writes is sorted
+func rangesWritten(reads []KeyRange, writes [][]byte) bool {
+	for _, r := range reads {
+		// the first written key >= start
+		idx := sort.Search(len(writes), func(i int) bool {
+			return bytes.Compare(writes[i], r.start) >= 0
+		})
+		if idx < len(writes) && bytes.Compare(writes[idx], r.stop) <= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// an in-memory B+tree for uncommitted updates
+func newPendingTree(layout pageLayout) BTree {
+	pages := map[uint64]BNode{}
+	next := uint64(0)
+	return BTree{
+		layout: layout,
+		flag:   1,
+		get: func(ptr uint64) BNode {
+			node, ok := pages[ptr]
+			assert(ok, fmt.Sprintf("pending tree, page not found: %d", ptr))
+			return node
+		},
+		new: func(node BNode) uint64 {
+			next++
+			pages[next] = node
+			return next
+		},
+		// 不释放旧的node，事务中修改之前创建的iterator还可以继续使用
+		del: func(ptr uint64) {},
+	}
+}
+
+// KV operations, 读操作会记录读过的范围
+func (tx *KVTX) Get(key []byte) ([]byte, bool, error) {
+	tx.reads = append(tx.reads, KeyRange{start: key, stop: key})
+
+	val, ok, err := tx.pending.Get(key)
+	switch {
+	case err != nil:
+		return nil, false, err
+	case ok && val[0] == FLAG_UPDATED:
+		return val[1:], true, nil
+	case ok && val[0] == FLAG_DELETED:
+		return nil, false, nil
+	default:
+		return tx.KVReader.Get(key)
+	}
+}
+
+// key2和cmp2是范围的另一端，用于记录读过的范围
+func (tx *KVTX) Seek(key1 []byte, cmp1 int, key2 []byte, cmp2 int) KVIter {
+	start, stop := key1, key2
+	if cmp1 < 0 {
+		start, stop = key2, key1
+	}
+	tx.reads = append(tx.reads, KeyRange{start: start, stop: stop})
+
+	top := tx.pending.Seek(key1, cmp1)
+	bot := tx.tree.Seek(key1, cmp1)
+	return newCombinedIter(top, bot, cmp1)
+}
+
+// 提交时才写入最新的tree，所以在这里检查key和value，避免提交时才失败
+func (tx *KVTX) Set(key []byte, val []byte) error {
+	// pending tree的Insert检查key和value的大小，flag不计入value的大小
+	return tx.pending.Insert(key, append([]byte{FLAG_UPDATED}, val...))
+}
+
+func (tx *KVTX) Update(req *InsertReq) (bool, error) {
+	old, exists, err := tx.Get(req.Key)
+	if err != nil {
+		return false, err
+	}
+	write, err := req.apply(old, exists)
+	if err != nil || !write {
+		return false, err
+	}
+	return true, tx.Set(req.Key, req.Val)
+}
+
+func (tx *KVTX) Del(key []byte) (bool, error) {
+	_, exists, err := tx.Get(key)
+	if err != nil || !exists {
+		return false, err
+	}
+	return true, tx.pending.Insert(key, []byte{FLAG_DELETED})
+}
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+/*
+*
+WAL模式(KV.WAL)
+
+默认每次提交fsync两次: 数据页和master page。WAL模式下提交时修改的KV追加到log文件，只fsync一次:
+
+	1. 和默认模式一样在新的page上修改tree，page写入mmap，但不fsync，也不写master page
+	2. 本次提交修改的KV追加到log，fsync log
+	3. 新的root对读事务可见
+
+文件中的master page停留在上一次checkpoint的版本。log超过WAL_CHECKPOINT_SIZE时，
+后台goroutine fsync数据文件、写入master page，然后清空log。
+Open时从master page的版本开始重放log中的记录，不是WAL模式时也会重放遗留的log。
+
+checkpoint的tree必须保持完整，所以checkpoint之后释放的page在下一次checkpoint之前不能复用，
+相当于一个停留在checkpoint版本的读事务。
+
+the log record format:
+| len | crc | version | nops | op1 | op2 | ...
+| 4B  | 4B  | 8B      | 4B   |
+
+the op format:
+| flag | klen | key | vlen | val |
+| 1B   | 4B   | ... | 4B   | ... |
+
+crc是len之后所有数据的CRC32C，崩溃时写了一半的记录在重放时被丢弃
+*/
+
+const WAL_CHECKPOINT_SIZE = 4 << 20
+
+// a KV pair written by a transaction, flag is FLAG_DELETED or FLAG_UPDATED
+type walOp struct {
+	flag byte
+	key  []byte
+	val  []byte
+}
+
+func walPath(path string) string {
+	return path + "-wal"
+}
+
+// 重放遗留的log，WAL模式下打开log并启动checkpoint
+func walOpen(db *KV) error {
+	flag := os.O_RDWR
+	if db.WAL {
+		flag |= os.O_CREATE
+	}
+	fp, err := os.OpenFile(walPath(db.Path), flag, 0644)
+	if !db.WAL && errors.Is(err, os.ErrNotExist) {
+		return nil // no log left
+	}
+	if err != nil {
+		return fmt.Errorf("open log: %w", err)
+	}
+
+	data, err := io.ReadAll(fp)
+	if err == nil {
+		err = walReplay(db, data)
+	}
+	if err == nil && len(data) > 0 {
+		// 重放的修改落盘之后才能清空log
+		if err = db.fp.Sync(); err == nil {
+			err = fp.Truncate(0)
+		}
+	}
+	if err == nil && !db.WAL {
+		err = os.Remove(walPath(db.Path))
+	}
+	if err != nil || !db.WAL {
+		fp.Close()
+		return err
+	}
+
+	db.wal.fp = fp
+	db.wal.size = 0
+	db.wal.checkpoint = db.version
+	db.wal.err = nil
+	db.wal.notify = make(chan struct{}, 1)
+	db.wal.stop = make(chan struct{})
+	db.wal.done = make(chan struct{})
+	go walCheckpointer(db)
+	return nil
+}
+
+// 正常关闭时做一次checkpoint，log是空的
+func walClose(db *KV) {
+	if db.wal.fp == nil {
+		return
+	}
+	close(db.wal.stop)
+	<-db.wal.done
+	walCheckpoint(db)
+	db.wal.fp.Close()
+	db.wal.fp = nil
+}
+
+// 应用log中比master page新的记录，最后像普通的提交一样flush
+func walReplay(db *KV, data []byte) error {
+	version := db.version // the last replayed version
+	// 重放时释放的page在flush之前不能复用
+	db.free.version = db.version + 1
+	db.free.minReader = db.version
+	for {
+		rec, ops, rest, ok := walDecode(data)
+		if !ok {
+			break // the end, or a torn write
+		}
+		data = rest
+		if !versionBefore(version, rec) {
+			continue // already checkpointed
+		}
+		if rec != version+1 {
+			return fmt.Errorf("%w: missing log records, expect version %d, got %d", ErrCorrupt, version+1, rec)
+		}
+		for _, op := range ops {
+			var err error
+			if op.flag == FLAG_DELETED {
+				_, err = db.tree.Delete(op.key)
+			} else {
+				err = db.tree.Insert(op.key, op.val)
+			}
+			if err != nil {
+				return fmt.Errorf("replay log: %w", err)
+			}
+		}
+		version = rec
+	}
+	if version == db.version {
+		return nil
+	}
+
+	// 提交后的版本是log中最后的版本，如果清空log之前崩溃，下次不会重复应用
+	db.version = version - 1
+	return flushPages(db, db.tree.root)
+}
+
+// the commit in WAL mode, 调用者在失败时回滚
+func walCommit(db *KV, root uint64, ops []walOp) error {
+	if db.wal.err != nil {
+		return db.wal.err
+	}
+	if err := writePages(db); err != nil {
+		return err
+	}
+	if err := walAppend(db, walEncode(db.version+1, ops)); err != nil {
+		return err
+	}
+	publishPages(db, root)
+
+	if db.wal.size >= WAL_CHECKPOINT_SIZE {
+		select {
+		case db.wal.notify <- struct{}{}:
+		default: // already notified
+		}
+	}
+	return nil
+}
+
+func walAppend(db *KV, rec []byte) error {
+	_, err := db.wal.fp.WriteAt(rec, db.wal.size)
+	if err == nil {
+		err = commitSync(db, db.wal.fp.Sync)
+	}
+	if err != nil {
+		// the incomplete record is discarded
+		db.wal.fp.Truncate(db.wal.size)
+		return fmt.Errorf("write log: %w", err)
+	}
+	db.wal.size += int64(len(rec))
+	return nil
+}
+
+func walCheckpointer(db *KV) {
+	defer close(db.wal.done)
+	for {
+		select {
+		case <-db.wal.notify:
+			walCheckpoint(db) // the error is kept in db.wal.err
+		case <-db.wal.stop:
+			return
+		}
+	}
+}
+
+// 数据文件fsync之后写入master page，然后清空log
+// 失败之后不知道哪些数据已经落盘，之后的提交都返回这个错误
+func walCheckpoint(db *KV) error {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	if db.wal.err != nil || db.wal.checkpoint == db.version {
+		return db.wal.err
+	}
+	if err := db.fp.Sync(); err != nil {
+		db.wal.err = fmt.Errorf("fsync: %w", err)
+		return db.wal.err
+	}
+	if err := masterStore(db); err != nil {
+		db.wal.err = err
+		return err
+	}
+	if err := db.fp.Sync(); err != nil {
+		db.wal.err = fmt.Errorf("fsync: %w", err)
+		return db.wal.err
+	}
+	db.wal.checkpoint = db.version
+
+	// log中的记录都不比master page新了
+	if err := db.wal.fp.Truncate(0); err != nil {
+		db.wal.err = fmt.Errorf("truncate log: %w", err)
+		return db.wal.err
+	}
+	db.wal.size = 0
+	return nil
+}
+
+func walEncode(version uint64, ops []walOp) []byte {
+	rec := make([]byte, 8, 64)
+	rec = binary.LittleEndian.AppendUint64(rec, version)
+	rec = binary.LittleEndian.AppendUint32(rec, uint32(len(ops)))
+	for _, op := range ops {
+		rec = append(rec, op.flag)
+		rec = binary.LittleEndian.AppendUint32(rec, uint32(len(op.key)))
+		rec = append(rec, op.key...)
+		rec = binary.LittleEndian.AppendUint32(rec, uint32(len(op.val)))
+		rec = append(rec, op.val...)
+	}
+	binary.LittleEndian.PutUint32(rec[0:], uint32(len(rec)-8))
+	binary.LittleEndian.PutUint32(rec[4:], crc32.Checksum(rec[8:], crc32c))
+	return rec
+}
+
+// 数据不完整或者crc不对时ok为false
+func walDecode(data []byte) (version uint64, ops []walOp, rest []byte, ok bool) {
+	if len(data) < 8 {
+		return 0, nil, nil, false
+	}
+	size := binary.LittleEndian.Uint32(data[0:])
+	if uint64(size) > uint64(len(data)-8) || size < 12 {
+		return 0, nil, nil, false
+	}
+	body, rest := data[8:8+size], data[8+size:]
+	if crc32.Checksum(body, crc32c) != binary.LittleEndian.Uint32(data[4:]) {
+		return 0, nil, nil, false
+	}
+
+	r := &protoReader{buf: body}
+	version = r.u64()
+	for n := r.count(); n > 0; n-- {
+		op := walOp{flag: r.byte()}
+		op.key = r.bytes()
+		op.val = r.bytes()
+		ops = append(ops, op)
+	}
+	return version, ops, rest, r.done() == nil
+}
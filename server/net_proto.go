@@ -0,0 +1,309 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+/*
+*
+客户端和服务端之间的协议，每个消息是一个带长度的frame:
+
+	| len 4B | payload |
+
+请求和响应一一对应，payload的格式:
+
+	request:  | op 1B | mode 4B | table | rec | key1 | key2 | cmp1 8B | cmp2 8B | data |
+	response: | code 1B | msg | ok 1B | affected 8B | names | recs | next |
+
+	string/bytes: | len 4B | data |
+	record:       | ncols 4B | name type 4B i64 8B str | ... |
+
+data是TableNew的表定义(json)或者Exec的查询语句
+
+Exec的结果也分页返回，还有更多的行时ok为1，客户端用OP_EXEC_NEXT取下一页，
+连接上的其他请求会丢弃没有取完的行。编码后超过PROTO_MAX_FRAME的响应换成一个错误，连接仍然可以使用
+
+范围查询的结果分页返回，每页最多PROTO_SCAN_ROWS行，或者超过PROTO_SCAN_BYTES之后结束，
+还有更多的行时ok为1，next是最后一行的key(主键或者索引的所有列)，客户端从next之后继续查询
+*/
+
+const (
+	PROTO_MAX_FRAME  = 64 << 20
+	PROTO_SCAN_ROWS  = 1000
+	PROTO_SCAN_BYTES = 16 << 20 // 加上最后一行也不会超过PROTO_MAX_FRAME
+)
+
+const (
+	OP_GET       = 1
+	OP_SET       = 2 // Insert, Update and Upsert, with the mode
+	OP_DELETE    = 3
+	OP_SCAN      = 4
+	OP_TABLE_NEW = 5
+	OP_EXEC      = 6
+	OP_BEGIN     = 7
+	OP_COMMIT    = 8
+	OP_ABORT     = 9
+	OP_EXEC_NEXT = 10 // the next page of the Exec result
+)
+
+// the response code
+const (
+	RES_OK       = 0
+	RES_ERR      = 1
+	RES_CONFLICT = 2 // ErrConflict
+)
+
+type Request struct {
+	Op    byte
+	Mode  int
+	Table string
+	Rec   Record
+	Key1  Record
+	Key2  Record
+	Cmp1  int
+	Cmp2  int
+	Data  []byte
+}
+
+type Response struct {
+	Code     byte
+	Msg      string
+	Ok       bool
+	Affected uint64
+	Names    []string
+	Recs     []Record
+	Next     Record // OP_SCAN的下一页从这里开始
+}
+
+// 把响应转换回错误
+func (res *Response) Err() error {
+	switch res.Code {
+	case RES_OK:
+		return nil
+	case RES_CONFLICT:
+		return ErrConflict
+	default:
+		return errors.New(res.Msg)
+	}
+}
+
+func WriteFrame(w io.Writer, payload []byte) error {
+	if len(payload) > PROTO_MAX_FRAME {
+		return fmt.Errorf("frame is too large: %d", len(payload))
+	}
+	frame := make([]byte, 4+len(payload))
+	binary.LittleEndian.PutUint32(frame, uint32(len(payload)))
+	copy(frame[4:], payload)
+	_, err := w.Write(frame)
+	return err
+}
+
+func ReadFrame(r io.Reader) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint32(hdr[:])
+	if size > PROTO_MAX_FRAME {
+		return nil, fmt.Errorf("frame is too large: %d", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+func (req *Request) Encode() []byte {
+	w := &protoWriter{}
+	w.buf = append(w.buf, req.Op)
+	w.u32(uint32(req.Mode))
+	w.bytes([]byte(req.Table))
+	w.record(req.Rec)
+	w.record(req.Key1)
+	w.record(req.Key2)
+	w.u64(uint64(req.Cmp1))
+	w.u64(uint64(req.Cmp2))
+	w.bytes(req.Data)
+	return w.buf
+}
+
+func DecodeRequest(data []byte) (Request, error) {
+	r := &protoReader{buf: data}
+	req := Request{}
+	req.Op = r.byte()
+	req.Mode = int(r.u32())
+	req.Table = string(r.bytes())
+	req.Rec = r.record()
+	req.Key1 = r.record()
+	req.Key2 = r.record()
+	req.Cmp1 = int(r.u64())
+	req.Cmp2 = int(r.u64())
+	req.Data = r.bytes()
+	return req, r.done()
+}
+
+func (res *Response) Encode() []byte {
+	w := &protoWriter{}
+	w.buf = append(w.buf, res.Code)
+	w.bytes([]byte(res.Msg))
+	w.bool(res.Ok)
+	w.u64(res.Affected)
+	w.u32(uint32(len(res.Names)))
+	for _, name := range res.Names {
+		w.bytes([]byte(name))
+	}
+	w.u32(uint32(len(res.Recs)))
+	for _, rec := range res.Recs {
+		w.record(rec)
+	}
+	w.record(res.Next)
+	return w.buf
+}
+
+func DecodeResponse(data []byte) (Response, error) {
+	r := &protoReader{buf: data}
+	res := Response{}
+	res.Code = r.byte()
+	res.Msg = string(r.bytes())
+	res.Ok = r.bool()
+	res.Affected = r.u64()
+	for n := r.count(); n > 0; n-- {
+		res.Names = append(res.Names, string(r.bytes()))
+	}
+	for n := r.count(); n > 0; n-- {
+		res.Recs = append(res.Recs, r.record())
+	}
+	res.Next = r.record()
+	return res, r.done()
+}
+
+type protoWriter struct {
+	buf []byte
+}
+
+func (w *protoWriter) u32(v uint32) {
+	w.buf = binary.LittleEndian.AppendUint32(w.buf, v)
+}
+
+func (w *protoWriter) u64(v uint64) {
+	w.buf = binary.LittleEndian.AppendUint64(w.buf, v)
+}
+
+func (w *protoWriter) bool(b bool) {
+	if b {
+		w.buf = append(w.buf, 1)
+	} else {
+		w.buf = append(w.buf, 0)
+	}
+}
+
+func (w *protoWriter) bytes(b []byte) {
+	w.u32(uint32(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *protoWriter) record(rec Record) {
+	w.u32(uint32(len(rec.Cols)))
+	for i, col := range rec.Cols {
+		w.bytes([]byte(col))
+		w.u32(rec.Vals[i].Type)
+		w.u64(uint64(rec.Vals[i].I64))
+		w.bytes(rec.Vals[i].Str)
+	}
+}
+
+// the encoded size of a record
+func recordSize(rec Record) int {
+	size := 4
+	for i, col := range rec.Cols {
+		size += 4 + len(col) + 4 + 8 + 4 + len(rec.Vals[i].Str)
+	}
+	return size
+}
+
+// 数据不完整时记录错误，之后读到的都是零值
+type protoReader struct {
+	buf []byte
+	err error
+}
+
+func (r *protoReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.buf) {
+		r.err = errors.New("bad message, unexpected end")
+		return nil
+	}
+	out := r.buf[:n]
+	r.buf = r.buf[n:]
+	return out
+}
+
+func (r *protoReader) byte() byte {
+	if b := r.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *protoReader) bool() bool {
+	return r.byte() != 0
+}
+
+func (r *protoReader) u32() uint32 {
+	if b := r.take(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *protoReader) u64() uint64 {
+	if b := r.take(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *protoReader) bytes() []byte {
+	n := int(r.u32())
+	if b := r.take(n); b != nil {
+		return append([]byte{}, b...)
+	}
+	return nil
+}
+
+// 元素的个数不会超过剩余的数据长度
+func (r *protoReader) count() int {
+	n := int(r.u32())
+	if n > len(r.buf) {
+		r.take(-1)
+		return 0
+	}
+	return n
+}
+
+func (r *protoReader) record() Record {
+	rec := Record{}
+	for n := r.count(); n > 0 && r.err == nil; n-- {
+		rec.Cols = append(rec.Cols, string(r.bytes()))
+		val := Value{Type: r.u32(), I64: int64(r.u64())}
+		val.Str = r.bytes()
+		if !validType(val.Type) && val.Type != TYPE_NULL && r.err == nil {
+			r.err = fmt.Errorf("bad message, unknown value type: %d", val.Type)
+		}
+		rec.Vals = append(rec.Vals, val)
+	}
+	return rec
+}
+
+func (r *protoReader) done() error {
+	if r.err == nil && len(r.buf) != 0 {
+		r.err = errors.New("bad message, trailing data")
+	}
+	return r.err
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// 通过网络提供DB的操作，每个连接一个goroutine
+// 连接上最多有一个进行中的事务，连接断开时事务回滚
+// l关闭后Serve关闭所有的连接，等待进行中的请求结束、未提交的事务回滚之后才返回，之后可以安全地Close DB
+func (db *DB) Serve(l net.Listener) error {
+	var (
+		mu    sync.Mutex
+		conns = map[net.Conn]bool{}
+		wg    sync.WaitGroup
+	)
+	defer func() {
+		mu.Lock()
+		for conn := range conns {
+			conn.Close()
+		}
+		mu.Unlock()
+		wg.Wait()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		conns[conn] = true
+		mu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			db.serveConn(conn)
+			mu.Lock()
+			delete(conns, conn)
+			mu.Unlock()
+		}()
+	}
+}
+
+func (db *DB) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	st := &connState{}
+	defer func() {
+		if st.tx != nil {
+			db.Abort(st.tx)
+		}
+	}()
+
+	r := bufio.NewReader(conn)
+	for {
+		data, err := ReadFrame(r)
+		if err != nil {
+			return // closed by the client or a bad frame
+		}
+		req, err := DecodeRequest(data)
+		if err != nil {
+			return
+		}
+		res := db.handle(st, &req)
+		payload := res.Encode()
+		if len(payload) > PROTO_MAX_FRAME {
+			// 连接和事务仍然可以使用
+			res = Response{Code: RES_ERR, Msg: fmt.Sprintf("result too large: %d bytes", len(payload))}
+			payload = res.Encode()
+		}
+		if err := WriteFrame(conn, payload); err != nil {
+			return
+		}
+	}
+}
+
+// the state of a connection
+type connState struct {
+	tx   *DBTX    // nil if not in a transaction
+	rows []Record // Exec的结果中还没有返回的行
+}
+
+func (db *DB) handle(st *connState, req *Request) Response {
+	res := Response{}
+	var err error
+	tx := st.tx
+	if req.Op != OP_EXEC_NEXT {
+		st.rows = nil // 没有取完的结果被丢弃
+	}
+	switch req.Op {
+	case OP_BEGIN:
+		if tx != nil {
+			err = errors.New("already in a transaction")
+			break
+		}
+		st.tx = &DBTX{}
+		db.Begin(st.tx)
+	case OP_COMMIT, OP_ABORT:
+		if tx == nil {
+			err = errors.New("not in a transaction")
+			break
+		}
+		st.tx = nil
+		if req.Op == OP_COMMIT {
+			err = db.Commit(tx)
+		} else {
+			db.Abort(tx)
+		}
+	case OP_GET:
+		rec := req.Rec
+		if tx != nil {
+			res.Ok, err = tx.Get(req.Table, &rec)
+		} else {
+			res.Ok, err = db.Get(req.Table, &rec)
+		}
+		res.Recs = []Record{rec}
+	case OP_SET:
+		if tx != nil {
+			res.Ok, err = tx.Set(req.Table, req.Rec, req.Mode)
+		} else {
+			res.Ok, err = db.Set(req.Table, req.Rec, req.Mode)
+		}
+	case OP_DELETE:
+		if tx != nil {
+			res.Ok, err = tx.Delete(req.Table, req.Rec)
+		} else {
+			res.Ok, err = db.Delete(req.Table, req.Rec)
+		}
+	case OP_SCAN:
+		res.Recs, res.Next, res.Ok, err = db.handleScan(tx, req)
+	case OP_TABLE_NEW:
+		tdef := &TableDef{}
+		if err = json.Unmarshal(req.Data, tdef); err != nil {
+			break
+		}
+		if tx != nil {
+			err = tx.TableNew(tdef)
+		} else {
+			err = db.TableNew(tdef)
+		}
+	case OP_EXEC:
+		var result QLResult
+		if tx != nil {
+			result, err = tx.Exec(string(req.Data))
+		} else {
+			result, err = db.Exec(string(req.Data))
+		}
+		res.Affected, res.Names = result.Affected, result.Names
+		st.rows = result.Rows
+		res.Recs, res.Ok = execPage(st)
+	case OP_EXEC_NEXT:
+		if st.rows == nil {
+			err = errors.New("no pending result")
+			break
+		}
+		res.Recs, res.Ok = execPage(st)
+	default:
+		err = fmt.Errorf("unknown op: %d", req.Op)
+	}
+
+	switch {
+	case err == nil:
+		res.Code = RES_OK
+	case errors.Is(err, ErrConflict):
+		res.Code, res.Msg = RES_CONFLICT, err.Error()
+	default:
+		res.Code, res.Msg = RES_ERR, err.Error()
+	}
+	return res
+}
+
+// 范围查询的一页结果，more表示还有更多的行，下一页从next之后开始
+func (db *DB) handleScan(tx *DBTX, req *Request) (recs []Record, next Record, more bool, err error) {
+	sc := &Scanner{Cmp1: req.Cmp1, Cmp2: req.Cmp2, Key1: req.Key1, Key2: req.Key2}
+	if tx != nil {
+		err = tx.Scan(req.Table, sc)
+	} else {
+		err = db.Scan(req.Table, sc)
+	}
+	if err != nil {
+		return nil, Record{}, false, err
+	}
+	defer sc.Close()
+
+	recs, size := []Record{}, 0
+	for ; sc.Valid(); sc.Next() {
+		if len(recs) == PROTO_SCAN_ROWS || size >= PROTO_SCAN_BYTES {
+			return recs, scanKeyOf(sc, recs[len(recs)-1]), true, nil
+		}
+		rec := Record{}
+		if err := sc.Deref(&rec); err != nil {
+			return nil, Record{}, false, err
+		}
+		recs = append(recs, rec)
+		size += recordSize(rec)
+	}
+	return recs, Record{}, false, nil
+}
+
+// Exec结果的下一页，和OP_SCAN的分页一样，more表示还有更多的行
+func execPage(st *connState) (recs []Record, more bool) {
+	n, size := 0, 0
+	for n < len(st.rows) && n < PROTO_SCAN_ROWS && size < PROTO_SCAN_BYTES {
+		size += recordSize(st.rows[n])
+		n++
+	}
+	recs, st.rows = st.rows[:n], st.rows[n:]
+	if len(st.rows) == 0 {
+		st.rows = nil
+	}
+	return recs, st.rows != nil
+}
+
+// the columns of the primary key or the index used by the scanner
+func scanKeyOf(sc *Scanner, row Record) Record {
+	tdef := sc.tdef
+	cols := tdef.Cols[:tdef.PKeys]
+	if sc.indexNo >= 0 {
+		cols = tdef.Indexes[sc.indexNo]
+	}
+	key := Record{}
+	for _, col := range cols {
+		key.Cols = append(key.Cols, col)
+		key.Vals = append(key.Vals, *row.Get(col))
+	}
+	return key
+}
@@ -11,20 +11,64 @@ const (
 
 	HEADLEN = 4
 
-	BTREE_PAGE_SIZE    = 4096
-	BTREE_MAX_KEY_SIZE = 1000
-	BTREE_MAX_VAL_SIZE = 3000
+	BTREE_PAGE_SIZE    = 4096 // the default page size
+	BTREE_MAX_KEY_SIZE = 1000 // the max inline key of the default page size
+	BTREE_MAX_VAL_SIZE = 3000 // the max inline value of the default page size
+
+	// 节点中的offset是uint16，插入时的临时节点有3个page，所以page最大16K
+	// 64K的page需要更宽的offset，是另一种文件格式，目前不支持
+	BTREE_MIN_PAGE_SIZE = 4096
+	BTREE_MAX_PAGE_SIZE = 16384
+
+	BTREE_KEY_LIMIT = 64 << 10 // the max key, ErrKeyTooLarge
+	BTREE_VAL_LIMIT = 16 << 20 // the max value, ErrValueTooLarge
 )
 
-func init() {
-	node1Max := HEADLEN + 8 + 2 + 4 + BTREE_MAX_KEY_SIZE + BTREE_MAX_VAL_SIZE
-	assert(node1Max <= BTREE_PAGE_SIZE, "init check fail, node1Max exceed page max")
+// 由page size决定的各种大小，page size在创建文件时选择，记录在master page中
+type pageLayout struct {
+	size       int  // the page size
+	checksum   bool // the last PAGE_CHECKSUM_SIZE bytes of each page is the checksum
+	space      int  // the max size of a node, the page without the checksum
+	maxKey     int  // the max inline key, longer keys are stored in overflow pages
+	maxVal     int  // the max inline value, larger values are stored in overflow pages
+	keyPrefix  int  // the prefix of a long key stored in the node
+	leafRawMax int  // the max leaf size without the common prefix
+	ovCap      int  // the data size of an overflow page
+	flCap      int  // the number of items in a free list node
+}
+
+func newPageLayout(size int, checksum bool) pageLayout {
+	assert(checkPageSize(size) == nil, fmt.Sprintf("function:newPageLayout, bad page size: %d", size))
+	l := pageLayout{size: size, checksum: checksum, space: size}
+	if checksum {
+		l.space -= PAGE_CHECKSUM_SIZE
+	}
+	l.maxKey = BTREE_MAX_KEY_SIZE * size / BTREE_PAGE_SIZE
+	l.maxVal = BTREE_MAX_VAL_SIZE * size / BTREE_PAGE_SIZE
+	l.keyPrefix = l.maxKey - 16
+	l.leafRawMax = 2 * size
+	l.ovCap = l.space - OVERFLOW_HEADER
+	l.flCap = (l.space - FREE_LIST_HEADER) / 16
+
+	node1Max := HEADLEN + 8 + 2 + 4 + l.maxKey + l.maxVal
+	assert(node1Max <= l.space, "init check fail, node1Max exceed page max")
+	return l
+}
+
+var defaultLayout = newPageLayout(BTREE_PAGE_SIZE, true)
+
+// 只支持4K到16K之间2的幂，原因见BTREE_MAX_PAGE_SIZE
+func checkPageSize(size int) error {
+	if size < BTREE_MIN_PAGE_SIZE || size > BTREE_MAX_PAGE_SIZE || size&(size-1) != 0 {
+		return fmt.Errorf("bad page size: %d, must be a power of 2 in [%d, %d]", size, BTREE_MIN_PAGE_SIZE, BTREE_MAX_PAGE_SIZE)
+	}
+	return nil
 }
 
 /*
 *
 node format
-pointers 指向下级节点 若叶子结点 则为空 但是有占位空间
+pointers 指向下级节点 若叶子结点 则指向大的值的overflow page(见btree_overflow.go)，普通的值为空
 offset kvPair[1:n]的偏移量 0就是第一个kv不用存储 注意这里偏移量总数还是nkeys，在修改文件时，idx的kv需要修改idx+1位置的offset
 | type | nkeys | pointers   | offsets    | key-values
 | 2B   | 2B    | nkeys * 8B | nkeys * 2B | ...
@@ -32,7 +76,15 @@ offset kvPair[1:n]的偏移量 0就是第一个kv不用存储 注意这里偏移
 format of the KV pair
 | klen | vlen | key | val |
 | 2B   | 2B   | ... | ... |
+
+klen的最高位BNODE_KEY_LONG表示超过maxKey的长key(见btree_overflow.go)
+type的最高位BNODE_FMT_PREFIX表示叶子节点的header后面有key的公共前缀(见node_prefix.go)
 */
+const (
+	BNODE_KEY_LONG   = 0x8000
+	BNODE_FMT_PREFIX = 0x8000
+)
+
 type BNode struct {
 	data []byte // dumped to the disk
 }
@@ -41,7 +93,7 @@ type BNode struct {
 
 // type and number of keys
 func (node BNode) btype() uint16 {
-	return binary.LittleEndian.Uint16(node.data)
+	return binary.LittleEndian.Uint16(node.data) &^ BNODE_FMT_PREFIX
 }
 
 func (node BNode) nkeys() uint16 {
@@ -56,14 +108,14 @@ func (node BNode) setHeader(btype uint16, nkeys uint16) {
 // ptr
 func (node BNode) getPtr(idx uint16) uint64 {
 	assert(idx < node.nkeys(), fmt.Sprintf("function:getPtr, idx exceed node max key number, idx: %v, total key: %v", idx, node.nkeys()))
-	posStart := HEADLEN + 8*idx
+	posStart := node.headLen() + 8*idx
 	return binary.LittleEndian.Uint64(node.data[posStart:])
 }
 
 func (node BNode) setPtr(idx uint16, val uint64) {
 	assert(idx <= node.nkeys(), "function:getPtr, idx exceed node max key number")
 
-	posStart := HEADLEN + 8*idx
+	posStart := node.headLen() + 8*idx
 	binary.LittleEndian.PutUint64(node.data[posStart:], val)
 }
 
@@ -73,7 +125,7 @@ func offsetPos(node BNode, idx uint16) uint16 {
 
 	assert(1 <= idx && idx <= nkeys, fmt.Sprintf("function:offsetPos, idx out of range [1:n], idx: %v, nkey: %v", idx, node.nkeys()))
 	// idx==0不用存储，所以当idx==1时，在offsets中相对偏移是1-1=0
-	return HEADLEN + 8*node.nkeys() + 2*(idx-1)
+	return node.headLen() + 8*node.nkeys() + 2*(idx-1)
 }
 
 func (node BNode) getOffset(idx uint16) uint16 {
@@ -91,20 +143,42 @@ func (node BNode) setOffset(idx uint16, offset uint16) {
 func (node BNode) kvPos(idx uint16) uint16 {
 	// 允许获取n位置的position 即当前数据占的空间末尾位置
 	assert(idx <= node.nkeys(), fmt.Sprintf("function:kvPos, idx out of max number of keys, idx: %v, total: %v", idx, node.nkeys()))
-	return HEADLEN + 8*node.nkeys() + 2*node.nkeys() + node.getOffset(idx)
+	return node.headLen() + 8*node.nkeys() + 2*node.nkeys() + node.getOffset(idx)
 }
 
+// the stored key, 有公共前缀时只是key的后半部分
+func (node BNode) getSuffix(idx uint16) []byte {
+	assert(idx < node.nkeys(), fmt.Sprintf("function:getSuffix, idx out of max number of keys, idx: %v, total: %v", idx, node.nkeys()))
+	posStart := node.kvPos(idx)
+	klen := binary.LittleEndian.Uint16(node.data[posStart:]) &^ BNODE_KEY_LONG
+	return node.data[posStart+4:][:klen]
+}
+
+// the complete stored key, 有公共前缀时是新分配的
 func (node BNode) getKey(idx uint16) []byte {
-	assert(idx < node.nkeys(), fmt.Sprintf("function:getKey, idx out of max number of keys, idx: %v, total: %v", idx, node.nkeys()))
+	suffix := node.getSuffix(idx)
+	prefix := node.prefix()
+	if len(prefix) == 0 {
+		return suffix
+	}
+	return append(append(make([]byte, 0, len(prefix)+len(suffix)), prefix...), suffix...)
+}
+
+func (node BNode) keyLong(idx uint16) bool {
+	posStart := node.kvPos(idx)
+	return binary.LittleEndian.Uint16(node.data[posStart:])&BNODE_KEY_LONG != 0
+}
+
+func (node BNode) setKeyLong(idx uint16) {
 	posStart := node.kvPos(idx)
 	klen := binary.LittleEndian.Uint16(node.data[posStart:])
-	return node.data[posStart+4:][:klen]
+	binary.LittleEndian.PutUint16(node.data[posStart:], klen|BNODE_KEY_LONG)
 }
 
 func (node BNode) getVal(idx uint16) []byte {
 	assert(idx < node.nkeys(), fmt.Sprintf("function:getVal, idx out of max number of keys, idx: %v, total: %v", idx, node.nkeys()))
 	posStart := node.kvPos(idx)
-	klen := binary.LittleEndian.Uint16(node.data[posStart:])
+	klen := binary.LittleEndian.Uint16(node.data[posStart:]) &^ BNODE_KEY_LONG
 	vlen := binary.LittleEndian.Uint16(node.data[posStart+2:])
 	return node.data[posStart+4+klen:][:vlen]
 }
@@ -115,7 +189,7 @@ func (node BNode) nbytes() uint16 {
 
 // for debug
 func (node BNode) String() string {
-	header := fmt.Sprintf("raw data: %v, \nbtype: %v, nkeys: %v\n", node.data[:node.nbytes()], node.btype(), node.nkeys())
+	header := fmt.Sprintf("raw data: %v, \nbtype: %v, nkeys: %v, prefix: %q\n", node.data[:node.nbytes()], node.btype(), node.nkeys(), node.prefix())
 
 	pointer, offset, kvpari := "", "", ""
 	for i := uint16(0); i < node.nkeys(); i++ {
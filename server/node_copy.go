@@ -1,6 +1,7 @@
 package server
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 )
@@ -13,6 +14,17 @@ func nodeAppendRange(dst, src BNode, dstStartIdx, srcStartIdx uint16, n uint16)
 	assert(srcStartIdx+n <= src.nkeys(), fmt.Sprintf("function:nodeAppendRange, n exceed max key number, n: %v, srcStartIdx: %v, src.nkey: %v", n, srcStartIdx, src.nkeys()))
 	assert(dstStartIdx+n <= dst.nkeys(), fmt.Sprintf("function:nodeAppendRange, n exceed max key number, n: %v, dstStartIdx: %v, dst.nkey: %v", n, dstStartIdx, dst.nkeys()))
 
+	// 公共前缀不同时需要逐个重新写入key
+	if !bytes.Equal(dst.prefix(), src.prefix()) {
+		for i := uint16(0); i < n; i++ {
+			nodeAppendKV(dst, dstStartIdx+i, src.getPtr(srcStartIdx+i), src.getKey(srcStartIdx+i), src.getVal(srcStartIdx+i))
+			if src.keyLong(srcStartIdx + i) {
+				dst.setKeyLong(dstStartIdx + i)
+			}
+		}
+		return
+	}
+
 	// copy pointer
 	for i := uint16(0); i < n; i++ {
 		dst.setPtr(dstStartIdx+i, src.getPtr(srcStartIdx+i))
@@ -39,7 +51,12 @@ func nodeAppendRange(dst, src BNode, dstStartIdx, srcStartIdx uint16, n uint16)
 	copy(dst.data[dst.kvPos(dstStartIdx):], src.data[begin:end])
 }
 
+// key是完整的key，写入时去掉dst的公共前缀
 func nodeAppendKV(dst BNode, idx uint16, ptr uint64, key, val []byte) {
+	prefix := dst.prefix()
+	assert(bytes.HasPrefix(key, prefix), fmt.Sprintf("function:nodeAppendKV, key %q without the prefix %q", key, prefix))
+	key = key[len(prefix):]
+
 	// ptrs
 	dst.setPtr(idx, ptr)
 
@@ -58,13 +75,15 @@ func nodeAppendKV(dst BNode, idx uint16, ptr uint64, key, val []byte) {
 	dst.setOffset(idx+1, offset)
 }
 
-func nodeUpdateKV(new BNode, idx uint16, ptr uint64, key, val []byte) {
+// 只替换值，idx位置的key已经拷贝过来了
+func nodeUpdateKV(new BNode, idx uint16, ptr uint64, val []byte) {
 	new.setPtr(idx, ptr)
 
 	pos := new.kvPos(idx)
+	klen := binary.LittleEndian.Uint16(new.data[pos:]) &^ BNODE_KEY_LONG
 	binary.LittleEndian.PutUint16(new.data[pos+2:], uint16(len(val)))
-	copy(new.data[pos+4+uint16(len(key)):], val)
+	copy(new.data[pos+4+klen:], val)
 
 	// the offset of the next key
-	new.setOffset(idx+1, new.getOffset(idx)+4+uint16(len(key)+len(val)))
+	new.setOffset(idx+1, new.getOffset(idx)+4+klen+uint16(len(val)))
 }
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+/*
+*
+叶子节点中的key是有序的，同一个表或索引的key有相同的前缀，公共前缀只保存一次:
+
+	| type | nkeys | plen | prefix | pointers   | offsets    | key-values
+	| 2B   | 2B    | 2B   | plen   | nkeys * 8B | nkeys * 2B | ...
+
+type中的BNODE_FMT_PREFIX表示这种格式，KV pair中只保存key去掉前缀后的部分。
+没有这个标志的节点和原来的格式一样，不能节省空间时仍然使用原来的格式。
+公共前缀只取决于第一个和最后一个key，每次生成新的叶子节点时重新计算，只在能节省空间时使用。
+
+压缩后一个page能放下更多的key，但解压后的大小不能超过leafRawMax(两个page)，
+这样插入时的临时节点和分裂的结果都有上限
+*/
+
+func (node BNode) headLen() uint16 {
+	if binary.LittleEndian.Uint16(node.data)&BNODE_FMT_PREFIX == 0 {
+		return HEADLEN
+	}
+	plen := binary.LittleEndian.Uint16(node.data[HEADLEN:])
+	if int(HEADLEN+2+plen) > len(node.data) {
+		panic(errCorrupt("bad prefix size: %d", plen))
+	}
+	return HEADLEN + 2 + plen
+}
+
+// the common prefix of the keys, nil for the old format
+func (node BNode) prefix() []byte {
+	end := node.headLen()
+	if end == HEADLEN {
+		return nil
+	}
+	return node.data[HEADLEN+2 : end]
+}
+
+// 需要在setHeader之后、写入任何KV之前调用
+func (node BNode) setPrefix(prefix []byte) {
+	if len(prefix) == 0 {
+		return
+	}
+	btype := binary.LittleEndian.Uint16(node.data)
+	binary.LittleEndian.PutUint16(node.data, btype|BNODE_FMT_PREFIX)
+	binary.LittleEndian.PutUint16(node.data[HEADLEN:], uint16(len(prefix)))
+	copy(node.data[HEADLEN+2:], prefix)
+}
+
+// 生成一个新节点的header，叶子节点的公共前缀由第一个和最后一个key决定
+func nodeSetHeaderKeys(tree *BTree, node BNode, btype uint16, nkeys uint16, first, last []byte) {
+	node.setHeader(btype, nkeys)
+	if btype == BNODE_LEAF {
+		plen := leafPrefixLen(tree, int(nkeys), commonLen(first, last))
+		node.setPrefix(first[:plen])
+	}
+}
+
+// 使用前缀时多了plen和prefix本身，其他n-1个key各节省plen字节
+// 长key保存的是前keyPrefix字节加上overflow page的指针，指针部分是无序的，不能作为公共前缀
+func leafPrefixLen(tree *BTree, nkeys int, lcp int) int {
+	lcp = min(lcp, tree.layout.keyPrefix)
+	if (nkeys-1)*lcp <= 2 {
+		return 0
+	}
+	return lcp
+}
+
+func commonLen(a, b []byte) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// the size without the common prefix
+func nodeRawBytes(node BNode) int {
+	return int(node.nbytes()) - int(node.headLen()-HEADLEN) + int(node.nkeys())*len(node.prefix())
+}
+
+// 能否写入一个page
+func nodeFits(tree *BTree, node BNode) bool {
+	return tree.layout.fits(int(node.nbytes()), nodeRawBytes(node))
+}
+
+func (l pageLayout) fits(size int, raw int) bool {
+	return size <= l.space && raw <= l.leafRawMax
+}
+
+// the size of a new node made of the KV pairs [start, end), 和nodeSetHeaderKeys使用相同的前缀
+func nodeRangeBytes(tree *BTree, node BNode, start, end uint16) (size int, raw int) {
+	n := int(end - start)
+	plen := len(node.prefix())
+	raw = HEADLEN + 10*n + int(node.getOffset(end)-node.getOffset(start)) + n*plen
+	if node.btype() != BNODE_LEAF || n == 0 {
+		return raw, raw
+	}
+	// 这个范围的key都以node的前缀开头
+	lcp := plen + commonLen(node.getSuffix(start), node.getSuffix(end-1))
+	return nodeBytesWithPrefix(raw, n, leafPrefixLen(tree, n, lcp)), raw
+}
+
+// the size of the node made of the left and the right node
+func nodeMergedBytes(tree *BTree, left, right BNode) (size int, raw int) {
+	n := int(left.nkeys() + right.nkeys())
+	raw = nodeRawBytes(left) + nodeRawBytes(right) - HEADLEN
+	if left.btype() != BNODE_LEAF || n == 0 {
+		return raw, raw
+	}
+	first, last := nodeMergedEnds(left, right)
+	return nodeBytesWithPrefix(raw, n, leafPrefixLen(tree, n, commonLen(first, last))), raw
+}
+
+func nodeBytesWithPrefix(raw int, nkeys int, plen int) int {
+	if plen == 0 {
+		return raw
+	}
+	return raw + 2 + plen - nkeys*plen
+}
+
+// the first and the last key of the merged node, 其中一个节点可能是空的
+func nodeMergedEnds(left, right BNode) ([]byte, []byte) {
+	keys := [][]byte{}
+	if left.nkeys() > 0 {
+		keys = append(keys, left.getKey(0), left.getKey(left.nkeys()-1))
+	}
+	if right.nkeys() > 0 {
+		keys = append(keys, right.getKey(0), right.getKey(right.nkeys()-1))
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	return keys[0], keys[len(keys)-1]
+}
+
+// compare prefix+suffix with the key, 不需要拼接出完整的key
+func cmpPrefixed(prefix, suffix, key []byte) int {
+	n := min(len(prefix), len(key))
+	if r := bytes.Compare(prefix, key[:n]); r != 0 {
+		return r
+	}
+	return bytes.Compare(suffix, key[n:])
+}
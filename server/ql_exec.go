@@ -0,0 +1,417 @@
+package server
+
+import "fmt"
+
+// the result of a statement
+type QLResult struct {
+	Names    []string // the output columns of SELECT
+	Rows     []Record
+	Affected uint64 // the number of rows changed by INSERT, UPDATE and DELETE
+}
+
+// 执行一个语句，SELECT在读事务中执行，其他语句在写事务中执行，冲突时重试
+func (db *DB) Exec(query string) (QLResult, error) {
+	stmt, err := ParseStmt(query)
+	if err != nil {
+		return QLResult{}, err
+	}
+
+	if req, ok := stmt.(*QLSelect); ok {
+		tx := DBReader{}
+		db.BeginRead(&tx)
+		defer db.EndRead(&tx)
+		return qlSelect(req, &tx)
+	}
+
+	res := QLResult{}
+	err = db.update(func(tx *DBTX) (err error) {
+		res, err = qlExec(stmt, tx)
+		return err
+	})
+	return res, err
+}
+
+func (tx *DBTX) Exec(query string) (QLResult, error) {
+	stmt, err := ParseStmt(query)
+	if err != nil {
+		return QLResult{}, err
+	}
+	return qlExec(stmt, tx)
+}
+
+func qlExec(stmt interface{}, tx *DBTX) (QLResult, error) {
+	switch req := stmt.(type) {
+	case *QLSelect:
+		return qlSelect(req, &tx.DBReader)
+	case *QLInsert:
+		return qlInsert(req, tx)
+	case *QLUpdate:
+		return qlUpdate(req, tx)
+	case *QLDelete:
+		return qlDelete(req, tx)
+	case *QLCreateTable:
+		return QLResult{}, tx.TableNew(&req.Def)
+	default:
+		panic(fmt.Sprintf("qlExec, unknown statement: %T", stmt))
+	}
+}
+
+func qlSelect(req *QLSelect, tx *DBReader) (QLResult, error) {
+	tdef, err := getTableDef(tx, req.Table)
+	if err != nil {
+		return QLResult{}, err
+	}
+
+	// expand *
+	res := QLResult{}
+	exprs := []QLNode{}
+	for i, expr := range req.Output {
+		if expr.Type != QL_STAR {
+			res.Names = append(res.Names, req.Names[i])
+			exprs = append(exprs, expr)
+			continue
+		}
+		for _, col := range tdef.Cols {
+			res.Names = append(res.Names, col)
+			exprs = append(exprs, QLNode{Value: Value{Type: QL_SYM, Str: []byte(col)}})
+		}
+	}
+
+	err = qlScan(&req.QLScan, tx, tdef, func(row Record) error {
+		out := Record{Cols: res.Names}
+		for _, expr := range exprs {
+			val, err := qlEval(tdef, row, expr)
+			if err != nil {
+				return err
+			}
+			out.Vals = append(out.Vals, val)
+		}
+		res.Rows = append(res.Rows, out)
+		return nil
+	})
+	return res, err
+}
+
+func qlInsert(req *QLInsert, tx *DBTX) (QLResult, error) {
+	tdef, err := getTableDef(&tx.DBReader, req.Table)
+	if err != nil {
+		return QLResult{}, err
+	}
+
+	res := QLResult{}
+	for _, exprs := range req.Values {
+		// 列的顺序和表定义一致
+		row := Record{Cols: tdef.Cols, Vals: make([]Value, len(tdef.Cols))}
+		for i, name := range req.Names {
+			idx := colIndex(tdef, name)
+			if idx < 0 {
+				return QLResult{}, fmt.Errorf("unknown column: %s", name)
+			}
+			if row.Vals[idx].Type != TYPE_ERROR {
+				return QLResult{}, fmt.Errorf("duplicated column: %s", name)
+			}
+			val, err := qlEval(nil, Record{}, exprs[i])
+			if err != nil {
+				return QLResult{}, err
+			}
+			if val, err = qlCheckType(tdef, idx, exprs[i], val); err != nil {
+				return QLResult{}, err
+			}
+			row.Vals[idx] = val
+		}
+		// 省略的列是NULL
+		for idx := range row.Vals {
+			switch {
+			case row.Vals[idx].Type != TYPE_ERROR:
+			case tdef.nullable(idx):
+				row.Vals[idx] = Value{Type: TYPE_NULL}
+			default:
+				return QLResult{}, fmt.Errorf("insert into %s, missing column: %s", req.Table, tdef.Cols[idx])
+			}
+		}
+
+		updated, err := tx.Set(req.Table, row, req.Mode)
+		if err != nil {
+			return QLResult{}, err
+		}
+		if !updated && req.Mode == MODE_INSERT_ONLY {
+			return QLResult{}, fmt.Errorf("insert into %s, duplicated primary key", req.Table)
+		}
+		if updated {
+			res.Affected++
+		}
+	}
+	return res, nil
+}
+
+func qlUpdate(req *QLUpdate, tx *DBTX) (QLResult, error) {
+	tdef, err := getTableDef(&tx.DBReader, req.Table)
+	if err != nil {
+		return QLResult{}, err
+	}
+	for i, name := range req.Names {
+		idx := colIndex(tdef, name)
+		switch {
+		case idx < 0:
+			return QLResult{}, fmt.Errorf("unknown column: %s", name)
+		case idx < tdef.PKeys:
+			return QLResult{}, fmt.Errorf("cannot update the primary key column: %s", name)
+		case indexOf(req.Names[:i], name) >= 0:
+			return QLResult{}, fmt.Errorf("duplicated column: %s", name)
+		}
+	}
+
+	// 先找出所有要修改的行，SET中的表达式使用修改前的值
+	rows := []Record{}
+	err = qlScan(&req.QLScan, &tx.DBReader, tdef, func(row Record) error {
+		vals := append([]Value{}, row.Vals...)
+		for i, name := range req.Names {
+			val, err := qlEval(tdef, row, req.Values[i])
+			if err != nil {
+				return err
+			}
+			idx := colIndex(tdef, name)
+			if val, err = qlCheckType(tdef, idx, req.Values[i], val); err != nil {
+				return err
+			}
+			vals[idx] = val
+		}
+		rows = append(rows, Record{Cols: row.Cols, Vals: vals})
+		return nil
+	})
+	if err != nil {
+		return QLResult{}, err
+	}
+
+	res := QLResult{}
+	for _, row := range rows {
+		updated, err := tx.Update(req.Table, row)
+		if err != nil {
+			return QLResult{}, err
+		}
+		if updated {
+			res.Affected++
+		}
+	}
+	return res, nil
+}
+
+func qlDelete(req *QLDelete, tx *DBTX) (QLResult, error) {
+	tdef, err := getTableDef(&tx.DBReader, req.Table)
+	if err != nil {
+		return QLResult{}, err
+	}
+
+	keys := []Record{}
+	err = qlScan(&req.QLScan, &tx.DBReader, tdef, func(row Record) error {
+		keys = append(keys, Record{Cols: row.Cols[:tdef.PKeys], Vals: row.Vals[:tdef.PKeys]})
+		return nil
+	})
+	if err != nil {
+		return QLResult{}, err
+	}
+
+	res := QLResult{}
+	for _, key := range keys {
+		deleted, err := tx.Delete(req.Table, key)
+		if err != nil {
+			return QLResult{}, err
+		}
+		if deleted {
+			res.Affected++
+		}
+	}
+	return res, nil
+}
+
+// 常量转换成列的类型，可以为NULL的列接受NULL
+func qlCheckType(tdef *TableDef, idx int, expr QLNode, val Value) (Value, error) {
+	if val.Type == TYPE_NULL && tdef.nullable(idx) {
+		return val, nil
+	}
+	val = qlCoerce(expr, val, tdef.Types[idx])
+	if val.Type != tdef.Types[idx] {
+		return Value{}, fmt.Errorf("column %s expects %s, got %s", tdef.Cols[idx], typeName(tdef.Types[idx]), typeName(val.Type))
+	}
+	return val, nil
+}
+
+// 遍历满足WHERE的行，再按照OFFSET和LIMIT截取
+func qlScan(req *QLScan, tx *DBReader, tdef *TableDef, fn func(row Record) error) error {
+	sc := Scanner{}
+	qlPlan(req, tdef, &sc)
+	if err := dbScan(tx, tdef, &sc); err != nil {
+		return err
+	}
+
+	skipped, n := int64(0), int64(0)
+	for ; n < req.Limit && sc.Valid(); sc.Next() {
+		row := Record{}
+		if err := sc.Deref(&row); err != nil {
+			return err
+		}
+		if req.Where.Type != QL_UNINIT {
+			ok, err := qlIsTrue(tdef, row, req.Where)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+		}
+		if skipped < req.Offset {
+			skipped++
+			continue
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+		n++
+	}
+	return nil
+}
+
+/*
+*
+从WHERE中选择主键或者一个索引的范围，WHERE仍然会作为过滤条件检查每一行。
+只使用AND连接的 列 op 常量 形式的条件，一个索引可以使用前几列的等值条件，
+加上下一列的范围条件，匹配的列最多的索引胜出:
+
+	WHERE a = 1 AND b > 2 AND b <= 5  =>  (a, b) > (1, 2) AND (a, b) <= (1, 5)
+*/
+func qlPlan(req *QLScan, tdef *TableDef, sc *Scanner) {
+	conds := []qlCond{}
+	for _, term := range qlSplitAnd(req.Where, nil) {
+		if cond, ok := qlMakeCond(tdef, term); ok {
+			conds = append(conds, cond)
+		}
+	}
+
+	candidates := append([][]string{tdef.Cols[:tdef.PKeys]}, tdef.Indexes...)
+	best := -1
+	*sc = Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE}
+	for _, cols := range candidates {
+		key := Record{}
+		for _, col := range cols {
+			cond, ok := qlFindCond(conds, col, 0)
+			if !ok {
+				break
+			}
+			key.Cols = append(key.Cols, col)
+			key.Vals = append(key.Vals, cond.val)
+		}
+		score := 2 * len(key.Cols)
+
+		// the range of the next column
+		key1 := Record{Cols: key.Cols, Vals: key.Vals}
+		key2 := Record{Cols: key.Cols, Vals: key.Vals}
+		cmp1, cmp2 := CMP_GE, CMP_LE
+		if len(key.Cols) < len(cols) {
+			col := cols[len(key.Cols)]
+			if cond, ok := qlFindCond(conds, col, +1); ok {
+				key1 = qlAppendKey(key, col, cond.val)
+				cmp1 = cond.cmp
+				score++
+			}
+			if cond, ok := qlFindCond(conds, col, -1); ok {
+				key2 = qlAppendKey(key, col, cond.val)
+				cmp2 = cond.cmp
+				score++
+			}
+		}
+		if score <= best {
+			continue
+		}
+		best = score
+		*sc = Scanner{Cmp1: cmp1, Cmp2: cmp2, Key1: key1, Key2: key2}
+	}
+}
+
+// the condition: col cmp val
+type qlCond struct {
+	col string
+	cmp int // CMP_??, 0 for =
+	val Value
+}
+
+func qlSplitAnd(node QLNode, out []QLNode) []QLNode {
+	switch node.Type {
+	case QL_UNINIT:
+		return out
+	case QL_AND:
+		out = qlSplitAnd(node.Kids[0], out)
+		return qlSplitAnd(node.Kids[1], out)
+	default:
+		return append(out, node)
+	}
+}
+
+func qlMakeCond(tdef *TableDef, node QLNode) (qlCond, bool) {
+	cmp := 0
+	switch node.Type {
+	case QL_CMP_EQ:
+	case QL_CMP_GE:
+		cmp = CMP_GE
+	case QL_CMP_GT:
+		cmp = CMP_GT
+	case QL_CMP_LT:
+		cmp = CMP_LT
+	case QL_CMP_LE:
+		cmp = CMP_LE
+	default:
+		return qlCond{}, false
+	}
+
+	sym, expr := node.Kids[0], node.Kids[1]
+	if sym.Type != QL_SYM {
+		// 1 < a => a > 1
+		sym, expr, cmp = expr, sym, -cmp
+	}
+	if sym.Type != QL_SYM || qlHasSym(expr) {
+		return qlCond{}, false
+	}
+	idx := colIndex(tdef, string(sym.Str))
+	if idx < 0 {
+		return qlCond{}, false
+	}
+	val, err := qlEval(nil, Record{}, expr)
+	if err == nil {
+		val = qlCoerce(expr, val, tdef.Types[idx])
+	}
+	if err != nil || val.Type != tdef.Types[idx] {
+		return qlCond{}, false // 交给过滤条件报错
+	}
+	return qlCond{col: string(sym.Str), cmp: cmp, val: val}, true
+}
+
+// dir: 0 for =, > 0 for the lower bound, < 0 for the upper bound
+func qlFindCond(conds []qlCond, col string, dir int) (qlCond, bool) {
+	for _, cond := range conds {
+		if cond.col != col {
+			continue
+		}
+		if (dir == 0 && cond.cmp == 0) || (dir > 0 && cond.cmp > 0) || (dir < 0 && cond.cmp < 0) {
+			return cond, true
+		}
+	}
+	return qlCond{}, false
+}
+
+func qlAppendKey(key Record, col string, val Value) Record {
+	return Record{
+		Cols: append(append([]string{}, key.Cols...), col),
+		Vals: append(append([]Value{}, key.Vals...), val),
+	}
+}
+
+func qlHasSym(node QLNode) bool {
+	if node.Type == QL_SYM {
+		return true
+	}
+	for _, kid := range node.Kids {
+		if qlHasSym(kid) {
+			return true
+		}
+	}
+	return false
+}
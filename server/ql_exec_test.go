@@ -0,0 +1,247 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func mustExec(t *testing.T, db *DB, query string) QLResult {
+	res, err := db.Exec(query)
+	if err != nil {
+		t.Fatalf("fail to exec %q, err: %s", query, err)
+	}
+	return res
+}
+
+// the rows of a result as strings, for comparison
+func qlRows(res QLResult) []string {
+	out := []string{}
+	for _, row := range res.Rows {
+		s := ""
+		for i, val := range row.Vals {
+			if i > 0 {
+				s += ","
+			}
+			switch val.Type {
+			case TYPE_INT64:
+				s += fmt.Sprint(val.I64)
+			case TYPE_FLOAT64:
+				s += fmt.Sprint(val.Float64())
+			case TYPE_BOOL:
+				s += fmt.Sprint(val.Bool())
+			case TYPE_TIMESTAMP:
+				s += val.Time().UTC().Format(time.RFC3339)
+			case TYPE_UINT64:
+				s += fmt.Sprint(val.Uint64())
+			case TYPE_NULL:
+				s += "NULL"
+			default:
+				s += string(val.Str)
+			}
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+func TestQLExec(t *testing.T) {
+	db := newTestDB(t)
+	mustExec(t, db, "create table users (id int64, name bytes, age int64, index (name), primary key (id))")
+	res := mustExec(t, db, "insert into users (id, name, age) values (1, 'alice', 30), (2, 'bob', 25), (3, 'carol', 35)")
+	if res.Affected != 3 {
+		t.Fatalf("wrong affected rows: %d", res.Affected)
+	}
+	if _, err := db.Exec("insert into users (id, name, age) values (1, 'dup', 0)"); err == nil {
+		t.Fatalf("expect an error on duplicated primary key")
+	}
+	if _, err := db.Exec("insert into users (id, name, age) values ('1', 'x', 0)"); err == nil {
+		t.Fatalf("expect a type error")
+	}
+
+	cases := []struct {
+		query string
+		want  []string
+	}{
+		{"select * from users", []string{"1,alice,30", "2,bob,25", "3,carol,35"}},
+		{"select name, id from users where id >= 2", []string{"bob,2", "carol,3"}},
+		{"select id from users where name = 'bob'", []string{"2"}},
+		{"select id from users where age > 26 and age < 40", []string{"1", "3"}},
+		{"select id from users where 2 > id or name = 'carol'", []string{"1", "3"}},
+		{"select id from users limit 1 offset 1", []string{"2"}},
+	}
+	for _, c := range cases {
+		if got := qlRows(mustExec(t, db, c.query)); !reflect.DeepEqual(got, c.want) {
+			t.Fatalf("wrong result of %q, got: %v, expected: %v", c.query, got, c.want)
+		}
+	}
+
+	res = mustExec(t, db, "update users set name = 'bobby', age = 26 where id = 2")
+	if res.Affected != 1 {
+		t.Fatalf("wrong affected rows: %d", res.Affected)
+	}
+	if got := qlRows(mustExec(t, db, "select id, age from users where name = 'bobby'")); !reflect.DeepEqual(got, []string{"2,26"}) {
+		t.Fatalf("update is not applied to the index, got: %v", got)
+	}
+	mustExec(t, db, "update users set age = age + 1, name = name + '!' where age > 30")
+	if got := qlRows(mustExec(t, db, "select name, age * 2 as double from users where id = 3")); !reflect.DeepEqual(got, []string{"carol!,72"}) {
+		t.Fatalf("wrong computed values, got: %v", got)
+	}
+	if _, err := db.Exec("update users set age = name where id = 2"); err == nil {
+		t.Fatalf("expect a type error")
+	}
+	if _, err := db.Exec("update users set id = 5 where id = 2"); err == nil {
+		t.Fatalf("expect an error on updating the primary key")
+	}
+
+	res = mustExec(t, db, "delete from users where id < 3")
+	if res.Affected != 2 {
+		t.Fatalf("wrong affected rows: %d", res.Affected)
+	}
+	if got := qlRows(mustExec(t, db, "select name from users")); !reflect.DeepEqual(got, []string{"carol!"}) {
+		t.Fatalf("wrong rows after delete, got: %v", got)
+	}
+}
+
+func TestQLPlan(t *testing.T) {
+	tdef := &TableDef{
+		Name:    "t",
+		Types:   []uint32{TYPE_INT64, TYPE_INT64, TYPE_BYTES},
+		Cols:    []string{"a", "b", "c"},
+		PKeys:   1,
+		Indexes: [][]string{{"c", "b", "a"}},
+	}
+	plan := func(where string) Scanner {
+		stmt, err := ParseStmt("select a from t where " + where)
+		if err != nil {
+			t.Fatalf("fail to parse, err: %s", err)
+		}
+		sc := Scanner{}
+		qlPlan(&stmt.(*QLSelect).QLScan, tdef, &sc)
+		return sc
+	}
+
+	sc := plan("a > 1 and a <= 5")
+	if !reflect.DeepEqual(sc.Key1.Cols, []string{"a"}) || sc.Cmp1 != CMP_GT || sc.Cmp2 != CMP_LE {
+		t.Fatalf("wrong primary key range: %+v", sc)
+	}
+	sc = plan("c = 'x' and 3 < b and a > 1")
+	if !reflect.DeepEqual(sc.Key1.Cols, []string{"c", "b"}) || sc.Cmp1 != CMP_GT || !reflect.DeepEqual(sc.Key2.Cols, []string{"c"}) {
+		t.Fatalf("wrong index range: %+v", sc)
+	}
+	sc = plan("b = 1 or a = 1")
+	if len(sc.Key1.Cols) != 0 || len(sc.Key2.Cols) != 0 {
+		t.Fatalf("expect a full scan: %+v", sc)
+	}
+}
+
+// key可以作为列名
+func TestQLKeyColumn(t *testing.T) {
+	db := newTestDB(t)
+	mustExec(t, db, "create table kv (key bytes, val bytes, primary key (key))")
+	mustExec(t, db, "insert into kv (key, val) values ('a', '1'), ('b', '2')")
+	mustExec(t, db, "update kv set val = val + key where key = 'b'")
+	if got := qlRows(mustExec(t, db, "select key, val from kv where key >= 'b'")); !reflect.DeepEqual(got, []string{"b,2b"}) {
+		t.Fatalf("wrong result, got: %v", got)
+	}
+}
+
+// float64, bool, uint64和timestamp的常量和转换
+func TestQLTypes(t *testing.T) {
+	db := newTestDB(t)
+	mustExec(t, db, "create table m (id uint64, f float64, ok bool, ts timestamp, index (f), primary key (id))")
+	mustExec(t, db, `insert into m (id, f, ok, ts) values
+		(1, 1.5, true, '2024-01-02T03:04:05Z'),
+		(18446744073709551615, -2, false, '2024-01-03T00:00:00+08:00')`)
+
+	cases := []struct {
+		query string
+		want  []string
+	}{
+		{"select id, f, ok, ts from m", []string{"1,1.5,true,2024-01-02T03:04:05Z", "18446744073709551615,-2,false,2024-01-02T16:00:00Z"}},
+		{"select id from m where id > 1", []string{"18446744073709551615"}},
+		{"select id from m where f >= 1 and f < 2.5", []string{"1"}},
+		{"select id from m where ok", []string{"1"}},
+		{"select id from m where not ok or ok = true", []string{"1", "18446744073709551615"}},
+		{"select id from m where ts < '2024-01-02T12:00:00Z'", []string{"1"}},
+		{"select f * 2 + 1, id + 1 from m where id = 1", []string{"4,2"}},
+		// 比较和逻辑运算的结果是bool
+		{"select id > 1, not ok from m", []string{"false,false", "true,true"}},
+		{"select id from m where ok = (f > 0)", []string{"1", "18446744073709551615"}},
+	}
+	for _, c := range cases {
+		if got := qlRows(mustExec(t, db, c.query)); !reflect.DeepEqual(got, c.want) {
+			t.Fatalf("wrong result of %q, got: %v, expected: %v", c.query, got, c.want)
+		}
+	}
+
+	mustExec(t, db, "insert into m (id, f, ok, ts) values (2, 0, 1 > 0 and not 2 < 1, '2024-01-02T03:04:05Z')")
+	if got := qlRows(mustExec(t, db, "select ok from m where id = 2")); !reflect.DeepEqual(got, []string{"true"}) {
+		t.Fatalf("wrong bool from an expression, got: %v", got)
+	}
+	mustExec(t, db, "update m set f = f / 4, ok = not ok where id = 1")
+	if got := qlRows(mustExec(t, db, "select f, ok from m where f = 0.375")); !reflect.DeepEqual(got, []string{"0.375,false"}) {
+		t.Fatalf("wrong result after update, got: %v", got)
+	}
+
+	for _, bad := range []string{
+		"insert into m (id, f, ok, ts) values (-1, 0, true, '2024-01-02T03:04:05Z')",
+		"insert into m (id, f, ok, ts) values (2, 0, 1, '2024-01-02T03:04:05Z')",
+		"insert into m (id, f, ok, ts) values (2, 0, true, 'yesterday')",
+		"insert into m (id, f, ok, ts) values (2, 0, true, 0)",
+		"update m set ok = ok + ok",
+		"select id from m where ts - ts > 0",
+	} {
+		if _, err := db.Exec(bad); err == nil {
+			t.Fatalf("expect an error: %s", bad)
+		}
+	}
+}
+
+func TestQLNull(t *testing.T) {
+	db := newTestDB(t)
+	mustExec(t, db, "create table p (id int64, name bytes null, age int64 null, index (age), primary key (id))")
+	mustExec(t, db, "insert into p (id, name, age) values (1, 'alice', 30), (2, null, 25)")
+	// 省略的可以为NULL的列是NULL
+	mustExec(t, db, "insert into p (id, name) values (3, 'carol')")
+
+	cases := []struct {
+		query string
+		want  []string
+	}{
+		{"select * from p", []string{"1,alice,30", "2,NULL,25", "3,carol,NULL"}},
+		{"select id from p where name is null", []string{"2"}},
+		{"select id from p where age is not null and name is not null", []string{"1"}},
+		// 和NULL比较的结果是NULL，WHERE不选择
+		{"select id from p where age > 20", []string{"2", "1"}},
+		{"select id from p where age < 40", []string{"2", "1"}},
+		{"select id from p where age = null or age != null", []string{}},
+		{"select id from p where not (age > 26)", []string{"2"}},
+		{"select id from p where age > 26 or id = 3", []string{"1", "3"}},
+		{"select id, age + 1, name + '!' from p", []string{"1,31,alice!", "2,26,NULL", "3,NULL,carol!"}},
+		{"select id, age > 26, age > 26 and false, age > 26 or true from p where id = 3", []string{"3,NULL,false,true"}},
+	}
+	for _, c := range cases {
+		if got := qlRows(mustExec(t, db, c.query)); !reflect.DeepEqual(got, c.want) {
+			t.Fatalf("wrong result of %q, got: %v, expected: %v", c.query, got, c.want)
+		}
+	}
+
+	mustExec(t, db, "update p set age = null, name = name + '?' where id = 1")
+	if got := qlRows(mustExec(t, db, "select id, name from p where age is null")); !reflect.DeepEqual(got, []string{"1,alice?", "3,carol"}) {
+		t.Fatalf("wrong result after update, got: %v", got)
+	}
+
+	for _, bad := range []string{
+		"insert into p (id, name, age) values (null, 'x', 1)",
+		"insert into p (name, age) values ('x', 1)",
+		"update p set id = null",
+		"create table q (id int64 null, primary key (id))",
+		"select id from p where name",
+	} {
+		if _, err := db.Exec(bad); err == nil {
+			t.Fatalf("expect an error: %s", bad)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"time"
+)
+
+/*
+*
+表达式的求值:
+
+	int64:   + - * / %, 比较, -a
+	float64: + - * / %, 比较, -a, 按IEEE 754计算
+	uint64:  + - * / %, 比较, 溢出时回绕
+	bytes:   + (连接), 比较
+	bool, timestamp: 比较
+	逻辑:    AND OR NOT, 操作数是bool
+	列名:    在tdef中查找列，从row中取值
+	NULL:    a IS NULL, a IS NOT NULL
+
+算术运算的结果和操作数的类型相同，除数为0时返回错误。
+比较和逻辑运算的结果是bool，类型不匹配时返回错误。
+
+NULL是未知的值，和SQL一样:
+
+	算术和比较的操作数有NULL时结果是NULL，NULL = NULL也是NULL
+	NOT NULL是NULL，false AND NULL是false，true OR NULL是true，其他有NULL的逻辑运算是NULL
+	WHERE的结果是NULL时和false一样，不选择这一行
+没有引用列的int64和bytes可以转换成另一个操作数或者列的类型(qlCoerce):
+
+	int64 => float64, uint64 (不能是负数)
+	bytes => timestamp (RFC3339)
+*/
+
+// parse a standalone expression
+func ParseExpr(s string) (QLNode, error) {
+	p := &Parser{input: []byte(s)}
+	expr := pExpr(p)
+	if p.err == nil && !pEnd(p) {
+		pErr(p, "unexpected trailing input")
+	}
+	if p.err != nil {
+		return QLNode{}, p.err
+	}
+	return expr, nil
+}
+
+// evaluate an expression against a row of the table
+// tdef为nil时表达式中不能引用列
+func EvalExpr(tdef *TableDef, row Record, expr QLNode) (Value, error) {
+	return qlEval(tdef, row, expr)
+}
+
+// WHERE的结果必须是bool，NULL是false
+func qlIsTrue(tdef *TableDef, row Record, node QLNode) (bool, error) {
+	val, err := qlEvalBool(tdef, row, node)
+	return val.Type != TYPE_NULL && val.Bool(), err
+}
+
+// 逻辑运算的操作数，结果是bool或者NULL
+func qlEvalBool(tdef *TableDef, row Record, node QLNode) (Value, error) {
+	val, err := qlEval(tdef, row, node)
+	if err != nil {
+		return Value{}, err
+	}
+	if val.Type != TYPE_BOOL && val.Type != TYPE_NULL {
+		return Value{}, fmt.Errorf("expect a boolean, got %s", typeName(val.Type))
+	}
+	return val, nil
+}
+
+func qlEval(tdef *TableDef, row Record, node QLNode) (Value, error) {
+	switch node.Type {
+	case TYPE_INT64, TYPE_BYTES, TYPE_FLOAT64, TYPE_BOOL, TYPE_UINT64, TYPE_NULL:
+		return node.Value, nil
+	case QL_SYM:
+		return qlEvalSym(tdef, row, string(node.Str))
+	case QL_NEG:
+		val, err := qlEval(tdef, row, node.Kids[0])
+		if err != nil {
+			return Value{}, err
+		}
+		switch val.Type {
+		case TYPE_NULL:
+			return val, nil
+		case TYPE_INT64:
+			return Value{Type: TYPE_INT64, I64: -val.I64}, nil
+		case TYPE_FLOAT64:
+			return qlFloat64(-val.Float64()), nil
+		default:
+			return Value{}, fmt.Errorf("bad operand for -: %s", typeName(val.Type))
+		}
+	case QL_NOT:
+		val, err := qlEvalBool(tdef, row, node.Kids[0])
+		if err != nil || val.Type == TYPE_NULL {
+			return val, err
+		}
+		return qlBool(!val.Bool()), nil
+	case QL_AND, QL_OR:
+		// 短路求值，AND遇到false或者OR遇到true时就是结果
+		decided := func(val Value) bool {
+			return val.Type != TYPE_NULL && val.Bool() == (node.Type == QL_OR)
+		}
+		left, err := qlEvalBool(tdef, row, node.Kids[0])
+		if err != nil || decided(left) {
+			return left, err
+		}
+		right, err := qlEvalBool(tdef, row, node.Kids[1])
+		if err != nil || decided(right) {
+			return right, err
+		}
+		if left.Type == TYPE_NULL {
+			return left, nil
+		}
+		return right, nil
+	case QL_IS_NULL, QL_NOT_NULL:
+		val, err := qlEval(tdef, row, node.Kids[0])
+		if err != nil {
+			return Value{}, err
+		}
+		return qlBool((val.Type == TYPE_NULL) == (node.Type == QL_IS_NULL)), nil
+	case QL_CMP_GE, QL_CMP_GT, QL_CMP_LT, QL_CMP_LE, QL_CMP_EQ, QL_CMP_NE:
+		left, right, err := qlEvalBinop(tdef, row, node)
+		if err != nil || left.Type == TYPE_NULL {
+			return left, err
+		}
+		return qlBool(qlCmpOK(node.Type, qlCompare(left, right))), nil
+	case QL_ADD, QL_SUB, QL_MUL, QL_DIV, QL_MOD:
+		left, right, err := qlEvalBinop(tdef, row, node)
+		if err != nil || left.Type == TYPE_NULL {
+			return left, err
+		}
+		return qlArith(node.Type, left, right)
+	case QL_TUP:
+		return Value{}, fmt.Errorf("tuple is not a value")
+	default:
+		return Value{}, fmt.Errorf("bad expression, type: %d", node.Type)
+	}
+}
+
+func qlEvalSym(tdef *TableDef, row Record, name string) (Value, error) {
+	if tdef == nil {
+		return Value{}, fmt.Errorf("column is not allowed here: %s", name)
+	}
+	idx := colIndex(tdef, name)
+	if idx < 0 {
+		return Value{}, fmt.Errorf("unknown column: %s.%s", tdef.Name, name)
+	}
+	val := row.Get(name)
+	if val == nil {
+		return Value{}, fmt.Errorf("column is missing in the row: %s", name)
+	}
+	if val.Type != tdef.Types[idx] && !(val.Type == TYPE_NULL && tdef.nullable(idx)) {
+		return Value{}, fmt.Errorf("column %s expects %s, got %s", name, typeName(tdef.Types[idx]), typeName(val.Type))
+	}
+	return *val, nil
+}
+
+// 二元操作符的两个操作数类型必须相同
+// 有一个操作数是NULL时不检查类型，返回的left是NULL
+func qlEvalBinop(tdef *TableDef, row Record, node QLNode) (Value, Value, error) {
+	left, err := qlEval(tdef, row, node.Kids[0])
+	if err != nil {
+		return Value{}, Value{}, err
+	}
+	right, err := qlEval(tdef, row, node.Kids[1])
+	if err != nil {
+		return Value{}, Value{}, err
+	}
+	if left.Type == TYPE_NULL || right.Type == TYPE_NULL {
+		return Value{Type: TYPE_NULL}, Value{Type: TYPE_NULL}, nil
+	}
+	if left.Type != right.Type {
+		left = qlCoerce(node.Kids[0], left, right.Type)
+		right = qlCoerce(node.Kids[1], right, left.Type)
+	}
+	if left.Type != right.Type {
+		return Value{}, Value{}, fmt.Errorf("bad operands for %s: %s and %s", qlOpName(node.Type), typeName(left.Type), typeName(right.Type))
+	}
+	return left, right, nil
+}
+
+// 转换常量的类型，不能转换时返回原来的值，由调用者报告类型错误
+func qlCoerce(expr QLNode, val Value, typ uint32) Value {
+	if qlHasSym(expr) {
+		return val
+	}
+	switch {
+	case val.Type == TYPE_INT64 && typ == TYPE_FLOAT64:
+		return qlFloat64(float64(val.I64))
+	case val.Type == TYPE_INT64 && typ == TYPE_UINT64 && val.I64 >= 0:
+		return Value{Type: TYPE_UINT64, I64: val.I64}
+	case val.Type == TYPE_BYTES && typ == TYPE_TIMESTAMP:
+		if ts, err := time.Parse(time.RFC3339Nano, string(val.Str)); err == nil {
+			return Value{Type: TYPE_TIMESTAMP, I64: ts.UnixNano()}
+		}
+	}
+	return val
+}
+
+// the operands have the same type
+func qlArith(op uint32, a, b Value) (Value, error) {
+	div := op == QL_DIV || op == QL_MOD
+	switch a.Type {
+	case TYPE_INT64, TYPE_UINT64:
+		if div && b.I64 == 0 {
+			return Value{}, fmt.Errorf("division by zero")
+		}
+		if a.Type == TYPE_UINT64 {
+			return Value{Type: TYPE_UINT64, I64: int64(qlArithInt(op, a.Uint64(), b.Uint64()))}, nil
+		}
+		return Value{Type: TYPE_INT64, I64: qlArithInt(op, a.I64, b.I64)}, nil
+	case TYPE_FLOAT64:
+		if div && b.Float64() == 0 { // 0和-0
+			return Value{}, fmt.Errorf("division by zero")
+		}
+		return qlFloat64(qlArithFloat(op, a.Float64(), b.Float64())), nil
+	case TYPE_BYTES:
+		if op == QL_ADD {
+			str := append(append([]byte{}, a.Str...), b.Str...)
+			return Value{Type: TYPE_BYTES, Str: str}, nil
+		}
+	}
+	return Value{}, fmt.Errorf("bad operands for %s: %s", qlOpName(op), typeName(a.Type))
+}
+
+// the divisor is not 0
+func qlArithInt[T int64 | uint64](op uint32, a, b T) T {
+	switch op {
+	case QL_ADD:
+		return a + b
+	case QL_SUB:
+		return a - b
+	case QL_MUL:
+		return a * b
+	case QL_DIV:
+		return a / b
+	default:
+		return a % b
+	}
+}
+
+func qlArithFloat(op uint32, a, b float64) float64 {
+	switch op {
+	case QL_ADD:
+		return a + b
+	case QL_SUB:
+		return a - b
+	case QL_MUL:
+		return a * b
+	case QL_DIV:
+		return a / b
+	default:
+		return math.Mod(a, b)
+	}
+}
+
+func qlFloat64(f float64) Value {
+	return Value{Type: TYPE_FLOAT64, I64: int64(math.Float64bits(f))}
+}
+
+// the operands have the same type
+func qlCompare(a, b Value) int {
+	switch a.Type {
+	case TYPE_BYTES:
+		return bytes.Compare(a.Str, b.Str)
+	case TYPE_FLOAT64, TYPE_UINT64:
+		// 和key的编码顺序一致
+		return bytes.Compare(encodeValues(nil, []Value{a}), encodeValues(nil, []Value{b}))
+	default:
+		return cmpInt64(a.I64, b.I64)
+	}
+}
+
+func qlCmpOK(op uint32, r int) bool {
+	switch op {
+	case QL_CMP_GE:
+		return r >= 0
+	case QL_CMP_GT:
+		return r > 0
+	case QL_CMP_LT:
+		return r < 0
+	case QL_CMP_LE:
+		return r <= 0
+	case QL_CMP_EQ:
+		return r == 0
+	default:
+		return r != 0
+	}
+}
+
+func qlOpName(op uint32) string {
+	names := map[uint32]string{
+		QL_CMP_GE: ">=", QL_CMP_GT: ">", QL_CMP_LT: "<", QL_CMP_LE: "<=", QL_CMP_EQ: "=", QL_CMP_NE: "!=",
+		QL_ADD: "+", QL_SUB: "-", QL_MUL: "*", QL_DIV: "/", QL_MOD: "%",
+	}
+	return names[op]
+}
+
+func cmpInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return +1
+	default:
+		return 0
+	}
+}
+
+func qlBool(b bool) Value {
+	if b {
+		return Value{Type: TYPE_BOOL, I64: 1}
+	}
+	return Value{Type: TYPE_BOOL, I64: 0}
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvalExpr(t *testing.T) {
+	tdef := &TableDef{
+		Name:  "t",
+		Types: []uint32{TYPE_INT64, TYPE_BYTES},
+		Cols:  []string{"a", "b"},
+		PKeys: 1,
+	}
+	row := *(&Record{}).AddStr("b", []byte("xy"))
+	row.Cols = append([]string{"a"}, row.Cols...)
+	row.Vals = append([]Value{{Type: TYPE_INT64, I64: 7}}, row.Vals...)
+
+	cases := []struct {
+		expr string
+		want Value
+	}{
+		{"a * 2 + 1", Value{Type: TYPE_INT64, I64: 15}},
+		{"a / 2 - a % 2", Value{Type: TYPE_INT64, I64: 2}},
+		{"-a", Value{Type: TYPE_INT64, I64: -7}},
+		{"b + 'z'", Value{Type: TYPE_BYTES, Str: []byte("xyz")}},
+		{"b < 'y' and a >= 7", qlBool(true)},
+		{"not (a = 7) or b != 'xy'", qlBool(false)},
+		// 短路求值，右边的错误不会发生
+		{"a = 1 and b + 1", qlBool(false)},
+	}
+	for _, c := range cases {
+		expr, err := ParseExpr(c.expr)
+		if err != nil {
+			t.Fatalf("fail to parse %q, err: %s", c.expr, err)
+		}
+		got, err := EvalExpr(tdef, row, expr)
+		if err != nil {
+			t.Fatalf("fail to eval %q, err: %s", c.expr, err)
+		}
+		if got.Type != c.want.Type || got.I64 != c.want.I64 || string(got.Str) != string(c.want.Str) {
+			t.Fatalf("wrong result of %q, got: %+v", c.expr, got)
+		}
+	}
+
+	errs := []struct {
+		expr string
+		msg  string
+	}{
+		{"a = b", "bad operands for =: int64 and bytes"},
+		{"b * 2", "bad operands for *: bytes and int64"},
+		{"b - 'x'", "bad operands for -: bytes"},
+		{"-b", "bad operand for -: bytes"},
+		{"a / 0", "division by zero"},
+		{"not b", "expect a boolean, got bytes"},
+		{"c + 1", "unknown column: t.c"},
+		{"(a, b)", "tuple is not a value"},
+	}
+	for _, c := range errs {
+		expr, err := ParseExpr(c.expr)
+		if err != nil {
+			t.Fatalf("fail to parse %q, err: %s", c.expr, err)
+		}
+		_, err = EvalExpr(tdef, row, expr)
+		if err == nil || !strings.Contains(err.Error(), c.msg) {
+			t.Fatalf("wrong error of %q, got: %v, expected: %s", c.expr, err, c.msg)
+		}
+	}
+
+	// 没有表时不能引用列
+	expr, _ := ParseExpr("a + 1")
+	if _, err := EvalExpr(nil, Record{}, expr); err == nil {
+		t.Fatalf("expect an error on a column without a table")
+	}
+}
+
+// 算术运算的结果和操作数的类型相同，不是对编码后的int64计算
+func TestEvalExprTypes(t *testing.T) {
+	tdef := &TableDef{
+		Name:  "t",
+		Types: []uint32{TYPE_FLOAT64, TYPE_UINT64, TYPE_BOOL, TYPE_TIMESTAMP, TYPE_FLOAT64},
+		Cols:  []string{"f", "u", "ok", "ts", "inf"},
+		PKeys: 1,
+	}
+	row := Record{}
+	row.AddFloat64("f", -1.5).AddUint64("u", 1<<63+3).AddBool("ok", true)
+	row.AddTime("ts", time.Unix(1, 0)).AddFloat64("inf", math.Inf(1))
+
+	cases := []struct {
+		expr string
+		want Value
+	}{
+		{"f * f", qlFloat64(2.25)},
+		{"f + f", qlFloat64(-3)},
+		{"-f / (f - f - f)", qlFloat64(1)},
+		{"(f - f - f) % f", qlFloat64(0)},
+		{"f < f - f", qlBool(true)},
+		{"inf + inf", qlFloat64(math.Inf(1))},
+		{"inf > f", qlBool(true)},
+		{"u + u", Value{Type: TYPE_UINT64, I64: 6}},
+		{"u / (u - u + u)", Value{Type: TYPE_UINT64, I64: 1}},
+		{"u % (u + u)", Value{Type: TYPE_UINT64, I64: 5}}, // (1<<63 + 3) % 6
+		{"u > u - u", qlBool(true)},
+		{"ok = ok", qlBool(true)},
+		{"ts >= ts", qlBool(true)},
+	}
+	for _, c := range cases {
+		expr, err := ParseExpr(c.expr)
+		if err != nil {
+			t.Fatalf("fail to parse %q, err: %s", c.expr, err)
+		}
+		got, err := EvalExpr(tdef, row, expr)
+		if err != nil {
+			t.Fatalf("fail to eval %q, err: %s", c.expr, err)
+		}
+		if got.Type != c.want.Type || got.I64 != c.want.I64 {
+			t.Fatalf("wrong result of %q, got: %+v, expected: %+v", c.expr, got, c.want)
+		}
+	}
+
+	errs := []struct {
+		expr string
+		msg  string
+	}{
+		{"ok + ok", "bad operands for +: bool"},
+		{"ts - ts", "bad operands for -: timestamp"},
+		{"-u", "bad operand for -: uint64"},
+		{"-ok", "bad operand for -: bool"},
+		{"f / (f - f)", "division by zero"},
+		{"u % (u - u)", "division by zero"},
+		{"f + u", "bad operands for +: float64 and uint64"},
+	}
+	for _, c := range errs {
+		expr, err := ParseExpr(c.expr)
+		if err != nil {
+			t.Fatalf("fail to parse %q, err: %s", c.expr, err)
+		}
+		_, err = EvalExpr(tdef, row, expr)
+		if err == nil || !strings.Contains(err.Error(), c.msg) {
+			t.Fatalf("wrong error of %q, got: %v, expected: %s", c.expr, err, c.msg)
+		}
+	}
+}
+
+func TestEvalExprNull(t *testing.T) {
+	null := Value{Type: TYPE_NULL}
+	cases := []struct {
+		expr string
+		want Value
+	}{
+		{"null + 1", null},
+		{"-null", null},
+		{"null = null", null},
+		{"'x' < null", null},
+		{"not null", null},
+		{"null and false", qlBool(false)},
+		{"null and true", null},
+		{"null or true", qlBool(true)},
+		{"false or null", null},
+		{"null is null", qlBool(true)},
+		{"1 + 1 is not null", qlBool(true)},
+	}
+	for _, c := range cases {
+		expr, err := ParseExpr(c.expr)
+		if err != nil {
+			t.Fatalf("fail to parse %q, err: %s", c.expr, err)
+		}
+		got, err := EvalExpr(nil, Record{}, expr)
+		if err != nil {
+			t.Fatalf("fail to eval %q, err: %s", c.expr, err)
+		}
+		if got.Type != c.want.Type || got.I64 != c.want.I64 {
+			t.Fatalf("wrong result of %q, got: %+v, expected: %+v", c.expr, got, c.want)
+		}
+	}
+
+	// 只有可以为NULL的列可以是NULL
+	tdef := &TableDef{
+		Name:     "t",
+		Types:    []uint32{TYPE_INT64, TYPE_INT64, TYPE_INT64},
+		Cols:     []string{"a", "b", "c"},
+		PKeys:    1,
+		Nullable: []bool{false, true, false},
+	}
+	row := Record{}
+	row.AddInt64("a", 1).AddNull("b").AddNull("c")
+	expr, _ := ParseExpr("b is null")
+	if got, err := EvalExpr(tdef, row, expr); err != nil || got.I64 != 1 {
+		t.Fatalf("wrong result of b is null, got: %+v, err: %v", got, err)
+	}
+	expr, _ = ParseExpr("c is null")
+	if _, err := EvalExpr(tdef, row, expr); err == nil || !strings.Contains(err.Error(), "column c expects int64, got null") {
+		t.Fatalf("expect a type error, got: %v", err)
+	}
+}
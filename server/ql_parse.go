@@ -0,0 +1,690 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/*
+*
+查询语言的语法:
+
+	CREATE TABLE t (a int64, b bytes, c int64 NULL, index (b), primary key (a))
+	SELECT a, b AS c FROM t WHERE a > 1 AND b = 'x' LIMIT 10 OFFSET 5
+	INSERT INTO t (a, b) VALUES (1, 'x'), (2, 'y')
+	UPSERT INTO t (a, b) VALUES (1, 'z')
+	UPDATE t SET b = 'z' WHERE a = 1
+	DELETE FROM t WHERE a = 1
+
+关键字不区分大小写，语句末尾的分号是可选的
+
+列默认不能是NULL，类型后面加上NULL的列可以是NULL，省略的这样的列在INSERT时是NULL
+
+常量: 123 (int64，超出int64的是uint64), 1.5 2e-3 (float64), true false (bool), 'x' "x" (bytes), NULL
+timestamp没有常量，用RFC3339的字符串，比如'2024-01-02T15:04:05Z'，见qlCoerce
+*/
+
+// the AST node of an expression
+// 常量的Type是TYPE_*，列名的Type是QL_SYM，其他节点是操作符，操作数在Kids中
+type QLNode struct {
+	Value
+	Kids []QLNode
+}
+
+const (
+	QL_UNINIT = 0
+	// scalars: TYPE_BYTES, TYPE_INT64, TYPE_FLOAT64, TYPE_BOOL, TYPE_UINT64, TYPE_NULL
+	QL_SYM  = 100 // column name, in Str
+	QL_TUP  = 101 // tuple
+	QL_STAR = 102 // select *
+	// unary ops
+	QL_NEG      = 110
+	QL_NOT      = 111
+	QL_IS_NULL  = 112 // a IS NULL
+	QL_NOT_NULL = 113 // a IS NOT NULL
+	// binary ops
+	QL_CMP_GE = 120 // >=
+	QL_CMP_GT = 121 // >
+	QL_CMP_LT = 122 // <
+	QL_CMP_LE = 123 // <=
+	QL_CMP_EQ = 124 // =
+	QL_CMP_NE = 125 // !=
+	QL_ADD    = 130
+	QL_SUB    = 131
+	QL_MUL    = 132
+	QL_DIV    = 133
+	QL_MOD    = 134
+	QL_AND    = 140
+	QL_OR     = 141
+)
+
+// common structure for statements with a WHERE clause
+type QLScan struct {
+	Table  string
+	Where  QLNode // QL_UNINIT: no condition
+	Offset int64
+	Limit  int64
+}
+
+// stmt: select
+type QLSelect struct {
+	QLScan
+	Names  []string // expr AS name
+	Output []QLNode
+}
+
+// stmt: insert, upsert
+type QLInsert struct {
+	Table  string
+	Mode   int
+	Names  []string
+	Values [][]QLNode
+}
+
+// stmt: update
+type QLUpdate struct {
+	QLScan
+	Names  []string
+	Values []QLNode
+}
+
+// stmt: delete
+type QLDelete struct {
+	QLScan
+}
+
+// stmt: create table
+type QLCreateTable struct {
+	Def TableDef
+}
+
+type Parser struct {
+	input []byte
+	idx   int
+	err   error
+}
+
+// parse a single statement
+func ParseStmt(s string) (interface{}, error) {
+	p := &Parser{input: []byte(s)}
+	stmt := pStmt(p)
+	pKeyword(p, ";")
+	if p.err == nil && !pEnd(p) {
+		pErr(p, "unexpected trailing input")
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	return stmt, nil
+}
+
+// 只记录第一个错误，之后的解析都会失败
+func pErr(p *Parser, format string, args ...interface{}) {
+	if p.err == nil {
+		p.err = fmt.Errorf("parse error at %d: %s", p.idx, fmt.Sprintf(format, args...))
+	}
+}
+
+func pStmt(p *Parser) interface{} {
+	switch {
+	case pKeyword(p, "create", "table"):
+		return pCreateTable(p)
+	case pKeyword(p, "select"):
+		return pSelect(p)
+	case pKeyword(p, "insert", "into"):
+		return pInsert(p, MODE_INSERT_ONLY)
+	case pKeyword(p, "upsert", "into"):
+		return pInsert(p, MODE_UPSERT)
+	case pKeyword(p, "update"):
+		return pUpdate(p)
+	case pKeyword(p, "delete", "from"):
+		return pDelete(p)
+	default:
+		pErr(p, "unknown statement")
+		return nil
+	}
+}
+
+func pCreateTable(p *Parser) *QLCreateTable {
+	stmt := &QLCreateTable{}
+	stmt.Def.Name = pMustSym(p)
+	pExpect(p, "(")
+
+	var names []string
+	var types []uint32
+	var nulls []bool
+	var pkeys []string
+	for p.err == nil {
+		switch {
+		case pKeyword(p, "primary", "key"):
+			if pkeys != nil {
+				pErr(p, "duplicated primary key")
+			}
+			pkeys = pNameList(p)
+		case pKeyword(p, "index"):
+			stmt.Def.Indexes = append(stmt.Def.Indexes, pNameList(p))
+		default:
+			names = append(names, pMustSym(p))
+			types = append(types, pColType(p))
+			nulls = append(nulls, pColNull(p))
+		}
+		if !pKeyword(p, ",") {
+			break
+		}
+	}
+	pExpect(p, ")")
+	if p.err != nil {
+		return nil
+	}
+	if len(pkeys) == 0 {
+		pErr(p, "no primary key")
+		return nil
+	}
+
+	// TableDef中主键列在前面
+	def := &stmt.Def
+	for _, col := range pkeys {
+		i := indexOf(names, col)
+		if i < 0 {
+			pErr(p, "unknown primary key column: %s", col)
+			return nil
+		}
+		if indexOf(def.Cols, col) >= 0 {
+			pErr(p, "duplicated primary key column: %s", col)
+			return nil
+		}
+		def.Cols = append(def.Cols, names[i])
+		def.Types = append(def.Types, types[i])
+		def.Nullable = append(def.Nullable, nulls[i])
+	}
+	def.PKeys = len(pkeys)
+	for i, col := range names {
+		if indexOf(def.Cols[:def.PKeys], col) >= 0 {
+			continue
+		}
+		if indexOf(def.Cols, col) >= 0 {
+			pErr(p, "duplicated column: %s", col)
+			return nil
+		}
+		def.Cols = append(def.Cols, col)
+		def.Types = append(def.Types, types[i])
+		def.Nullable = append(def.Nullable, nulls[i])
+	}
+	// 没有可以为NULL的列时和原来的表定义一样
+	if !def.hasNullable() {
+		def.Nullable = nil
+	}
+	return stmt
+}
+
+func pColType(p *Parser) uint32 {
+	switch {
+	case pKeyword(p, "int64"):
+		return TYPE_INT64
+	case pKeyword(p, "bytes"):
+		return TYPE_BYTES
+	case pKeyword(p, "float64"):
+		return TYPE_FLOAT64
+	case pKeyword(p, "bool"):
+		return TYPE_BOOL
+	case pKeyword(p, "timestamp"):
+		return TYPE_TIMESTAMP
+	case pKeyword(p, "uint64"):
+		return TYPE_UINT64
+	default:
+		pErr(p, "expect a column type")
+		return TYPE_ERROR
+	}
+}
+
+// NULL or NOT NULL after the column type
+func pColNull(p *Parser) bool {
+	if pKeyword(p, "not", "null") {
+		return false
+	}
+	return pKeyword(p, "null")
+}
+
+func pSelect(p *Parser) *QLSelect {
+	stmt := &QLSelect{}
+	for p.err == nil {
+		if pKeyword(p, "*") {
+			stmt.Names = append(stmt.Names, "*")
+			stmt.Output = append(stmt.Output, QLNode{Value: Value{Type: QL_STAR}})
+		} else {
+			start := p.idx
+			expr := pExpr(p)
+			name := strings.TrimSpace(string(p.input[start:p.idx]))
+			if pKeyword(p, "as") {
+				name = pMustSym(p)
+			}
+			stmt.Names = append(stmt.Names, name)
+			stmt.Output = append(stmt.Output, expr)
+		}
+		if !pKeyword(p, ",") {
+			break
+		}
+	}
+	pExpect(p, "from")
+	pScan(p, &stmt.QLScan)
+	return stmt
+}
+
+func pInsert(p *Parser, mode int) *QLInsert {
+	stmt := &QLInsert{Mode: mode}
+	stmt.Table = pMustSym(p)
+	stmt.Names = pNameList(p)
+	pExpect(p, "values")
+	for p.err == nil {
+		pExpect(p, "(")
+		row := pExprList(p)
+		pExpect(p, ")")
+		if p.err == nil && len(row) != len(stmt.Names) {
+			pErr(p, "expect %d values, got %d", len(stmt.Names), len(row))
+		}
+		stmt.Values = append(stmt.Values, row)
+		if !pKeyword(p, ",") {
+			break
+		}
+	}
+	return stmt
+}
+
+func pUpdate(p *Parser) *QLUpdate {
+	stmt := &QLUpdate{}
+	stmt.Table = pMustSym(p)
+	pExpect(p, "set")
+	for p.err == nil {
+		stmt.Names = append(stmt.Names, pMustSym(p))
+		pExpect(p, "=")
+		stmt.Values = append(stmt.Values, pExpr(p))
+		if !pKeyword(p, ",") {
+			break
+		}
+	}
+	pScanTail(p, &stmt.QLScan)
+	return stmt
+}
+
+func pDelete(p *Parser) *QLDelete {
+	stmt := &QLDelete{}
+	pScan(p, &stmt.QLScan)
+	return stmt
+}
+
+// table [WHERE expr] [LIMIT n] [OFFSET m]
+func pScan(p *Parser, stmt *QLScan) {
+	stmt.Table = pMustSym(p)
+	pScanTail(p, stmt)
+}
+
+func pScanTail(p *Parser, stmt *QLScan) {
+	if pKeyword(p, "where") {
+		stmt.Where = pExpr(p)
+	}
+	stmt.Offset, stmt.Limit = 0, math.MaxInt64
+	if pKeyword(p, "limit") {
+		stmt.Limit = pMustNum(p)
+	}
+	if pKeyword(p, "offset") {
+		stmt.Offset = pMustNum(p)
+	}
+}
+
+// (a, b, c)
+func pNameList(p *Parser) []string {
+	pExpect(p, "(")
+	names := []string{pMustSym(p)}
+	for p.err == nil && pKeyword(p, ",") {
+		names = append(names, pMustSym(p))
+	}
+	pExpect(p, ")")
+	return names
+}
+
+func pExprList(p *Parser) []QLNode {
+	exprs := []QLNode{pExpr(p)}
+	for p.err == nil && pKeyword(p, ",") {
+		exprs = append(exprs, pExpr(p))
+	}
+	return exprs
+}
+
+/*
+*
+表达式按照优先级从低到高:
+
+	a OR b
+	a AND b
+	NOT a
+	a = b, a != b, a <> b, a < b, a <= b, a > b, a >= b, a IS [NOT] NULL
+	a + b, a - b
+	a * b, a / b, a % b
+	-a
+	(a), (a, b), column, 123, 'string', NULL
+*/
+func pExpr(p *Parser) QLNode {
+	return pExprOr(p)
+}
+
+func pExprOr(p *Parser) QLNode {
+	left := pExprAnd(p)
+	for p.err == nil && pKeyword(p, "or") {
+		left = QLNode{Value: Value{Type: QL_OR}, Kids: []QLNode{left, pExprAnd(p)}}
+	}
+	return left
+}
+
+func pExprAnd(p *Parser) QLNode {
+	left := pExprNot(p)
+	for p.err == nil && pKeyword(p, "and") {
+		left = QLNode{Value: Value{Type: QL_AND}, Kids: []QLNode{left, pExprNot(p)}}
+	}
+	return left
+}
+
+func pExprNot(p *Parser) QLNode {
+	if pKeyword(p, "not") {
+		return QLNode{Value: Value{Type: QL_NOT}, Kids: []QLNode{pExprNot(p)}}
+	}
+	return pExprCmp(p)
+}
+
+func pExprCmp(p *Parser) QLNode {
+	left := pExprAdd(p)
+	if pKeyword(p, "is", "null") {
+		return QLNode{Value: Value{Type: QL_IS_NULL}, Kids: []QLNode{left}}
+	}
+	if pKeyword(p, "is", "not", "null") {
+		return QLNode{Value: Value{Type: QL_NOT_NULL}, Kids: []QLNode{left}}
+	}
+	// 较长的操作符放在前面
+	ops := []struct {
+		tok string
+		op  uint32
+	}{
+		{">=", QL_CMP_GE}, {"<=", QL_CMP_LE}, {"!=", QL_CMP_NE}, {"<>", QL_CMP_NE},
+		{">", QL_CMP_GT}, {"<", QL_CMP_LT}, {"=", QL_CMP_EQ},
+	}
+	for _, item := range ops {
+		if pKeyword(p, item.tok) {
+			return QLNode{Value: Value{Type: item.op}, Kids: []QLNode{left, pExprAdd(p)}}
+		}
+	}
+	return left
+}
+
+func pExprAdd(p *Parser) QLNode {
+	left := pExprMul(p)
+	for p.err == nil {
+		var op uint32
+		switch {
+		case pKeyword(p, "+"):
+			op = QL_ADD
+		case pKeyword(p, "-"):
+			op = QL_SUB
+		default:
+			return left
+		}
+		left = QLNode{Value: Value{Type: op}, Kids: []QLNode{left, pExprMul(p)}}
+	}
+	return left
+}
+
+func pExprMul(p *Parser) QLNode {
+	left := pExprUnop(p)
+	for p.err == nil {
+		var op uint32
+		switch {
+		case pKeyword(p, "*"):
+			op = QL_MUL
+		case pKeyword(p, "/"):
+			op = QL_DIV
+		case pKeyword(p, "%"):
+			op = QL_MOD
+		default:
+			return left
+		}
+		left = QLNode{Value: Value{Type: op}, Kids: []QLNode{left, pExprUnop(p)}}
+	}
+	return left
+}
+
+func pExprUnop(p *Parser) QLNode {
+	if pKeyword(p, "-") {
+		return QLNode{Value: Value{Type: QL_NEG}, Kids: []QLNode{pExprUnop(p)}}
+	}
+	return pExprAtom(p)
+}
+
+func pExprAtom(p *Parser) QLNode {
+	if pKeyword(p, "(") {
+		kids := pExprList(p)
+		pExpect(p, ")")
+		if len(kids) == 1 {
+			return kids[0]
+		}
+		return QLNode{Value: Value{Type: QL_TUP}, Kids: kids}
+	}
+
+	skipSpace(p)
+	switch {
+	case pEnd(p):
+		pErr(p, "expect an expression")
+	case isDigit(p.input[p.idx]):
+		return pNum(p)
+	case p.input[p.idx] == '\'' || p.input[p.idx] == '"':
+		return QLNode{Value: Value{Type: TYPE_BYTES, Str: pStr(p)}}
+	case pKeyword(p, "true"):
+		return QLNode{Value: Value{Type: TYPE_BOOL, I64: 1}}
+	case pKeyword(p, "false"):
+		return QLNode{Value: Value{Type: TYPE_BOOL, I64: 0}}
+	case pKeyword(p, "null"):
+		return QLNode{Value: Value{Type: TYPE_NULL}}
+	default:
+		if name, ok := pSym(p); ok {
+			return QLNode{Value: Value{Type: QL_SYM, Str: []byte(name)}}
+		}
+		pErr(p, "expect an expression")
+	}
+	return QLNode{}
+}
+
+// tokens
+func skipSpace(p *Parser) {
+	for p.idx < len(p.input) && isSpace(p.input[p.idx]) {
+		p.idx++
+	}
+}
+
+func pEnd(p *Parser) bool {
+	skipSpace(p)
+	return p.idx >= len(p.input)
+}
+
+// match a sequence of keywords or symbols, case-insensitive
+// 不匹配时不移动位置
+func pKeyword(p *Parser, kwds ...string) bool {
+	if p.err != nil {
+		return false
+	}
+	save := p.idx
+	for _, kw := range kwds {
+		skipSpace(p)
+		end := p.idx + len(kw)
+		if end > len(p.input) || !strings.EqualFold(string(p.input[p.idx:end]), kw) {
+			p.idx = save
+			return false
+		}
+		// 关键字不能是一个更长的名字的前缀
+		if isSymStart(kw[0]) && end < len(p.input) && isSym(p.input[end]) {
+			p.idx = save
+			return false
+		}
+		p.idx = end
+	}
+	return true
+}
+
+func pExpect(p *Parser, tok string) {
+	if !pKeyword(p, tok) {
+		pErr(p, "expect %q", tok)
+	}
+}
+
+// 关键字不能作为名字
+// key不是保留字，常用作列名(比如@meta)，primary key由pKeyword匹配
+var pReserved = map[string]bool{
+	"create": true, "table": true, "select": true, "from": true, "where": true,
+	"insert": true, "upsert": true, "into": true, "values": true, "update": true,
+	"set": true, "delete": true, "index": true, "primary": true,
+	"limit": true, "offset": true, "as": true, "and": true, "or": true, "not": true,
+	"true": true, "false": true, "null": true, "is": true,
+}
+
+func pSym(p *Parser) (string, bool) {
+	if p.err != nil {
+		return "", false
+	}
+	skipSpace(p)
+	end := p.idx
+	if end >= len(p.input) || !isSymStart(p.input[end]) {
+		return "", false
+	}
+	for end < len(p.input) && isSym(p.input[end]) {
+		end++
+	}
+	name := string(p.input[p.idx:end])
+	if pReserved[strings.ToLower(name)] {
+		return "", false
+	}
+	p.idx = end
+	return name, true
+}
+
+func pMustSym(p *Parser) string {
+	name, ok := pSym(p)
+	if !ok {
+		pErr(p, "expect a name")
+	}
+	return name
+}
+
+func pMustNum(p *Parser) int64 {
+	if p.err != nil {
+		return 0
+	}
+	skipSpace(p)
+	end := p.idx
+	for end < len(p.input) && isDigit(p.input[end]) {
+		end++
+	}
+	if end < len(p.input) && isSym(p.input[end]) {
+		pErr(p, "bad number")
+		return 0
+	}
+	num, err := strconv.ParseInt(string(p.input[p.idx:end]), 10, 64)
+	if err != nil {
+		pErr(p, "bad number: %s", err)
+		return 0
+	}
+	p.idx = end
+	return num
+}
+
+// a number literal, 有小数点或者指数的是float64
+func pNum(p *Parser) QLNode {
+	end := p.idx
+	digits := func() {
+		for end < len(p.input) && isDigit(p.input[end]) {
+			end++
+		}
+	}
+	digits()
+	float := false
+	if end < len(p.input) && p.input[end] == '.' {
+		float = true
+		end++
+		digits()
+	}
+	if end < len(p.input) && (p.input[end] == 'e' || p.input[end] == 'E') {
+		float = true
+		end++
+		if end < len(p.input) && (p.input[end] == '+' || p.input[end] == '-') {
+			end++
+		}
+		digits()
+	}
+	if end < len(p.input) && isSym(p.input[end]) {
+		pErr(p, "bad number")
+		return QLNode{}
+	}
+
+	s := string(p.input[p.idx:end])
+	node := QLNode{}
+	var err error
+	if float {
+		var f float64
+		f, err = strconv.ParseFloat(s, 64)
+		node.Value = qlFloat64(f)
+	} else if node.I64, err = strconv.ParseInt(s, 10, 64); err == nil {
+		node.Type = TYPE_INT64
+	} else {
+		var u uint64
+		u, err = strconv.ParseUint(s, 10, 64)
+		node.Value = Value{Type: TYPE_UINT64, I64: int64(u)}
+	}
+	if err != nil {
+		pErr(p, "bad number: %s", err)
+		return QLNode{}
+	}
+	p.idx = end
+	return node
+}
+
+// 'string' or "string", 反斜杠转义下一个字符
+func pStr(p *Parser) []byte {
+	quote := p.input[p.idx]
+	out := []byte{}
+	for i := p.idx + 1; i < len(p.input); i++ {
+		switch ch := p.input[i]; {
+		case ch == quote:
+			p.idx = i + 1
+			return out
+		case ch == '\\' && i+1 < len(p.input):
+			i++
+			out = append(out, p.input[i])
+		default:
+			out = append(out, ch)
+		}
+	}
+	pErr(p, "unterminated string")
+	return nil
+}
+
+func isSpace(ch byte) bool {
+	return ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r'
+}
+
+func isDigit(ch byte) bool {
+	return '0' <= ch && ch <= '9'
+}
+
+func isSymStart(ch byte) bool {
+	return ch == '_' || ('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z')
+}
+
+func isSym(ch byte) bool {
+	return isSymStart(ch) || isDigit(ch)
+}
+
+func indexOf(list []string, s string) int {
+	for i, item := range list {
+		if item == s {
+			return i
+		}
+	}
+	return -1
+}
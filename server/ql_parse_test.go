@@ -0,0 +1,103 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseExpr(t *testing.T) {
+	sym := func(name string) QLNode {
+		return QLNode{Value: Value{Type: QL_SYM, Str: []byte(name)}}
+	}
+	num := func(n int64) QLNode {
+		return QLNode{Value: Value{Type: TYPE_INT64, I64: n}}
+	}
+	op := func(typ uint32, kids ...QLNode) QLNode {
+		return QLNode{Value: Value{Type: typ}, Kids: kids}
+	}
+
+	cases := []struct {
+		expr string
+		want QLNode
+	}{
+		{"a", sym("a")},
+		{"'x\\'y'", QLNode{Value: Value{Type: TYPE_BYTES, Str: []byte("x'y")}}},
+		{"1 + 2 * 3", op(QL_ADD, num(1), op(QL_MUL, num(2), num(3)))},
+		{"(1 + 2) * -3", op(QL_MUL, op(QL_ADD, num(1), num(2)), op(QL_NEG, num(3)))},
+		{"a >= 1 AND not b <> 2 or c", op(QL_OR, op(QL_AND, op(QL_CMP_GE, sym("a"), num(1)), op(QL_NOT, op(QL_CMP_NE, sym("b"), num(2)))), sym("c"))},
+		{"(a, b)", op(QL_TUP, sym("a"), sym("b"))},
+		{"1.5 * 2e3", op(QL_MUL, QLNode{Value: qlFloat64(1.5)}, QLNode{Value: qlFloat64(2000)})},
+		{"-0.25", op(QL_NEG, QLNode{Value: qlFloat64(0.25)})},
+		{"a = true or b != FALSE", op(QL_OR, op(QL_CMP_EQ, sym("a"), QLNode{Value: Value{Type: TYPE_BOOL, I64: 1}}), op(QL_CMP_NE, sym("b"), QLNode{Value: Value{Type: TYPE_BOOL}}))},
+		{"18446744073709551615", QLNode{Value: Value{Type: TYPE_UINT64, I64: -1}}},
+		{"a is null or b + 1 IS NOT NULL", op(QL_OR, op(QL_IS_NULL, sym("a")), op(QL_NOT_NULL, op(QL_ADD, sym("b"), num(1))))},
+		{"a = null", op(QL_CMP_EQ, sym("a"), QLNode{Value: Value{Type: TYPE_NULL}})},
+	}
+	for _, c := range cases {
+		p := &Parser{input: []byte(c.expr)}
+		got := pExpr(p)
+		if p.err != nil || !pEnd(p) {
+			t.Fatalf("fail to parse %q, err: %v", c.expr, p.err)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Fatalf("wrong AST of %q, got: %+v", c.expr, got)
+		}
+	}
+}
+
+func TestParseStmt(t *testing.T) {
+	stmt, err := ParseStmt("create table t (a int64, b bytes, c int64, index (b), primary key (c, a));")
+	if err != nil {
+		t.Fatalf("fail to parse, err: %s", err)
+	}
+	def := stmt.(*QLCreateTable).Def
+	if !reflect.DeepEqual(def.Cols, []string{"c", "a", "b"}) || def.PKeys != 2 || !reflect.DeepEqual(def.Indexes, [][]string{{"b"}}) {
+		t.Fatalf("wrong table def: %+v", def)
+	}
+	stmt, err = ParseStmt("create table t (a int64 not null, b bytes null, c int64, primary key (c))")
+	if err != nil {
+		t.Fatalf("fail to parse, err: %s", err)
+	}
+	def = stmt.(*QLCreateTable).Def
+	if !reflect.DeepEqual(def.Cols, []string{"c", "a", "b"}) || !reflect.DeepEqual(def.Nullable, []bool{false, false, true}) {
+		t.Fatalf("wrong table def: %+v", def)
+	}
+
+	stmt, err = ParseStmt("SELECT *, a + 1 AS b, c FROM t WHERE a = 1 LIMIT 10 OFFSET 2")
+	if err != nil {
+		t.Fatalf("fail to parse, err: %s", err)
+	}
+	sel := stmt.(*QLSelect)
+	if sel.Table != "t" || !reflect.DeepEqual(sel.Names, []string{"*", "b", "c"}) || sel.Limit != 10 || sel.Offset != 2 {
+		t.Fatalf("wrong select: %+v", sel)
+	}
+
+	stmt, err = ParseStmt("insert into t (a, b) values (1, 'x'), (2, 'y')")
+	if err != nil {
+		t.Fatalf("fail to parse, err: %s", err)
+	}
+	if ins := stmt.(*QLInsert); ins.Mode != MODE_INSERT_ONLY || len(ins.Values) != 2 {
+		t.Fatalf("wrong insert: %+v", ins)
+	}
+
+	for _, bad := range []string{
+		"select from t",
+		"select a from t where",
+		"insert into t (a, b) values (1)",
+		"update t set a = 1 extra",
+		"delete from t where a = 'x",
+		"create table t (a int64)",
+		"create table t (a int32, primary key (a))",
+		"drop table t",
+		"select a from t where a > 1e",
+		"select a from t where a > 1.5x",
+		"select 99999999999999999999 from t",
+		"create table t (true int64, primary key (true))",
+		"select a from t where a is 1",
+		"select a from t where a is not",
+	} {
+		if _, err := ParseStmt(bad); err == nil {
+			t.Fatalf("expect an error: %s", bad)
+		}
+	}
+}